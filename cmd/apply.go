@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thanhpk/randstr"
+)
+
+// savedPlansPrefix - backend key prefix of the plans saved by plan --out
+const savedPlansPrefix = "plans/"
+
+// savedPlanFile - metadata of a saved plan, stored with its artifacts
+const savedPlanFile = "plan.json"
+
+// Saved plan artifacts
+const (
+	savedPlanReportFile    = "report.json"
+	savedPlanKopsFile      = "kops.yaml"
+	savedPlanManifestsFile = "k8s.yaml"
+)
+
+// savedPlanIDPattern - plan IDs are used in backend keys, so they are restricted to safe characters
+var savedPlanIDPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z-]*$`)
+
+// SavedPlan - a plan saved to the remote state by plan --out, and applied by apply --plan
+type SavedPlan struct {
+	ID              string    `json:"id"`
+	Cluster         string    `json:"cluster"`
+	CreatedAt       time.Time `json:"created_at"`
+	KlaristaVersion string    `json:"klarista_version"`
+	// InputChecksum is the checksum of the input files the plan was made with
+	InputChecksum string `json:"input_checksum"`
+	// State is the version of the remote state the plan was made from
+	State *RemoteStateVersion `json:"state"`
+	// OutputChecksum is the checksum of the terraform output the templates were rendered with
+	OutputChecksum string `json:"output_checksum,omitempty"`
+
+	// dir holds the plan artifacts
+	dir string
+}
+
+// NewSavedPlan - describe a new plan of a cluster, made from the given inputs and remote state
+func NewSavedPlan(clusterName, inputChecksum string, state *RemoteStateVersion) *SavedPlan {
+	if state == nil {
+		state = &RemoteStateVersion{Exists: false}
+	}
+
+	now := time.Now().UTC()
+	return &SavedPlan{
+		ID:              now.Format("20060102T150405Z") + "-" + randstr.Hex(4),
+		Cluster:         clusterName,
+		CreatedAt:       now,
+		KlaristaVersion: Version,
+		InputChecksum:   inputChecksum,
+		State:           state,
+	}
+}
+
+func getSavedPlanKey(id string) string {
+	return savedPlansPrefix + id + ".tar"
+}
+
+// getOutputChecksum - checksum of the terraform output that templates are rendered with
+func getOutputChecksum(output []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(output))
+}
+
+// Path - path of a plan artifact
+func (p *SavedPlan) Path(name string) string {
+	return path.Join(p.dir, name)
+}
+
+// terraformPlanFile - path of the terraform plan of a module
+func (p *SavedPlan) terraformPlanFile(module string) (string, error) {
+	fp := p.Path(module + ".tfplan")
+	if !fileExists(fp) {
+		return "", NewInputError(`Plan %s has no terraform plan for the %s module. Run "klarista plan %s --out" to save a new plan`, p.ID, module, p.Cluster)
+	}
+	return fp, nil
+}
+
+// rendered - the templates rendered when the plan was made, or nil to render them now
+//
+// Templates aren't rendered before the cluster terraform is applied, or while
+// the cluster doesn't exist. They are also rendered again if applying the
+// terraform plan changed the terraform output in outputFile, since the saved
+// ones would push a stale spec.
+func (p *SavedPlan) rendered(name, outputFile string) ([]byte, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	fp := p.Path(name)
+	if !fileExists(fp) {
+		Logger.Warnf(`Plan %s has no rendered %s, rendering it with the current terraform output`, p.ID, name)
+		return nil, nil
+	}
+
+	output, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	if getOutputChecksum(output) != p.OutputChecksum {
+		Logger.Warnf(`The terraform output changed since plan %s rendered %s, rendering it with the current terraform output`, p.ID, name)
+		return nil, nil
+	}
+
+	return ioutil.ReadFile(fp)
+}
+
+// check - refuse to apply the plan to inputs other than the ones it was made with
+func (p *SavedPlan) check(clusterName, inputChecksum string) error {
+	if p.Cluster != clusterName {
+		return NewInputError(`Plan %s was saved for cluster "%s", not "%s"`, p.ID, p.Cluster, clusterName)
+	}
+
+	if p.KlaristaVersion != Version {
+		return NewInputError(
+			`Plan %s was saved by klarista %s, but this is klarista %s. Run "klarista plan %s --out" to save a new plan`,
+			p.ID,
+			p.KlaristaVersion,
+			Version,
+			clusterName,
+		)
+	}
+
+	if p.InputChecksum != inputChecksum {
+		return NewInputError(
+			`The inputs of cluster "%s" changed since plan %s was saved. Run "klarista plan %s --out" to save a new plan`,
+			clusterName,
+			p.ID,
+			clusterName,
+		)
+	}
+
+	return nil
+}
+
+// checkState - refuse to apply the plan to a remote state other than the one it was made from
+func (p *SavedPlan) checkState(current *RemoteStateVersion) error {
+	if current == nil {
+		current = &RemoteStateVersion{Exists: false}
+	}
+
+	if !p.State.Equal(current) {
+		return NewStateError(
+			`The remote state of cluster "%s" changed since plan %s was saved (expected %s, found %s). Run "klarista plan %s --out" to save a new plan`,
+			p.Cluster,
+			p.ID,
+			p.State,
+			current,
+			p.Cluster,
+		)
+	}
+
+	return nil
+}
+
+// writeSavedPlan - store the plan and its artifacts under the plan ID
+func writeSavedPlan(backend StateBackend, plan *SavedPlan, artifacts map[string][]byte) error {
+	planBytes, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return useTempDir(func(dir string) error {
+		for name, data := range artifacts {
+			if err := ioutil.WriteFile(path.Join(dir, name), data, 0600); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(path.Join(dir, savedPlanFile), planBytes, 0600); err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if _, err := writeStateArchive(&buf, dir, stateCompression); err != nil {
+			return &StateError{Err: err}
+		}
+
+		key := getSavedPlanKey(plan.ID)
+		Logger.Debugf("Writing plan to %s", backend.Location(key))
+
+		if _, err := backend.Write(key, &buf, getRemoteStateMetadata(getStateLayoutVersion())); err != nil {
+			return NewStateError("Failed to write plan %s, %v", plan.ID, err)
+		}
+		return nil
+	})
+}
+
+// readSavedPlan - download the plan with the given ID, and unpack its artifacts into dir
+func readSavedPlan(backend StateBackend, id, dir string) (*SavedPlan, error) {
+	if !savedPlanIDPattern.MatchString(id) {
+		return nil, NewInputError(`Invalid plan ID "%s"`, id)
+	}
+
+	key := getSavedPlanKey(id)
+
+	file, err := ioutil.TempFile("", "klarista-plan-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = backend.Read(key, "", file)
+	file.Close()
+	if err != nil {
+		if err == ErrStateNotFound {
+			return nil, NewInputError("Plan %s does not exist at %s", id, backend.Location(key))
+		}
+		return nil, NewStateError("Failed to download plan %s, %v", id, err)
+	}
+
+	if err = os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err = extractStateArchive(file.Name(), dir); err != nil {
+		return nil, &StateError{Err: err}
+	}
+
+	planBytes, err := ioutil.ReadFile(path.Join(dir, savedPlanFile))
+	if err != nil {
+		return nil, NewStateError("Failed to read plan %s, %v", id, err)
+	}
+
+	var plan SavedPlan
+	if err = json.Unmarshal(planBytes, &plan); err != nil {
+		return nil, NewStateError("Failed to parse plan %s, %v", id, err)
+	}
+	if plan.ID != id {
+		return nil, NewStateError("Plan %s contains plan %s", id, plan.ID)
+	}
+	if plan.State == nil {
+		plan.State = &RemoteStateVersion{Exists: false}
+	}
+	plan.dir = dir
+
+	return &plan, nil
+}
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply <name>",
+	Short: "Apply a plan saved with plan --out",
+	Long:  "Apply a plan saved with plan --out. Applies the saved terraform plans, and the kops templates and k8s manifests rendered when the plan was made, then runs every other create phase. Refuses to apply the plan if the inputs or the remote state changed since it was saved.",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
+		planID, _ := cmd.Flags().GetString("plan")
+
+		return runCreate(cmd, args[0], planID)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+	applyCmd.Flags().String("plan", "", "ID of the plan to apply, as printed by plan --out")
+	applyCmd.MarkFlagRequired("plan")
+	applyCmd.Flags().Bool("fast", false, "Apply updates as quickly as possible. This is not safe in production")
+	applyCmd.Flags().StringVar(&recordFile, "record", "", "Record the external commands and their results to a fixture file")
+	applyCmd.Flags().StringVar(&replayFile, "replay", "", "Replay the external commands from a fixture file instead of running them")
+	applyCmd.Flags().Duration("timeout", 30*time.Minute, "Time to wait for the cluster to pass validation and accept requests. 0 waits forever")
+	applyCmd.Flags().Bool("yes", false, "Skip confirmation")
+	applyCmd.Flags().String("client-authentication-api-version", "client.authentication.k8s.io/v1beta1", "Version of the Kubernetes Client Authentication API to use when generating the Kubeconfig file")
+}
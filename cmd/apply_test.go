@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplySavedPlanWithChangedOutput(t *testing.T) {
+	const name = "dev2-lavender.bfmiv.com"
+
+	input, err := ioutil.ReadFile(path.Join("..", "test", "fixtures", name, "input.tfvars"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const output = `{"aws_region":{"value":"us-east-1"},"private_subnet_ids":{"value":["subnet-a"]}}`
+
+	tests := []struct {
+		name string
+		// applied is the terraform output after the saved terraform plan is applied
+		applied string
+		// renders is the number of templates apply is expected to render again, instead of using the saved ones
+		renders int
+	}{
+		{
+			name:    "output unchanged",
+			applied: output,
+		},
+		{
+			name:    "output changed",
+			applied: `{"aws_region":{"value":"us-east-1"},"private_subnet_ids":{"value":["subnet-b"]}}`,
+			renders: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, _ := useTestToolchain(t)
+
+			tmpDir := t.TempDir()
+			t.Setenv("TMPDIR", tmpDir)
+
+			workDir := t.TempDir()
+			if err := ioutil.WriteFile(path.Join(workDir, "input.tfvars"), input, 0644); err != nil {
+				t.Fatal(err)
+			}
+			useTestWorkDir(t, workDir)
+
+			stateFlags := []string{"--state-backend", "local", "--state-local-dir", path.Join(tmpDir, "state")}
+
+			// The output of create's tf and tf-finish phases is what plan renders the templates with
+			tc.On("terraform", "output", "-json").Times(2).Stdout(output)
+			tc.On("terraform", "output", "-json").Stdout(tt.applied)
+			tc.On("terraform", "plan").
+				WritesFile("$TMPDIR/"+name+".plan/tf_state.tfplan", "").
+				WritesFile("$TMPDIR/"+name+".plan/tf.tfplan", "")
+			tc.On("terraform", "show", "-json").Stdout(`{}`)
+			tc.On("kops", "toolbox", "template").Stdout("kind: Cluster\nmetadata:\n  name: " + name + "\n")
+			tc.On("kops", "update", "cluster").WritesFile("kubernetes.tf", "")
+			tc.On("kops", "validate", "cluster").Stdout(`{}`)
+
+			if err := executeTestCommand(t, append(stateFlags, "create", name, "--yes")...); err != nil {
+				t.Fatalf("create = %v", err)
+			}
+
+			if err := executeTestCommand(t, append(stateFlags, "plan", name, "--out")...); err != nil {
+				t.Fatalf("plan = %v", err)
+			}
+
+			plans, err := filepath.Glob(path.Join(tmpDir, "state", getStateBucketName(name), savedPlansPrefix, "*.tar"))
+			if err != nil || len(plans) != 1 {
+				t.Fatalf("saved plans = %v, %v", plans, err)
+			}
+			planID := strings.TrimSuffix(path.Base(plans[0]), ".tar")
+
+			planned := len(tc.CallsTo("kops", "toolbox", "template"))
+
+			if err := executeTestCommand(t, append(stateFlags, "apply", name, "--plan", planID, "--yes")...); err != nil {
+				t.Fatalf("apply = %v", err)
+			}
+
+			if renders := len(tc.CallsTo("kops", "toolbox", "template")) - planned; renders != tt.renders {
+				t.Errorf("apply rendered %d templates, want %d", renders, tt.renders)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// State archive compression algorithms
+const (
+	stateCompressionGzip = "gzip"
+	stateCompressionZstd = "zstd"
+	stateCompressionNone = "none"
+)
+
+// stateArchiveFormatVersion - version of the state archive layout written by this build
+//
+// Version 1 archives are plain tarballs without a manifest.
+const stateArchiveFormatVersion = 2
+
+// stateManifestPath - path of the manifest inside the state archive
+const stateManifestPath = ".klarista/manifest.json"
+
+// stateSignaturePath - path of the manifest signature inside the state archive
+const stateSignaturePath = ".klarista/manifest.sig"
+
+// stateCompression - compression algorithm used to write state archives
+var stateCompression string
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// StateManifest - describes the content of a state archive
+type StateManifest struct {
+	FormatVersion int                  `json:"format_version"`
+	StateVersion  int                  `json:"state_version"`
+	WriterVersion string               `json:"writer_version"`
+	CreatedAt     time.Time            `json:"created_at"`
+	Files         []*StateManifestFile `json:"files"`
+}
+
+// StateManifestFile - describes one file in a state archive
+type StateManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Digests - map each file path to the sha256 of its content
+func (m *StateManifest) Digests() map[string]string {
+	digests := map[string]string{}
+	for _, f := range m.Files {
+		digests[f.Path] = f.SHA256
+	}
+	return digests
+}
+
+// isExcludedFromState - whether a local state dir entry is kept out of the state archive
+func isExcludedFromState(fpath string, info os.FileInfo) bool {
+	if info.IsDir() {
+		return info.Name() == ".terraform"
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return true
+	}
+	return strings.HasSuffix(info.Name(), ".backup") ||
+		info.Name() == ".kubeconfig.admin.yaml" ||
+		fpath == remoteStateRecordFile
+}
+
+// newCompressedWriter - wrap w with the given compression algorithm
+func newCompressedWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case stateCompressionGzip, "":
+		return gzip.NewWriter(w), nil
+	case stateCompressionZstd:
+		return zstd.NewWriter(w)
+	case stateCompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, NewInputError(
+			`Unknown state compression "%s". Expected one of [%s, %s, %s]`,
+			compression,
+			stateCompressionGzip,
+			stateCompressionZstd,
+			stateCompressionNone,
+		)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// writeStateArchive - stream the content of dir to w as a compressed state archive
+func writeStateArchive(w io.Writer, dir string, compression string) (*StateManifest, error) {
+	compressed, err := newCompressedWriter(w, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := tar.NewWriter(compressed)
+
+	migrations, err := readStateMigrationRecord(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &StateManifest{
+		FormatVersion: stateArchiveFormatVersion,
+		StateVersion:  migrations.StateVersion,
+		WriterVersion: Version,
+		CreatedAt:     time.Now().UTC(),
+	}
+
+	err = useDirWalk(dir, func(fpath string, info os.FileInfo) error {
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = fpath
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// Ownership is meaningless on another machine
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+
+		if err = writer.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		Logger.Debugf(`Adding "%s" to state file`, fpath)
+
+		file, err := os.Open(path.Join(dir, fpath))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		size, err := io.Copy(writer, io.TeeReader(file, hash))
+		if err != nil {
+			return err
+		}
+
+		manifest.Files = append(manifest.Files, &StateManifestFile{
+			Path:   fpath,
+			Size:   size,
+			SHA256: fmt.Sprintf("%x", hash.Sum(nil)),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.WriteHeader(&tar.Header{
+		Name:    stateManifestPath,
+		Mode:    0644,
+		ModTime: manifest.CreatedAt,
+		Size:    int64(len(manifestBytes)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = writer.Write(manifestBytes); err != nil {
+		return nil, err
+	}
+
+	if signature := signStateManifest(manifestBytes); signature != nil {
+		signatureBytes, err := json.MarshalIndent(signature, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		err = writer.WriteHeader(&tar.Header{
+			Name:    stateSignaturePath,
+			Mode:    0644,
+			ModTime: manifest.CreatedAt,
+			Size:    int64(len(signatureBytes)),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = writer.Write(signatureBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	if err = compressed.Close(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// useDirWalk - call cb for every entry of dir that belongs in the state archive
+func useDirWalk(dir string, cb func(string, os.FileInfo) error) error {
+	return filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fpath, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+
+		if fpath == "." {
+			return nil
+		}
+
+		if isExcludedFromState(fpath, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return cb(filepath.ToSlash(fpath), info)
+	})
+}
+
+// openStateArchive - read a state archive in any supported format
+func openStateArchive(r io.Reader) (*tar.Reader, func(), error) {
+	buffered := bufio.NewReader(r)
+
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(reader), func() { reader.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		reader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(reader), reader.Close, nil
+	default:
+		// Version 1 archives are plain tarballs
+		return tar.NewReader(buffered), func() {}, nil
+	}
+}
+
+// useStateArchive - call cb for every entry of the state archive at fp
+func useStateArchive(fp string, cb func(*tar.Header, io.Reader) error) error {
+	file, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, closeReader, err := openStateArchive(file)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = cb(hdr, reader); err != nil {
+			return err
+		}
+	}
+}
+
+// readStateManifest - read the manifest of the state archive at fp, or nil for version 1 archives
+func readStateManifest(fp string) (*StateManifest, error) {
+	var manifest *StateManifest
+
+	err := useStateArchive(fp, func(hdr *tar.Header, r io.Reader) error {
+		if path.Clean(hdr.Name) != stateManifestPath {
+			return nil
+		}
+		manifest = &StateManifest{}
+		return json.NewDecoder(r).Decode(manifest)
+	})
+
+	return manifest, err
+}
+
+// isStateMetadataPath - whether name is archive metadata rather than part of the state
+func isStateMetadataPath(name string) bool {
+	return name == stateManifestPath || name == stateSignaturePath
+}
+
+// extractStateArchive - verify the state archive at fp, then unpack it into dir
+func extractStateArchive(fp, dir string) error {
+	if _, err := checkStateArchive(fp); err != nil {
+		return err
+	}
+
+	return unpackStateArchive(fp, dir)
+}
+
+// unpackStateArchive - unpack the state archive at fp into dir without verifying it
+func unpackStateArchive(fp, dir string) error {
+	return useStateArchive(fp, func(hdr *tar.Header, r io.Reader) error {
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+
+		if isStateMetadataPath(name) {
+			return nil
+		}
+
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf(`Refusing to extract "%s" outside of the state directory`, hdr.Name)
+		}
+
+		target := path.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			return os.Chmod(target, hdr.FileInfo().Mode().Perm())
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				return err
+			}
+
+			file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			if _, err = io.Copy(file, r); err != nil {
+				return err
+			}
+
+			// The mode of an existing file is not changed by OpenFile
+			if err = file.Chmod(hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+
+			return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		default:
+			Logger.Warnf(`Skipping unsupported state file entry "%s"`, hdr.Name)
+			return nil
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// ErrStateNotFound - returned when a state object does not exist
+var ErrStateNotFound = errors.New("state object not found")
+
+// ErrStateStoreNotFound - returned when the bucket or directory holding the state does not exist
+var ErrStateStoreNotFound = errors.New("state store not found")
+
+// StateObject - one stored version of a state object
+type StateObject struct {
+	Key          string            `json:"key"`
+	VersionID    string            `json:"version_id,omitempty"`
+	ETag         string            `json:"etag"`
+	Size         int64             `json:"size"`
+	LastModified time.Time         `json:"last_modified"`
+	IsLatest     bool              `json:"is_latest"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// Version - identify the version of the remote state this object represents
+func (o *StateObject) Version() *RemoteStateVersion {
+	return &RemoteStateVersion{
+		Exists:    true,
+		ETag:      o.ETag,
+		VersionID: o.VersionID,
+	}
+}
+
+// StateBackend - storage for remote klarista state
+//
+// Keys are relative to the backend, which is scoped to a single cluster.
+type StateBackend interface {
+	// Read copies a version of key to w. An empty versionID reads the current version
+	Read(key, versionID string, w io.Writer) (*StateObject, error)
+	// Write stores r as the new current version of key
+	Write(key string, r io.Reader, metadata map[string]string) (*StateObject, error)
+	// Stat describes the current version of key, or returns ErrStateNotFound
+	Stat(key string) (*StateObject, error)
+	// Lock takes the state lock, or refreshes it if it is already held by lock.RunID
+	Lock(lock *StateLock) error
+	// Unlock releases the state lock if it is held by lock.RunID, or unconditionally if force is set
+	Unlock(lock *StateLock, force bool) error
+	// LockInfo describes the current state lock, or returns nil if the state is not locked
+	LockInfo() (*StateLock, error)
+	// List describes the current version of every key with the given prefix
+	List(prefix string) ([]*StateObject, error)
+	// Versions describes every stored version of key, newest first
+	Versions(key string) ([]*StateObject, error)
+	// Location returns a human readable location of key
+	Location(key string) string
+}
+
+// State backend names
+const (
+	stateBackendS3    = "s3"
+	stateBackendLocal = "local"
+)
+
+// stateBackendName - name of the configured state backend
+var stateBackendName string
+
+// stateLocalDir - root directory of the local state backend
+var stateLocalDir string
+
+// stateEndpoint - custom endpoint of an S3 compatible state store
+var stateEndpoint string
+
+// statePathStyle - use path-style addressing for the S3 state bucket
+var statePathStyle bool
+
+// stateBucket - state bucket override, shared by every cluster that uses it
+var stateBucket string
+
+// stateKeyPrefix - prefix of every state object key
+var stateKeyPrefix string
+
+func getDefaultStateLocalDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path.Join(os.TempDir(), "klarista-state")
+	}
+	return path.Join(home, ".klarista", "state")
+}
+
+// getStateBucketName - name of the bucket (or local directory) holding the cluster state
+func getStateBucketName(clusterName string) string {
+	if stateBucket != "" {
+		return stateBucket
+	}
+	return strings.ReplaceAll(clusterName, ".", "-") + "-state"
+}
+
+// isStateBucketManaged - whether klarista creates and destroys the state bucket with the cluster
+//
+// An overridden bucket may be shared with other clusters, so it must be managed elsewhere.
+func isStateBucketManaged() bool {
+	return stateBucket == ""
+}
+
+// getKopsStateStore - kops state store URL for a cluster
+func getKopsStateStore(clusterName string) string {
+	return "s3://" + path.Join(getStateBucketName(clusterName), stateKeyPrefix, "kops")
+}
+
+// setKopsStateStoreEnv - point kops at the cluster state store
+func setKopsStateStoreEnv(clusterName string) error {
+	if err := os.Setenv("KOPS_STATE_STORE", getKopsStateStore(clusterName)); err != nil {
+		return err
+	}
+
+	// See https://kops.sigs.k8s.io/state/#s3-compatible-storage
+	if stateEndpoint != "" {
+		return os.Setenv("S3_ENDPOINT", stateEndpoint)
+	}
+	return nil
+}
+
+func newStateSession() (*session.Session, error) {
+	config := aws.NewConfig().WithS3ForcePathStyle(statePathStyle)
+	if stateEndpoint != "" {
+		config = config.WithEndpoint(stateEndpoint)
+	}
+	return session.NewSession(config)
+}
+
+// getStateBackend - construct the configured state backend for a cluster
+func getStateBackend(clusterName string) (StateBackend, error) {
+	var backend StateBackend
+
+	switch stateBackendName {
+	case stateBackendS3, "":
+		sess, err := newStateSession()
+		if err != nil {
+			return nil, &StateError{Err: err}
+		}
+		backend = NewS3StateBackend(
+			sess,
+			getStateBucketName(clusterName),
+			stateKeyPrefix,
+		)
+	case stateBackendLocal:
+		backend = NewLocalStateBackend(path.Join(stateLocalDir, getStateBucketName(clusterName), stateKeyPrefix))
+	default:
+		return nil, NewInputError(`Unknown state backend "%s". Expected one of [%s, %s]`, stateBackendName, stateBackendS3, stateBackendLocal)
+	}
+
+	return NewEncryptedStateBackend(backend, clusterName), nil
+}
@@ -0,0 +1,407 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thanhpk/randstr"
+)
+
+// localStateVersionsDir - directory holding every stored version of each key
+const localStateVersionsDir = ".versions"
+
+// LocalStateBackend - state backend storing objects in a local directory
+//
+// The current version of each key is stored at <root>/<key>. Every version,
+// including the current one, is also kept in <root>/.versions/<key>/ along
+// with a JSON description of the version.
+type LocalStateBackend struct {
+	root string
+}
+
+func NewLocalStateBackend(root string) *LocalStateBackend {
+	return &LocalStateBackend{root: root}
+}
+
+func (b *LocalStateBackend) Location(key string) string {
+	return path.Join(b.root, key)
+}
+
+func (b *LocalStateBackend) versionPath(key, versionID string) string {
+	return path.Join(b.root, localStateVersionsDir, key, versionID)
+}
+
+func (b *LocalStateBackend) readVersion(key, versionID string) (*StateObject, error) {
+	data, err := ioutil.ReadFile(b.versionPath(key, versionID) + ".json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrStateNotFound
+		}
+		return nil, err
+	}
+
+	var object StateObject
+	if err = json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	return &object, nil
+}
+
+// writeFile - atomically replace fp with the content of r
+func (b *LocalStateBackend) writeFile(fp string, r io.Reader) (int64, string, error) {
+	if err := os.MkdirAll(path.Dir(fp), 0755); err != nil {
+		return 0, "", err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(fp), "."+path.Base(fp))
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		tmp.Close()
+		return 0, "", err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return 0, "", err
+	}
+
+	if err = os.Rename(tmp.Name(), fp); err != nil {
+		return 0, "", err
+	}
+
+	return size, fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func (b *LocalStateBackend) Read(key, versionID string, w io.Writer) (*StateObject, error) {
+	var object *StateObject
+	var err error
+
+	if versionID == "" {
+		object, err = b.Stat(key)
+	} else {
+		object, err = b.readVersion(key, versionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(b.versionPath(key, object.VersionID))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(w, file); err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
+
+func (b *LocalStateBackend) Write(key string, r io.Reader, metadata map[string]string) (*StateObject, error) {
+	now := time.Now().UTC()
+	// Version IDs sort chronologically
+	versionID := fmt.Sprintf("%020d-%s", now.UnixNano(), randstr.Hex(4))
+
+	size, etag, err := b.writeFile(b.versionPath(key, versionID), r)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &StateObject{
+		Key:          key,
+		VersionID:    versionID,
+		ETag:         etag,
+		Size:         size,
+		LastModified: now,
+		Metadata:     metadata,
+	}
+
+	data, err := json.MarshalIndent(object, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ioutil.WriteFile(b.versionPath(key, versionID)+".json", data, 0644); err != nil {
+		return nil, err
+	}
+
+	// Point the current version at the new one
+	if err = os.Symlink(versionID, b.versionPath(key, versionID)+".tmp"); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(b.versionPath(key, versionID)+".tmp", b.versionPath(key, "current")); err != nil {
+		return nil, err
+	}
+
+	// Keep a plain copy of the current version for convenience
+	file, err := os.Open(b.versionPath(key, versionID))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, _, err = b.writeFile(b.Location(key), file); err != nil {
+		return nil, err
+	}
+
+	object.IsLatest = true
+
+	return object, nil
+}
+
+func (b *LocalStateBackend) Stat(key string) (*StateObject, error) {
+	versionID, err := os.Readlink(b.versionPath(key, "current"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrStateNotFound
+		}
+		return nil, err
+	}
+
+	object, err := b.readVersion(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	object.IsLatest = true
+
+	return object, nil
+}
+
+func (b *LocalStateBackend) LockInfo() (*StateLock, error) {
+	lock, err := readStateLock(b.Location(remoteStateLockKey))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return lock, err
+}
+
+// readStateLock - read the state lock file at fp
+func readStateLock(fp string) (*StateLock, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock StateLock
+	if err = json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("Failed to parse state lock %s, %v", fp, err)
+	}
+
+	return &lock, nil
+}
+
+// Lock - take the state lock
+//
+// The lock is written to a temporary file and linked into place, which fails
+// if the lock exists, so it is never seen half written. An expired lock is
+// first renamed aside, which only one of several concurrent runs can do.
+func (b *LocalStateBackend) Lock(lock *StateLock) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(b.root, 0755); err != nil {
+		return err
+	}
+
+	fp := b.Location(remoteStateLockKey)
+
+	err = b.createLock(fp, data)
+	if err == nil || !os.IsExist(err) {
+		return err
+	}
+
+	existing, err := b.LockInfo()
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		return fmt.Errorf("State lock %s was released while it was being acquired. Try again", fp)
+	}
+
+	if existing.RunID == lock.RunID {
+		// Refresh the lock held by this run
+		_, _, err = b.writeFile(fp, strings.NewReader(string(data)))
+		return err
+	}
+
+	if !existing.Expired() {
+		return &StateLockedError{Holder: existing}
+	}
+
+	Logger.Warnf("Taking over expired state lock held by %s", existing)
+
+	expired := fmt.Sprintf("%s.%s.expired", fp, lock.RunID)
+	if err = os.Rename(fp, expired); err != nil {
+		if os.IsNotExist(err) {
+			return b.lockedBy(fp)
+		}
+		return err
+	}
+	defer os.Remove(expired)
+
+	// Put the lock back if another run replaced it since it was read
+	if moved, err := readStateLock(expired); err != nil || moved.RunID != existing.RunID {
+		if err = os.Link(expired, fp); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return b.lockedBy(fp)
+	}
+
+	if err = b.createLock(fp, data); err != nil {
+		if os.IsExist(err) {
+			return b.lockedBy(fp)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// createLock - write the lock at fp, unless it exists
+func (b *LocalStateBackend) createLock(fp string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(fp), "."+path.Base(fp))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Link(tmp.Name(), fp)
+}
+
+// lockedBy - the error for a lock that another run took while it was being acquired
+func (b *LocalStateBackend) lockedBy(fp string) error {
+	current, err := b.LockInfo()
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("State lock %s was released while it was being acquired. Try again", fp)
+	}
+	return &StateLockedError{Holder: current}
+}
+
+func (b *LocalStateBackend) Unlock(lock *StateLock, force bool) error {
+	if !force {
+		existing, err := b.LockInfo()
+		if err != nil {
+			return err
+		}
+
+		if existing == nil {
+			Logger.Warnf("State lock %s was already released", b.Location(remoteStateLockKey))
+			return nil
+		}
+
+		if existing.RunID != lock.RunID {
+			Logger.Warnf("State lock is now held by %s; leaving it in place", existing)
+			return nil
+		}
+	}
+
+	if err := os.Remove(b.Location(remoteStateLockKey)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (b *LocalStateBackend) List(prefix string) ([]*StateObject, error) {
+	var objects []*StateObject
+
+	versionsRoot := path.Join(b.root, localStateVersionsDir)
+	if !fileExists(versionsRoot) {
+		return objects, nil
+	}
+
+	err := filepath.Walk(versionsRoot, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() != "current" || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		key, err := filepath.Rel(versionsRoot, path.Dir(fp))
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		object, err := b.Stat(key)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, object)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+func (b *LocalStateBackend) Versions(key string) ([]*StateObject, error) {
+	entries, err := ioutil.ReadDir(path.Join(b.root, localStateVersionsDir, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	current, err := b.Stat(key)
+	if err != nil && err != ErrStateNotFound {
+		return nil, err
+	}
+
+	var versions []*StateObject
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		object, err := b.readVersion(key, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		object.IsLatest = current != nil && current.VersionID == object.VersionID
+		versions = append(versions, object)
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].VersionID > versions[j].VersionID
+	})
+
+	return versions, nil
+}
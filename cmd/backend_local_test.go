@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalStateBackendLock(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is the lock held before Lock is called, if any
+		existing *StateLock
+		// holder is the run ID of the StateLockedError, or empty if the lock is taken
+		holder string
+	}{
+		{
+			name: "free",
+		},
+		{
+			name:     "held by another run",
+			existing: newTestStateLock("other", time.Hour),
+			holder:   "other",
+		},
+		{
+			name:     "refreshed by the run holding it",
+			existing: newTestStateLock("mine", time.Hour),
+		},
+		{
+			name:     "expired",
+			existing: newTestStateLock("other", -time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewLocalStateBackend(t.TempDir())
+			if tt.existing != nil {
+				if err := backend.Lock(tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := backend.Lock(newTestStateLock("mine", time.Hour))
+
+			if tt.holder != "" {
+				lockedErr, ok := err.(*StateLockedError)
+				if !ok {
+					t.Fatalf("Lock() = %v, want a StateLockedError", err)
+				}
+				if lockedErr.Holder.RunID != tt.holder {
+					t.Errorf("lock is held by run %s, want %s", lockedErr.Holder.RunID, tt.holder)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Lock() = %v, want nil", err)
+			}
+			current, err := backend.LockInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current == nil || current.RunID != "mine" {
+				t.Errorf("lock is held by %v, want run mine", current)
+			}
+		})
+	}
+}
+
+func TestLocalStateBackendLockConcurrent(t *testing.T) {
+	for _, existing := range []*StateLock{nil, newTestStateLock("other", -time.Hour)} {
+		name := "free"
+		if existing != nil {
+			name = "expired"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			backend := NewLocalStateBackend(t.TempDir())
+			if existing != nil {
+				if err := backend.Lock(existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			const runs = 8
+			errs := make([]error, runs)
+
+			var wg sync.WaitGroup
+			for i := 0; i < runs; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = backend.Lock(newTestStateLock(fmt.Sprintf("run-%d", i), time.Hour))
+				}(i)
+			}
+			wg.Wait()
+
+			taken := 0
+			for _, err := range errs {
+				if err == nil {
+					taken++
+				}
+			}
+			if taken != 1 {
+				t.Errorf("%d runs took the lock, want 1: %v", taken, errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3StateBackend - state backend storing objects in an S3 compatible bucket
+type S3StateBackend struct {
+	bucket   string
+	prefix   string
+	client   s3iface.S3API
+	uploader *s3manager.Uploader
+
+	// conditionalWritesChecked - whether the store was checked for If-None-Match support
+	conditionalWritesChecked bool
+}
+
+func NewS3StateBackend(sess *session.Session, bucket, prefix string) *S3StateBackend {
+	return &S3StateBackend{
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}
+}
+
+// objectKey - full object key of a backend key
+func (b *S3StateBackend) objectKey(key string) *string {
+	return aws.String(path.Join(b.prefix, key))
+}
+
+func (b *S3StateBackend) Location(key string) string {
+	return fmt.Sprintf("s3://%s/%s", b.bucket, *b.objectKey(key))
+}
+
+func isAwsErrorCode(err error, codes ...string) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		for _, code := range codes {
+			if aerr.Code() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *S3StateBackend) wrapError(err error) error {
+	if isAwsErrorCode(err, s3.ErrCodeNoSuchBucket) {
+		return fmt.Errorf("%w: bucket %s does not exist", ErrStateStoreNotFound, b.bucket)
+	}
+	if isAwsErrorCode(err, s3.ErrCodeNoSuchKey, "NotFound", "NoSuchVersion") {
+		return ErrStateNotFound
+	}
+	return err
+}
+
+func (b *S3StateBackend) Read(key, versionID string, w io.Writer) (*StateObject, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.objectKey(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	result, err := b.client.GetObject(input)
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+	defer result.Body.Close()
+
+	if _, err = io.Copy(w, result.Body); err != nil {
+		return nil, err
+	}
+
+	return &StateObject{
+		Key:          key,
+		VersionID:    aws.StringValue(result.VersionId),
+		ETag:         aws.StringValue(result.ETag),
+		Size:         aws.Int64Value(result.ContentLength),
+		LastModified: aws.TimeValue(result.LastModified),
+		Metadata:     aws.StringValueMap(result.Metadata),
+	}, nil
+}
+
+func (b *S3StateBackend) Write(key string, r io.Reader, metadata map[string]string) (*StateObject, error) {
+	_, err := b.uploader.Upload(&s3manager.UploadInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      b.objectKey(key),
+		Body:     r,
+		Metadata: aws.StringMap(metadata),
+	})
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+
+	return b.Stat(key)
+}
+
+func (b *S3StateBackend) stat(key, versionID string) (*StateObject, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.objectKey(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	result, err := b.client.HeadObject(input)
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+
+	return &StateObject{
+		Key:          key,
+		VersionID:    aws.StringValue(result.VersionId),
+		ETag:         aws.StringValue(result.ETag),
+		Size:         aws.Int64Value(result.ContentLength),
+		LastModified: aws.TimeValue(result.LastModified),
+		IsLatest:     versionID == "",
+		Metadata:     aws.StringValueMap(result.Metadata),
+	}, nil
+}
+
+func (b *S3StateBackend) Stat(key string) (*StateObject, error) {
+	return b.stat(key, "")
+}
+
+func (b *S3StateBackend) LockInfo() (*StateLock, error) {
+	lock, _, err := b.readLock()
+	return lock, err
+}
+
+// readLock - the current state lock and the ETag to write it conditionally, or nil if the state is not locked
+func (b *S3StateBackend) readLock() (*StateLock, string, error) {
+	var body bytes.Buffer
+	object, err := b.Read(remoteStateLockKey, "", &body)
+	if err != nil {
+		if err == ErrStateNotFound {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	var lock StateLock
+	if err := json.Unmarshal(body.Bytes(), &lock); err != nil {
+		return nil, "", fmt.Errorf("Failed to parse state lock %s, %v", b.Location(remoteStateLockKey), err)
+	}
+
+	return &lock, object.ETag, nil
+}
+
+// writeLock - write the state lock if the condition holds, e.g. If-None-Match: *, or unconditionally
+//
+// The SDK has no fields for the conditions of PutObject, so they are set as headers.
+func (b *S3StateBackend) writeLock(lock *StateLock, condition, value string) error {
+	body, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	req, _ := b.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         b.objectKey(remoteStateLockKey),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if condition != "" {
+		req.HTTPRequest.Header.Set(condition, value)
+	}
+
+	return b.wrapError(req.Send())
+}
+
+// isPreconditionFailed - whether a conditional write failed because the object changed
+func isPreconditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		// S3 returns 409 while another conditional write of the object is in flight
+		return reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict
+	}
+	return false
+}
+
+// isConditionNotImplemented - whether the store rejected the condition of a write
+func isConditionNotImplemented(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotImplemented
+	}
+	return false
+}
+
+// Lock - take the state lock
+//
+// The lock is created with If-None-Match: *, and taken over or refreshed with
+// If-Match: <etag> of the lock that was read, so that of two concurrent runs
+// only one can write it. The other gets 412 Precondition Failed, and backs off.
+func (b *S3StateBackend) Lock(lock *StateLock) error {
+	existing, etag, err := b.readLock()
+	if err != nil {
+		return err
+	}
+
+	condition, value := "If-None-Match", "*"
+	if existing != nil {
+		if existing.RunID != lock.RunID {
+			if !existing.Expired() {
+				return &StateLockedError{Holder: existing}
+			}
+			Logger.Warnf("Taking over expired state lock held by %s", existing)
+		}
+		condition, value = "If-Match", etag
+	}
+
+	err = b.writeLock(lock, condition, value)
+
+	if isConditionNotImplemented(err) {
+		Logger.Warnf(
+			"The state store doesn't support conditional writes, so concurrent runs may take the state lock %s at the same time",
+			b.Location(remoteStateLockKey),
+		)
+		err = b.writeLock(lock, "", "")
+	}
+
+	// S3 returns 404 for If-Match if the object no longer exists
+	if isPreconditionFailed(err) || err == ErrStateNotFound {
+		// Another run took, refreshed or released the lock since it was read
+		current, _, err := b.readLock()
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return fmt.Errorf("State lock %s was released while it was being acquired. Try again", b.Location(remoteStateLockKey))
+		}
+		return &StateLockedError{Holder: current}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		b.checkConditionalWrites(lock)
+	}
+
+	return nil
+}
+
+// checkConditionalWrites - warn if the store ignores the conditions of writes, once per backend
+//
+// Creating the lock again must fail, since it exists. Stores that ignore
+// If-None-Match write it instead, which is harmless since it is unchanged.
+func (b *S3StateBackend) checkConditionalWrites(lock *StateLock) {
+	if b.conditionalWritesChecked {
+		return
+	}
+	b.conditionalWritesChecked = true
+
+	err := b.writeLock(lock, "If-None-Match", "*")
+	if isPreconditionFailed(err) {
+		return
+	}
+	if err != nil {
+		Logger.Debugf("Failed to check conditional writes, %v", err)
+		return
+	}
+
+	Logger.Warnf(
+		"The state store ignores conditional writes, so concurrent runs may take the state lock %s at the same time",
+		b.Location(remoteStateLockKey),
+	)
+}
+
+func (b *S3StateBackend) Unlock(lock *StateLock, force bool) error {
+	if !force {
+		existing, err := b.LockInfo()
+		if err != nil {
+			return err
+		}
+
+		if existing == nil {
+			Logger.Warnf("State lock %s was already released", b.Location(remoteStateLockKey))
+			return nil
+		}
+
+		if existing.RunID != lock.RunID {
+			Logger.Warnf("State lock is now held by %s; leaving it in place", existing)
+			return nil
+		}
+	}
+
+	_, err := b.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.objectKey(remoteStateLockKey),
+	})
+
+	return b.wrapError(err)
+}
+
+func (b *S3StateBackend) List(prefix string) ([]*StateObject, error) {
+	var objects []*StateObject
+
+	// Don't match keys of clusters with a longer prefix
+	listPrefix := *b.objectKey(prefix)
+	if prefix == "" && b.prefix != "" {
+		listPrefix += "/"
+	}
+
+	err := b.client.ListObjectsV2Pages(
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(b.bucket),
+			Prefix: aws.String(listPrefix),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, o := range page.Contents {
+				objects = append(objects, &StateObject{
+					Key:          strings.TrimPrefix(strings.TrimPrefix(aws.StringValue(o.Key), b.prefix), "/"),
+					ETag:         aws.StringValue(o.ETag),
+					Size:         aws.Int64Value(o.Size),
+					LastModified: aws.TimeValue(o.LastModified),
+					IsLatest:     true,
+				})
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+
+	return objects, nil
+}
+
+func (b *S3StateBackend) Versions(key string) ([]*StateObject, error) {
+	var versions []*StateObject
+
+	err := b.client.ListObjectVersionsPages(
+		&s3.ListObjectVersionsInput{
+			Bucket: aws.String(b.bucket),
+			Prefix: b.objectKey(key),
+		},
+		func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			for _, v := range page.Versions {
+				if aws.StringValue(v.Key) != *b.objectKey(key) {
+					continue
+				}
+				versions = append(versions, &StateObject{
+					Key:          key,
+					VersionID:    aws.StringValue(v.VersionId),
+					ETag:         aws.StringValue(v.ETag),
+					Size:         aws.Int64Value(v.Size),
+					LastModified: aws.TimeValue(v.LastModified),
+					IsLatest:     aws.BoolValue(v.IsLatest),
+				})
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+
+	// Object metadata is not included in version listings
+	for _, v := range versions {
+		object, err := b.stat(key, v.VersionID)
+		if err != nil {
+			return nil, err
+		}
+		v.Metadata = object.Metadata
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+
+	return versions, nil
+}
@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakeS3 - an S3 compatible store of one bucket that honours If-Match and If-None-Match on PUT
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+	// ignoreConditions makes the store write objects whatever the condition
+	ignoreConditions bool
+	// beforePut is called before each PUT is handled, e.g. to let another run write first
+	beforePut func(s *fakeS3)
+}
+
+func (s *fakeS3) etag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(data))
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && s.beforePut != nil {
+		s.beforePut(s)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	data, exists := s.objects[key]
+
+	fail := func(status int, code string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			fail(http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", s.etag(data))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		s.puts++
+		if !s.ignoreConditions {
+			if r.Header.Get("If-None-Match") == "*" && exists {
+				fail(http.StatusPreconditionFailed, "PreconditionFailed")
+				return
+			}
+			if etag := r.Header.Get("If-Match"); etag != "" {
+				if !exists {
+					fail(http.StatusNotFound, "NoSuchKey")
+					return
+				}
+				if etag != s.etag(data) {
+					fail(http.StatusPreconditionFailed, "PreconditionFailed")
+					return
+				}
+			}
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = body
+		w.Header().Set("ETag", s.etag(body))
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// put - write an object directly, like another run would
+func (s *fakeS3) put(t *testing.T, b *S3StateBackend, key string, lock *StateLock) {
+	t.Helper()
+
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.objects[*b.objectKey(key)] = data
+}
+
+// newFakeS3Session - a session for the fake store, served until the test finishes
+func newFakeS3Session(t *testing.T, store *fakeS3) *session.Session {
+	t.Helper()
+
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	return session.Must(session.NewSession(aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithRegion("us-east-1").
+		WithS3ForcePathStyle(true).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0)))
+}
+
+func newTestStateLock(runID string, ttl time.Duration) *StateLock {
+	lock := NewStateLock(ttl)
+	lock.RunID = runID
+	return lock
+}
+
+// getTestWarnings - the warnings logged since the hook was installed, one per line
+func getTestWarnings(hook *logtest.Hook) string {
+	var warnings []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	return strings.Join(warnings, "\n")
+}
+
+func TestS3StateBackendLock(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is the lock held before Lock is called, if any
+		existing *StateLock
+		// store configures the fake store before Lock is called
+		store func(s *fakeS3, b *S3StateBackend)
+		// holder is the run ID of the StateLockedError, or empty if the lock is taken
+		holder string
+		// warning is a substring of the expected warning, if any
+		warning string
+	}{
+		{
+			name: "free",
+		},
+		{
+			name:     "held by another run",
+			existing: newTestStateLock("other", time.Hour),
+			holder:   "other",
+		},
+		{
+			name:     "refreshed by the run holding it",
+			existing: newTestStateLock("mine", time.Hour),
+		},
+		{
+			name:     "expired",
+			existing: newTestStateLock("other", -time.Hour),
+			warning:  "Taking over expired state lock",
+		},
+		{
+			name: "created by another run after it was read",
+			store: func(s *fakeS3, b *S3StateBackend) {
+				s.beforePut = func(s *fakeS3) {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+					if s.puts == 0 {
+						s.put(t, b, remoteStateLockKey, newTestStateLock("racer", time.Hour))
+					}
+				}
+			},
+			holder: "racer",
+		},
+		{
+			name:     "expired and taken over by another run after it was read",
+			existing: newTestStateLock("other", -time.Hour),
+			store: func(s *fakeS3, b *S3StateBackend) {
+				s.beforePut = func(s *fakeS3) {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+					if s.puts == 0 {
+						s.put(t, b, remoteStateLockKey, newTestStateLock("racer", time.Hour))
+					}
+				}
+			},
+			holder:  "racer",
+			warning: "Taking over expired state lock",
+		},
+		{
+			name: "store ignores conditions",
+			store: func(s *fakeS3, b *S3StateBackend) {
+				s.ignoreConditions = true
+			},
+			warning: "ignores conditional writes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(Logger)
+			defer hook.Reset()
+
+			store := &fakeS3{objects: map[string][]byte{}}
+			backend := NewS3StateBackend(newFakeS3Session(t, store), "bucket", "")
+			if tt.existing != nil {
+				store.put(t, backend, remoteStateLockKey, tt.existing)
+			}
+			if tt.store != nil {
+				tt.store(store, backend)
+			}
+
+			lock := newTestStateLock("mine", time.Hour)
+			err := backend.Lock(lock)
+
+			if tt.holder == "" {
+				if err != nil {
+					t.Fatalf("Lock() = %v, want nil", err)
+				}
+				current, err := backend.LockInfo()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if current == nil || current.RunID != "mine" {
+					t.Errorf("lock is held by %v, want run mine", current)
+				}
+			} else {
+				lockedErr, ok := err.(*StateLockedError)
+				if !ok {
+					t.Fatalf("Lock() = %v, want a StateLockedError", err)
+				}
+				if lockedErr.Holder.RunID != tt.holder {
+					t.Errorf("lock is held by run %s, want %s", lockedErr.Holder.RunID, tt.holder)
+				}
+			}
+
+			if warnings := getTestWarnings(hook); (warnings == "") != (tt.warning == "") || !strings.Contains(warnings, tt.warning) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warning)
+			}
+		})
+	}
+}
+
+func TestS3StateBackendLockConcurrent(t *testing.T) {
+	store := &fakeS3{objects: map[string][]byte{}}
+	sess := newFakeS3Session(t, store)
+
+	const runs = 8
+	errs := make([]error, runs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each run has its own backend, like separate klarista processes
+			backend := NewS3StateBackend(sess, "bucket", "")
+			errs[i] = backend.Lock(newTestStateLock(fmt.Sprintf("run-%d", i), time.Hour))
+		}(i)
+	}
+	wg.Wait()
+
+	taken := 0
+	for _, err := range errs {
+		if err == nil {
+			taken++
+		}
+	}
+	if taken != 1 {
+		t.Errorf("%d runs took the lock, want 1: %v", taken, errs)
+	}
+}
@@ -1,33 +1,26 @@
 package cmd
 
 import (
-	"archive/tar"
-	"bytes"
+	"bufio"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
-	"os/signal"
 	"path"
 	"path/filepath"
-	"reflect"
+	"regexp"
 	"sort"
 	"strings"
-	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gobuffalo/packr/v2"
 	"github.com/gobwas/glob"
-	"github.com/mholt/archiver/v3"
 	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
 	"github.com/stevenle/topsort"
 	"github.com/thanhpk/randstr"
 	"github.com/thoas/go-funk"
@@ -36,6 +29,50 @@ import (
 // Version - klarista cli version
 var Version = "latest"
 
+// maxClusterNameLength - limit on cluster names enforced by assets/tf/variables.tf
+const maxClusterNameLength = 44
+
+var dnsLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// validateClusterName - check that name is a DNS name that klarista can use for a cluster
+//
+// The first label is the cluster name and the rest is its DNS zone, so a
+// cluster name has at least two labels.
+func validateClusterName(name string) error {
+	if len(name) > maxClusterNameLength {
+		return fmt.Errorf(`Invalid cluster name "%s": cluster names must be %d characters or less`, name, maxClusterNameLength)
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf(`Invalid cluster name "%s": expected a DNS name with a zone, e.g. "dev-cluster.example.com"`, name)
+	}
+
+	for _, label := range labels {
+		if len(label) > 63 || !dnsLabelPattern.MatchString(label) {
+			return fmt.Errorf(`Invalid cluster name "%s": DNS labels may only contain lowercase letters, digits and "-", and must start and end with a letter or digit`, name)
+		}
+	}
+
+	return nil
+}
+
+// clusterNameArgs - validate args, then check that the first one is a valid cluster name
+func clusterNameArgs(validate cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := validate(cmd, args); err != nil {
+			return &InputError{Err: err}
+		}
+		if err := validateClusterName(args[0]); err != nil {
+			return &InputError{Err: err}
+		}
+		return nil
+	}
+}
+
+// remoteStateKey - object key of the remote state tarball
+const remoteStateKey = "klarista.state.tar"
+
 // AssetWriter - Asset writer strict
 type AssetWriter struct {
 	box           *packr.Box
@@ -58,7 +95,8 @@ func NewAssetWriter(pwd, localStateDir string, box *packr.Box) *AssetWriter {
 	}
 }
 
-func (w *AssetWriter) Digest(args ...interface{}) {
+// Digest - write the assets matching the optional glob pattern to the local state dir
+func (w *AssetWriter) Digest(args ...interface{}) error {
 	var pattern string
 	if len(args) == 1 {
 		pattern = args[0].(string)
@@ -69,7 +107,9 @@ func (w *AssetWriter) Digest(args ...interface{}) {
 		g = glob.MustCompile(pattern)
 	}
 
-	useWorkDir(w.pwd, func() {
+	return useWorkDir(w.pwd, func() error {
+		written := map[string]bool{}
+
 		for _, file := range w.box.List() {
 			fp := path.Join(w.localStateDir, file)
 
@@ -87,71 +127,97 @@ func (w *AssetWriter) Digest(args ...interface{}) {
 
 			data, err := w.box.Find(file)
 			if err != nil {
-				panic(err)
+				return err
 			}
 
 			if err = os.MkdirAll(path.Dir(fp), 0755); err != nil {
-				panic(err)
+				return err
 			}
 
 			if err = ioutil.WriteFile(fp, data, 0644); err != nil {
-				panic(err)
+				return err
 			}
+
+			written[file] = true
 		}
-	})
-}
 
-// InputProcessor - Input processor struct
-type InputProcessor struct {
-	checksum *[]byte
-	hash     hash.Hash
-	writer   *AssetWriter
+		return w.removeStaleInputs(written)
+	})
 }
 
-func NewInputProcessor(writer *AssetWriter) *InputProcessor {
-	p := &InputProcessor{
-		checksum: nil,
-		hash:     sha1.New(),
-		writer:   writer,
-	}
-	p.init()
-	return p
-}
+// removeStaleInputs - remove the files of the inputs dirs that were just written, but not from the current inputs
+//
+// Inputs of earlier runs, e.g. 000.tfvars after switching to YAML, would
+// otherwise be passed to terraform again when no --input is given.
+func (w *AssetWriter) removeStaleInputs(written map[string]bool) error {
+	for _, dir := range inputDirs {
+		inputDir := path.Join(dir, "inputs")
+
+		var found bool
+		for file := range written {
+			if path.Dir(file) == inputDir {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
 
-func (p *InputProcessor) init() {
-	checksumFilePath := path.Join(p.writer.localStateDir, ".checksum")
-	if fileExists(checksumFilePath) {
-		checksumBytes, err := ioutil.ReadFile(checksumFilePath)
+		files, err := ioutil.ReadDir(path.Join(w.localStateDir, inputDir))
 		if err != nil {
-			panic(err)
+			return err
+		}
+
+		for _, file := range files {
+			if written[path.Join(inputDir, file.Name())] {
+				continue
+			}
+
+			Logger.Debugf("Removing stale input %s", path.Join(inputDir, file.Name()))
+			if err := os.RemoveAll(path.Join(w.localStateDir, inputDir, file.Name())); err != nil {
+				return err
+			}
 		}
-		p.checksum = &checksumBytes
-		Logger.Debugf("Got existing checksum from state directory %x", checksumBytes)
 	}
+
+	return nil
+}
+
+// inputDirs - the terraform dirs that read the input files from their inputs dir
+var inputDirs = []string{"tf_vars", "tf_state", "tf"}
+
+// InputProcessor - Input processor struct
+type InputProcessor struct {
+	hash   hash.Hash
+	writer *AssetWriter
 }
 
-func (p *InputProcessor) Changed() bool {
-	if p.checksum == nil {
-		return true
+func NewInputProcessor(writer *AssetWriter) *InputProcessor {
+	return &InputProcessor{
+		hash:   sha1.New(),
+		writer: writer,
 	}
-	return bytes.Compare(p.hash.Sum(nil), *p.checksum) != 0
 }
 
-func (p *InputProcessor) Commit() {
-	p.writer.box.AddBytes(
-		".checksum",
-		p.hash.Sum(nil),
-	)
-	p.writer.Digest(".checksum")
+// Checksum - the checksum of the inputs passed to Digest
+func (p *InputProcessor) Checksum() string {
+	return fmt.Sprintf("%x", p.hash.Sum(nil))
 }
 
-func (p *InputProcessor) Digest(inputPaths []string) []string {
+// Digest - write the inputs to the inputs dirs, and return their ids
+//
+// A single input is written as is, or converted to JSON if it is YAML.
+// Layered inputs are merged into one resolved input, see resolveInputFiles.
+func (p *InputProcessor) Digest(inputPaths []string) ([]string, error) {
 	inputIds := []string{}
 	p.hash.Reset()
-	p.hash.Write([]byte(Version))
 
-	useWorkDir(p.writer.localStateDir, func() {
-		for i, input := range inputPaths {
+	err := useWorkDir(p.writer.localStateDir, func() error {
+		var files []string
+		var data []byte
+
+		for _, input := range inputPaths {
 			if !filepath.IsAbs(input) {
 				input = path.Join(p.writer.pwd, input)
 			}
@@ -162,32 +228,54 @@ func (p *InputProcessor) Digest(inputPaths []string) []string {
 
 			inputBytes, err := ioutil.ReadFile(input)
 			if err != nil {
-				panic(err)
+				return err
 			}
 
-			_, err = p.hash.Write(inputBytes)
-			if err != nil {
-				panic(err)
+			if _, err = p.hash.Write(inputBytes); err != nil {
+				return err
 			}
 
-			inputIds = append(inputIds, fmt.Sprintf("%03d.tfvars", i))
+			files = append(files, input)
+			data = inputBytes
+		}
 
-			for _, dir := range []string{"tf_vars", "tf_state", "tf"} {
-				p.writer.box.AddBytes(
-					path.Join(dir, "inputs", inputIds[i]),
-					inputBytes,
-				)
+		switch len(files) {
+		case 0:
+			return nil
+		case 1:
+			converted, err := convertInput(data, files[0])
+			if err != nil {
+				return err
+			}
+			data = converted
+			inputIds = append(inputIds, getInputID(0, files[0]))
+		default:
+			resolved, err := resolveInputData(files)
+			if err != nil {
+				return err
 			}
+			data = resolved
+			inputIds = append(inputIds, resolvedInputID)
 		}
 
-		p.writer.Digest("*/inputs/*")
+		for _, dir := range inputDirs {
+			p.writer.box.AddBytes(
+				path.Join(dir, "inputs", inputIds[0]),
+				data,
+			)
+		}
+
+		return p.writer.Digest("*/inputs/*")
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	if len(inputIds) == 0 {
-		Logger.Fatalf(`No input files were found. You must explicitly pass "--input <file>"`)
+		return nil, NewInputError(`No input files were found. You must explicitly pass "--input <file>"`)
 	}
 
-	return inputIds
+	return inputIds, nil
 }
 
 func fileExists(fp string) bool {
@@ -205,7 +293,7 @@ func getAutoFlags(override bool) string {
 	return ""
 }
 
-func getInitialInputs(localStateDir string) []string {
+func getInitialInputs(localStateDir string) ([]string, error) {
 	var localInputDir = path.Join(localStateDir, "tf_vars/inputs")
 	var initialInputs = []string{"input.tfvars"}
 	var err error
@@ -215,7 +303,7 @@ func getInitialInputs(localStateDir string) []string {
 		if err == nil {
 			initialInputs[i], err = filepath.Abs(input)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 		} else {
 			Logger.Debug(err)
@@ -229,7 +317,7 @@ func getInitialInputs(localStateDir string) []string {
 			var inputFileInfo []os.FileInfo
 			inputFileInfo, err = ioutil.ReadDir(localInputDir)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 
 			initialInputs = cast.ToStringSlice(
@@ -247,43 +335,60 @@ func getInitialInputs(localStateDir string) []string {
 		)
 	}
 
-	return initialInputs
+	return initialInputs, nil
 }
 
-func getVarFileFlags(inputIds []string) string {
-	return strings.Join(
-		cast.ToStringSlice(
-			funk.Map(inputIds, func(id string) string {
-				return fmt.Sprintf(`-var-file "inputs/%s"`, id)
-			}),
-		),
-		" ",
-	)
+func getVarFileFlags(inputIds []string) []string {
+	var flags []string
+	for _, id := range inputIds {
+		flags = append(flags, "-var-file", path.Join("inputs", id))
+	}
+	return flags
 }
 
-func getTerraformOutputJSONBytes() ([]byte, error) {
-	command := exec.Command("terraform", "output", "-json")
-	outputBytes, err := command.Output()
+// newKopsTemplateCommand - render the templates in the state dir matching pattern with output.json
+//
+// Template paths are relative to the parent directory, e.g. when run in the tf dir.
+func newKopsTemplateCommand(name string, pattern string, flags ...string) (*Command, error) {
+	templates, err := filepath.Glob(path.Join("..", pattern))
 	if err != nil {
 		return nil, err
 	}
 
-	var output map[string]interface{}
-	err = json.Unmarshal(outputBytes, &output)
+	args := append([]string{"toolbox", "template", "--name", name}, flags...)
+	args = append(args, "--values", "output.json")
+	for _, template := range templates {
+		args = append(args, "--template", template)
+	}
+
+	return NewCommand("kops", append(args, "--format-yaml")...), nil
+}
+
+func getTerraformOutputJSONBytes() ([]byte, error) {
+	command := NewCommand("terraform", "output", "-json")
+	command.Capture = true
+
+	outputBytes, err := runner.Run(command)
 	if err != nil {
-		return nil, err
+		return nil, NewToolError(command, err)
 	}
 
-	for key, value := range output {
-		output[key] = value.(map[string]interface{})["value"]
+	// Each output is an object with its value, type and sensitivity
+	var output map[string]map[string]json.RawMessage
+	if err = json.Unmarshal(outputBytes, &output); err != nil {
+		return nil, NewToolError(command, fmt.Errorf("Failed to parse the output, %v", err))
 	}
 
-	outputBytes, err = json.MarshalIndent(output, "", "  ")
-	if err != nil {
-		return nil, err
+	values := map[string]json.RawMessage{}
+	for key, attrs := range output {
+		value, ok := attrs["value"]
+		if !ok {
+			return nil, NewToolError(command, fmt.Errorf(`Failed to parse the output, "%s" has no value`, key))
+		}
+		values[key] = value
 	}
 
-	return outputBytes, nil
+	return json.MarshalIndent(values, "", "  ")
 }
 
 func getTerraformOutputJSON() (map[string]interface{}, error) {
@@ -301,40 +406,95 @@ func getTerraformOutputJSON() (map[string]interface{}, error) {
 	return output, nil
 }
 
+// readTerraformOutputFile - read the terraform output written to fp by an earlier phase
+func readTerraformOutputFile(fp string) (map[string]interface{}, error) {
+	outputBytes, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, fmt.Errorf(`Failed to read the terraform output, %v. Run the "tf" phase first`, err)
+	}
+
+	var output map[string]interface{}
+	err = json.Unmarshal(outputBytes, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
 func isDebug() bool {
 	return strings.Contains(os.Getenv("DEBUG"), "klarista")
 }
 
-func setAwsEnv(localStateDir string, inputIds []string) {
-	useWorkDir(path.Join(localStateDir, "tf_vars"), func() {
-		shell(
-			"bash",
-			"-c",
-			fmt.Sprintf(
-				`terraform apply -auto-approve -compact-warnings -refresh=false %s`,
-				getVarFileFlags(inputIds),
-			),
-		)
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
 
-		output, err := getTerraformOutputJSON()
+// setAwsEnv - configure the AWS environment from the cluster inputs
+//
+// The input tfvars are parsed natively. The tf_vars module is only applied
+// when a setting can't be evaluated without terraform.
+func setAwsEnv(localStateDir string, inputIds []string) error {
+	tfVarsDir := path.Join(localStateDir, "tf_vars")
+
+	settings, err := readAwsSettings(tfVarsDir, inputIds)
+	if errors.Is(err, errTfvarNotStatic) {
+		Logger.Debugf("%v, reading the AWS settings with terraform", err)
+		settings, err = readAwsSettingsWithTerraform(tfVarsDir, inputIds)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Setenv("AWS_PROFILE", settings.Profile); err != nil {
+		return err
+	}
+
+	if err = os.Setenv("AWS_REGION", settings.Region); err != nil {
+		return err
+	}
+
+	inputEncryptionKeyArn = settings.EncryptionKeyArn
+	return nil
+}
+
+// readAwsSettingsWithTerraform - read the AWS settings from the outputs of the tf_vars module
+func readAwsSettingsWithTerraform(tfVarsDir string, inputIds []string) (*AwsSettings, error) {
+	var settings *AwsSettings
+
+	err := useWorkDir(tfVarsDir, func() error {
+		err := shell(
+			"terraform",
+			"apply",
+			"-auto-approve",
+			"-compact-warnings",
+			"-refresh=false",
+			getVarFileFlags(inputIds),
+		)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		awsProfile := output["aws_profile"].(string)
-		awsRegion := output["aws_region"].(string)
-
-		if err = os.Setenv("AWS_PROFILE", awsProfile); err != nil {
-			panic(err)
+		output, err := getTerraformOutputJSON()
+		if err != nil {
+			return err
 		}
 
-		if err = os.Setenv("AWS_REGION", awsRegion); err != nil {
-			panic(err)
+		settings = &AwsSettings{
+			Profile:          cast.ToString(output["aws_profile"]),
+			Region:           cast.ToString(output["aws_region"]),
+			EncryptionKeyArn: cast.ToString(output["encryption_key_arn"]),
 		}
+		return nil
 	})
+
+	return settings, err
 }
 
-func generateEnvironmentFile(args ...map[string]string) []byte {
+func generateEnvironmentFile(args ...map[string]string) ([]byte, error) {
 	var overrides map[string]string
 	if len(args) == 1 {
 		overrides = args[0]
@@ -378,25 +538,20 @@ func generateEnvironmentFile(args ...map[string]string) []byte {
 		}
 	}
 
-	// Environment variables may reference each other, so must be sorted topologically
-	sort.Slice(varNames, func(i, j int) bool {
-		a := varNames[i]
-		b := varNames[j]
-
-		orderA, err := graph.TopSort(a)
-		if err != nil {
-			panic(err)
-		}
-
-		orderB, err := graph.TopSort(b)
+	// Environment variables may reference each other, so must be sorted topologically.
+	// graph.TopSort(name) returns an array of variable names where name is
+	// always the last element. We can use the lengths of the node paths to
+	// determine the desired varNames sort order.
+	depths := map[string]int{}
+	for _, name := range varNames {
+		order, err := graph.TopSort(name)
 		if err != nil {
-			panic(err)
+			return nil, NewInputError("Failed to order the environment variables, %v", err)
 		}
-
-		// graph.TopSort(name) returns an array of variable names where
-		// name is always the last element. We can use the lengths of
-		// the node paths to determine the desired varNames sort order.
-		return len(orderA) < len(orderB)
+		depths[name] = len(order)
+	}
+	sort.Slice(varNames, func(i, j int) bool {
+		return depths[varNames[i]] < depths[varNames[j]]
 	})
 
 	lines := make([]string, len(varNames))
@@ -404,24 +559,21 @@ func generateEnvironmentFile(args ...map[string]string) []byte {
 		lines[i] = fmt.Sprintf(`export %s="%s"`, name, environment[name])
 	}
 
-	return []byte(strings.Join(lines, "\n"))
+	return []byte(strings.Join(lines, "\n")), nil
 }
 
-func generateDefaultEnvironmentFile(clusterName string) []byte {
+func generateDefaultEnvironmentFile(clusterName string) ([]byte, error) {
 	return generateEnvironmentFile(map[string]string{
 		"KLARISTA_LOCAL_STATE_DIR": "${TMPDIR:-/tmp/}" + clusterName,
 		"KUBECONFIG":               "${KLARISTA_LOCAL_STATE_DIR}/kubeconfig.yaml",
 	})
 }
 
-// ShellErrorCallback - shell error callback function
-type ShellErrorCallback = func(error)
-
 // ShellOutputCallback - shell output callback function
 type ShellOutputCallback = func([]byte)
 
-func shell(command string, args ...interface{}) {
-	var cbError ShellErrorCallback
+// shell - run a command, and return a ToolError if it fails
+func shell(command string, args ...interface{}) error {
 	var cbOutput ShellOutputCallback
 	var filteredArgs []string
 
@@ -429,105 +581,89 @@ func shell(command string, args ...interface{}) {
 		switch arg := v.(type) {
 		case string:
 			filteredArgs = append(filteredArgs, arg)
-		case ShellErrorCallback:
-			cbError = arg
+		case []string:
+			filteredArgs = append(filteredArgs, arg...)
 		case ShellOutputCallback:
 			cbOutput = arg
 		default:
-			Logger.Warnf("Unknown argument type %t", arg)
+			Logger.Warnf("Unknown argument type %T", arg)
 		}
 	}
 
-	filteredArgs = funk.Compact(filteredArgs).([]string)
-	cmd := exec.Command(command, filteredArgs...)
-
-	cmd.Stdin = os.Stdin
-	if cbOutput == nil {
-		cmd.Stdout = os.Stderr
-	}
-	cmd.Stderr = os.Stderr
-
-	sigs := make(chan os.Signal)
-	done := make(chan bool)
-
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		if <-done {
-			return
-		}
-
-		sig := <-sigs
-		Logger.Debug("GOT SIGNAL ", sig)
-
-		if cmd.ProcessState != nil && !cmd.ProcessState.Exited() {
-			if err := cmd.Process.Kill(); err != nil {
-				Logger.Fatal("Failed to kill process: ", err)
-			}
-		}
-	}()
-
-	Logger.Debugf("%s %s", command, strings.Join(filteredArgs, " "))
+	c := NewCommand(command, funk.Compact(filteredArgs).([]string)...)
+	c.Capture = cbOutput != nil
 
-	var err error
+	output, err := runner.Run(c)
 	if cbOutput != nil {
-		var output []byte
-		output, err = cmd.Output()
 		cbOutput(output)
-	} else {
-		err = cmd.Run()
 	}
 
+	return NewToolError(c, err)
+}
+
+// shellPipe - run a command with the output of another command as its input
+func shellPipe(from *Command, to *Command) error {
+	from.Capture = true
+
+	output, err := runner.Run(from)
 	if err != nil {
-		if cbError != nil {
-			cbError(err)
-		} else {
-			panic(err)
-		}
+		return NewToolError(from, err)
 	}
 
-	done <- true
+	return shellInput(output, to)
+}
+
+// shellInput - run a command with input piped to its stdin
+func shellInput(input []byte, to *Command) error {
+	to.Stdin = input
+	_, err := runner.Run(to)
+	return NewToolError(to, err)
 }
 
-func useWorkDir(wd string, cb func()) {
+// useWorkDir - call cb in the working directory wd, and return to the current one
+func useWorkDir(wd string, cb func() error) (err error) {
 	// Get the pwd
 	originalWd, err := os.Getwd()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	wd, err = filepath.Abs(wd)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if wd == originalWd {
 		Logger.Debugf(`Already in WD %s`, wd)
-		cb()
-	} else {
-		// Change to the target wd
-		Logger.Debugf(`Using WD %s`, wd)
-		if err = os.Chdir(wd); err != nil {
-			panic(err)
-		}
-
-		defer func() {
-			// Return to the original wd
-			Logger.Debugf(`Returning to WD %s`, originalWd)
-			if err = os.Chdir(originalWd); err != nil {
-				panic(err)
-			}
-		}()
+		return cb()
+	}
 
-		// Do work
-		cb()
+	// Change to the target wd
+	Logger.Debugf(`Using WD %s`, wd)
+	if err = os.Chdir(wd); err != nil {
+		return err
 	}
+
+	defer func() {
+		// Return to the original wd
+		Logger.Debugf(`Returning to WD %s`, originalWd)
+		if chdirErr := os.Chdir(originalWd); chdirErr != nil && err == nil {
+			err = chdirErr
+		}
+	}()
+
+	// Do work
+	return cb()
 }
 
 // UseTempDirCallback - useTempDir callback function
-type UseTempDirCallback = func(string)
+type UseTempDirCallback = func(string) error
 
-func useTempDir(args ...interface{}) {
+// useTempDir - call cb in a temporary working directory
+//
+// The arguments are the callback, a func() error or a UseTempDirCallback, and
+// optionally the name of the directory and whether to remove it afterwards.
+func useTempDir(args ...interface{}) error {
 	var autoremove bool = true
 	var cb UseTempDirCallback
 	var name string
@@ -538,15 +674,13 @@ func useTempDir(args ...interface{}) {
 			autoremove = arg
 		case string:
 			name = arg
+		case UseTempDirCallback:
+			cb = arg
+		case func() error:
+			cb = func(string) error { return arg() }
 		default:
-			cb = func(tmpdir string) {
-				fn := reflect.ValueOf(arg)
-				fnArgs := []reflect.Value{}
-				if fn.Type().NumIn() == 1 {
-					fnArgs = append(fnArgs, reflect.ValueOf(tmpdir))
-				}
-				reflect.ValueOf(arg).Call(fnArgs)
-			}
+			// A callback of any other type is a bug, and would silently not be called
+			panic(fmt.Sprintf("useTempDir: unknown argument type %T", arg))
 		}
 	}
 
@@ -556,174 +690,283 @@ func useTempDir(args ...interface{}) {
 
 	tmpdir := path.Join(os.TempDir(), name)
 	if err := os.MkdirAll(tmpdir, 0755); err != nil {
-		panic(err)
+		return err
 	}
 
 	if autoremove {
 		defer os.RemoveAll(tmpdir)
 	}
 
-	useWorkDir(tmpdir, func() {
-		cb(tmpdir)
+	return useWorkDir(tmpdir, func() error {
+		return cb(tmpdir)
 	})
 }
 
-func useRemoteState(clusterName, bucket string, read bool, write bool, cb func()) {
-	remoteStateKey := "klarista.state.tar"
-
-	sess := session.Must(session.NewSession())
-	downloader := s3manager.NewDownloader(sess)
+// RemoteStateOptions - useRemoteState options
+type RemoteStateOptions struct {
+	// Read the remote state into the local state dir before calling back
+	Read bool
+	// Write the local state dir to the remote state after calling back
+	Write bool
+	// Overwrite the remote state even if it changed since it was read
+	Force bool
+}
 
-	useTempDir(func(stateTmpDir string) {
-		localStateFilePath := path.Join(stateTmpDir, remoteStateKey)
+// useRemoteState - call cb in the local state dir of the cluster, with the remote state read before and written after
+//
+// The state is written even if cb fails, so that the changes it made are kept.
+func useRemoteState(clusterName string, opts RemoteStateOptions, cb func() error) error {
+	backend, err := getStateBackend(clusterName)
+	if err != nil {
+		return err
+	}
+	location := backend.Location(remoteStateKey)
 
-		stateFile, err := os.Create(localStateFilePath)
+	if isDryRun() {
+		if opts.Read {
+			skipInDryRun("read the remote state from %s", location)
+		}
+		localStateDir, err := getLocalStateDir(clusterName)
 		if err != nil {
-			panic(fmt.Errorf("Failed to create file %q, %v", localStateFilePath, err))
+			return err
+		}
+		if err := useWorkDir(localStateDir, cb); err != nil {
+			return err
 		}
+		if opts.Write {
+			skipInDryRun("write the remote state to %s", location)
+		}
+		return nil
+	}
 
-		useTempDir(clusterName, false, func() {
-			if read {
-				_, err = downloader.Download(stateFile, &s3.GetObjectInput{
-					Bucket: aws.String(bucket),
-					Key:    aws.String(remoteStateKey),
-				})
+	if opts.Write {
+		lock := NewStateLock(lockTTL)
 
-				if err != nil {
-					if aerr, ok := err.(awserr.Error); ok {
-						switch aerr.Code() {
-						case s3.ErrCodeNoSuchKey:
-							Logger.Warn(aerr.Error())
-						case s3.ErrCodeNoSuchBucket:
-							Logger.Error(aerr.Error())
-						default:
-							panic(aerr.Error())
-						}
-					} else {
-						panic(fmt.Errorf("Failed to download file, %v", err))
-					}
-				} else {
-					Logger.Debugf("Reading state from s3://%s/%s", bucket, remoteStateKey)
-					tar := &archiver.Tar{
-						ImplicitTopLevelFolder: false,
-						MkdirAll:               true,
-						OverwriteExisting:      true,
-						StripComponents:        0,
-					}
-					if err := tar.Unarchive(localStateFilePath, "."); err != nil {
-						panic(err)
-					}
-				}
+		if err := acquireStateLock(backend, clusterName, lock); err != nil {
+			if !errors.Is(err, ErrStateStoreNotFound) {
+				return &StateError{Err: err}
 			}
-
+			Logger.Warnf("%v; continuing without a state lock", err)
+		} else {
+			stopKeepAlive := keepStateLockAlive(backend, lock, lockTTL)
 			defer func() {
-				if !write {
-					return
+				stopKeepAlive()
+				if err := releaseStateLock(backend, lock); err != nil {
+					Logger.Errorf("Failed to release state lock, %v", err)
 				}
+			}()
+		}
+	}
+
+	return useTempDir(func(stateTmpDir string) error {
+		localStateFilePath := path.Join(stateTmpDir, remoteStateKey)
+		baseStateFilePath := path.Join(stateTmpDir, "base."+remoteStateKey)
+
+		return useTempDir(clusterName, false, func() (err error) {
+			// The remote state version that the local state is based on
+			var base *RemoteStateVersion
 
-				type ArchiveElement struct {
-					Body    []byte
-					ModTime time.Time
-					Path    string
-					Size    int64
+			if opts.Read {
+				stateFile, err := os.Create(baseStateFilePath)
+				if err != nil {
+					return NewStateError("Failed to create file %q, %v", baseStateFilePath, err)
 				}
 
-				var archiveContent []*ArchiveElement
+				object, err := backend.Read(remoteStateKey, "", stateFile)
+				stateFile.Close()
 
-				filepath.Walk(".", func(fpath string, info os.FileInfo, err error) error {
-					if err != nil {
-						panic(err)
+				if err != nil {
+					switch {
+					case err == ErrStateNotFound:
+						Logger.Warnf("No state found at %s", location)
+					case errors.Is(err, ErrStateStoreNotFound):
+						Logger.Error(err.Error())
+					default:
+						return NewStateError("Failed to download file, %v", err)
 					}
+					base = &RemoteStateVersion{Exists: false}
+				} else {
+					base = object.Version()
 
-					if info.IsDir() {
-						if info.Name() == ".terraform" {
-							return filepath.SkipDir
-						}
-					} else {
-						if strings.HasSuffix(info.Name(), ".backup") {
-							return nil
-						}
-
-						if info.Name() == ".kubeconfig.admin.yaml" {
-							return nil
-						}
-
-						body, err := ioutil.ReadFile(fpath)
-						if err != nil {
-							panic(err)
-						}
-
-						Logger.Debugf(`Adding "%s" to state file`, fpath)
-
-						archiveContent = append(archiveContent, &ArchiveElement{
-							Body:    body,
-							ModTime: info.ModTime(),
-							Path:    fpath,
-							Size:    info.Size(),
-						})
+					Logger.Debugf("Reading state from %s", location)
+					if err := extractStateArchive(baseStateFilePath, "."); err != nil {
+						return &StateError{Err: err}
 					}
+				}
 
-					return nil
-				})
+				if err := writeRemoteStateRecord(base); err != nil {
+					return &StateError{Err: err}
+				}
+			} else if base, err = readRemoteStateRecord(); err != nil {
+				return &StateError{Err: err}
+			}
 
-				var data bytes.Buffer
-				writer := tar.NewWriter(&data)
+			if err := migrateState("."); err != nil {
+				return &StateError{Err: err}
+			}
 
-				for _, file := range archiveContent {
-					hdr := &tar.Header{
-						Name:    file.Path,
-						Mode:    0755,
-						ModTime: file.ModTime,
-						Size:    file.Size,
+			if opts.Write {
+				defer func() {
+					writeErr := writeRemoteState(clusterName, backend, base, opts.Force, localStateFilePath, baseStateFilePath)
+					if writeErr == nil {
+						return
 					}
-					if err := writer.WriteHeader(hdr); err != nil {
-						panic(err)
-					}
-					if _, err := writer.Write(file.Body); err != nil {
-						panic(err)
+					if err != nil {
+						Logger.Errorf("Failed to write state, %v", writeErr)
+						return
 					}
-				}
-				if err := writer.Close(); err != nil {
-					panic(err)
-				}
-				if err := stateFile.Truncate(0); err != nil {
-					panic(err)
-				}
-				if _, err := stateFile.Write(data.Bytes()); err != nil {
-					panic(err)
-				}
-				if _, err := stateFile.Seek(0, 0); err != nil {
-					panic(err)
-				}
+					err = writeErr
+				}()
+			}
 
-				Logger.Infof("Writing state to s3://%s/%s", bucket, remoteStateKey)
+			return cb()
+		})
+	})
+}
 
-				uploader := s3manager.NewUploader(sess)
+// writeRemoteState - write the local state in the working directory to the remote state
+//
+// The local state is kept in a conflict file instead if the remote state
+// changed since base was read, unless force is set.
+func writeRemoteState(
+	clusterName string,
+	backend StateBackend,
+	base *RemoteStateVersion,
+	force bool,
+	localStateFilePath, baseStateFilePath string,
+) error {
+	location := backend.Location(remoteStateKey)
 
-				result, err := uploader.Upload(&s3manager.UploadInput{
-					Bucket: aws.String(bucket),
-					Key:    aws.String(remoteStateKey),
-					Body:   stateFile,
-				})
+	if err := checkLocalStateDowngrade(".", location); err != nil {
+		return &StateError{Err: err}
+	}
 
-				if err != nil {
-					if aerr, ok := err.(awserr.Error); ok {
-						switch aerr.Code() {
-						case s3.ErrCodeNoSuchBucket:
-							Logger.Warn(aerr.Error())
-							// noop
-						default:
-							panic(aerr.Error())
-						}
-					} else {
-						panic(fmt.Errorf("Failed to upload file, %v", err))
-					}
-				} else {
-					Logger.Infof("State written successfully to %s", result.Location)
-				}
-			}()
+	if err := checkStateDowngrade(backend); err != nil && !errors.Is(err, ErrStateStoreNotFound) {
+		return &StateError{Err: err}
+	}
 
-			cb()
-		})
-	})
+	current, err := statRemoteState(backend)
+	if err != nil && !errors.Is(err, ErrStateStoreNotFound) {
+		return &StateError{Err: err}
+	}
+
+	// Without a record of the version the local state is based on, only
+	// writing to an empty remote is known to be safe
+	expected := base
+	if expected == nil {
+		expected = &RemoteStateVersion{Exists: false}
+	}
+
+	if !force && current != nil && !expected.Equal(current) {
+		stateFile, err := os.Create(localStateFilePath)
+		if err != nil {
+			return NewStateError("Failed to create file %q, %v", localStateFilePath, err)
+		}
+		_, err = writeStateArchive(stateFile, ".", stateCompression)
+		stateFile.Close()
+		if err != nil {
+			return &StateError{Err: err}
+		}
+		return saveConflictingState(clusterName, backend, base, current, localStateFilePath, baseStateFilePath)
+	}
+
+	Logger.Infof("Writing state to %s", location)
+
+	// Stream the archive to the backend without holding it in memory
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := writeStateArchive(pw, ".", stateCompression)
+		pw.CloseWithError(err)
+	}()
+
+	written, err := backend.Write(remoteStateKey, pr, getRemoteStateMetadata(getStateLayoutVersion()))
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		if !errors.Is(err, ErrStateStoreNotFound) {
+			return NewStateError("Failed to upload file, %v", err)
+		}
+		Logger.Warn(err.Error())
+		return nil
+	}
+
+	Logger.Infof("State written successfully to %s", location)
+	if err := writeRemoteStateRecord(written.Version()); err != nil {
+		return &StateError{Err: err}
+	}
+
+	return nil
+}
+
+// saveConflictingState - keep the local state tarball and report how it differs from the remote state
+func saveConflictingState(
+	clusterName string,
+	backend StateBackend,
+	base, current *RemoteStateVersion,
+	localStateFilePath, baseStateFilePath string,
+) error {
+	conflictPath := path.Join(
+		os.TempDir(),
+		fmt.Sprintf("%s.%s.%s", clusterName, time.Now().Format("20060102150405"), remoteStateKey),
+	)
+
+	data, err := ioutil.ReadFile(localStateFilePath)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(conflictPath, data, 0600); err != nil {
+		return err
+	}
+
+	conflictErr := &StateConflictError{
+		Cluster:   clusterName,
+		Base:      base,
+		Current:   current,
+		LocalPath: conflictPath,
+	}
+
+	// The three-way report is best effort; the conflict is reported either way
+	report := func() (string, error) {
+		localDigests, err := digestTarFile(localStateFilePath)
+		if err != nil {
+			return "", err
+		}
+
+		remoteStateFilePath := localStateFilePath + ".remote"
+		if current.Exists {
+			if err = downloadRemoteStateVersion(backend, current, remoteStateFilePath); err != nil {
+				return "", err
+			}
+		}
+		remoteDigests := map[string]string{}
+		if current.Exists {
+			if remoteDigests, err = digestTarFile(remoteStateFilePath); err != nil {
+				return "", err
+			}
+		}
+
+		// Leave baseDigests nil if the base version is unknown or unavailable
+		var baseDigests map[string]string
+		if base != nil && base.Exists && !fileExists(baseStateFilePath) && base.VersionID != "" {
+			if err = downloadRemoteStateVersion(backend, base, baseStateFilePath); err != nil {
+				Logger.Debugf("Failed to download base state version, %v", err)
+			}
+		}
+		if base != nil && !base.Exists {
+			baseDigests = map[string]string{}
+		} else if base != nil && fileExists(baseStateFilePath) {
+			if baseDigests, err = digestTarFile(baseStateFilePath); err != nil {
+				return "", err
+			}
+		}
+
+		return formatThreeWayReport(baseDigests, localDigests, remoteDigests), nil
+	}
+
+	if r, err := report(); err != nil {
+		Logger.Warnf("Failed to compare local and remote state, %v", err)
+	} else {
+		Logger.Warnf("Local and remote state differ:\n%s", r)
+	}
+
+	return conflictErr
 }
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bfmiv/klarista/test/toolchain"
+	"github.com/spf13/pflag"
+)
+
+// testRunner - runs commands like ExecRunner, but waits a thousandth of the time between polls
+type testRunner struct {
+	ExecRunner
+	sleeps []time.Duration
+}
+
+func (r *testRunner) Sleep(d time.Duration) error {
+	r.sleeps = append(r.sleeps, d)
+	time.Sleep(d / 1000)
+	return nil
+}
+
+// useTestToolchain - run commands with the fake tools until the test finishes
+func useTestToolchain(t *testing.T) (*toolchain.Toolchain, *testRunner) {
+	t.Helper()
+
+	tc := toolchain.New(t)
+
+	// The fixtures and the fakes record these, so start from a clean environment
+	for _, key := range runnerEnv {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+
+	previous := runner
+	r := &testRunner{}
+	runner = r
+	t.Cleanup(func() {
+		runner = previous
+	})
+
+	return tc, r
+}
+
+// useTestWorkDir - change to dir until the test finishes
+func useTestWorkDir(t *testing.T, dir string) {
+	t.Helper()
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(pwd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// executeTestCommand - run klarista with args, and reset the flags they set when the test finishes
+func executeTestCommand(t *testing.T, args ...string) error {
+	t.Helper()
+
+	t.Cleanup(func() {
+		reset := func(f *pflag.Flag) {
+			if f.Changed {
+				f.Value.Set(f.DefValue)
+				f.Changed = false
+			}
+		}
+		rootCmd.PersistentFlags().VisitAll(reset)
+		for _, c := range rootCmd.Commands() {
+			c.Flags().VisitAll(reset)
+		}
+		rootCmd.SetArgs(nil)
+	})
+
+	rootCmd.SetArgs(args)
+	return executeRootCommand()
+}
+
+func TestUnknownCommand(t *testing.T) {
+	err := executeTestCommand(t, "bogus")
+	if got := getExitCode(err); got != exitCodeInput {
+		t.Errorf("exit code of %v = %d, want %d", err, got, exitCodeInput)
+	}
+}
+
+func TestGetTerraformOutputJSONBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		exitCode int
+		// want is the expected output, or empty if a ToolError is expected
+		want string
+		// wantErr is a substring of the expected ToolError
+		wantErr string
+	}{
+		{
+			name:   "values",
+			output: `{"aws_region":{"sensitive":false,"type":"string","value":"us-east-1"},"zones":{"type":["list","string"],"value":["us-east-1a"]}}`,
+			want:   `{"aws_region":"us-east-1","zones":["us-east-1a"]}`,
+		},
+		{
+			name:   "no outputs",
+			output: `{}`,
+			want:   `{}`,
+		},
+		{
+			name:    "not JSON",
+			output:  `Error: No outputs found`,
+			wantErr: "Failed to parse the output",
+		},
+		{
+			name:    "output is not an object",
+			output:  `{"aws_region":"us-east-1"}`,
+			wantErr: "Failed to parse the output",
+		},
+		{
+			name:    "output without a value",
+			output:  `{"aws_region":{"type":"string"}}`,
+			wantErr: `"aws_region" has no value`,
+		},
+		{
+			name:     "terraform fails",
+			exitCode: 1,
+			wantErr:  "failed with exit status 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, _ := useTestToolchain(t)
+			tc.On("terraform", "output", "-json").Stdout(tt.output).Exit(tt.exitCode)
+
+			output, err := getTerraformOutputJSONBytes()
+
+			if tt.wantErr != "" {
+				var toolErr *ToolError
+				if !errors.As(err, &toolErr) {
+					t.Fatalf("getTerraformOutputJSONBytes() = %v, want a ToolError", err)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("getTerraformOutputJSONBytes() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getTerraformOutputJSONBytes() = %v", err)
+			}
+			var got, want interface{}
+			if err = json.Unmarshal(output, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err = json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("getTerraformOutputJSONBytes() = %s, want %s", output, tt.want)
+			}
+		})
+	}
+}
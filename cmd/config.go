@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/pflag"
+)
+
+// defaultConfigFile - configuration file read from the working directory when --config is not set
+const defaultConfigFile = "klarista.yaml"
+
+var configFile string
+
+// Config - klarista configuration file
+type Config struct {
+	State StateConfig `json:"state,omitempty"`
+}
+
+// StateConfig - remote state configuration
+type StateConfig struct {
+	Backend          string `json:"backend,omitempty"`
+	LocalDir         string `json:"local_dir,omitempty"`
+	Endpoint         string `json:"endpoint,omitempty"`
+	PathStyle        bool   `json:"path_style,omitempty"`
+	Bucket           string `json:"bucket,omitempty"`
+	KeyPrefix        string `json:"key_prefix,omitempty"`
+	Compression      string `json:"compression,omitempty"`
+	Encryption       string `json:"encryption,omitempty"`
+	EncryptionKeyArn string `json:"encryption_key_arn,omitempty"`
+}
+
+// flagValues - map flag names to their configured values
+func (c *Config) flagValues() map[string]string {
+	values := map[string]string{
+		"state-backend":            c.State.Backend,
+		"state-local-dir":          c.State.LocalDir,
+		"state-endpoint":           c.State.Endpoint,
+		"state-bucket":             c.State.Bucket,
+		"state-key-prefix":         c.State.KeyPrefix,
+		"state-compression":        c.State.Compression,
+		"state-encryption":         c.State.Encryption,
+		"state-encryption-key-arn": c.State.EncryptionKeyArn,
+	}
+	if c.State.PathStyle {
+		values["state-path-style"] = "true"
+	}
+	return values
+}
+
+func loadConfig(fp string) (*Config, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse config file %s, %v", fp, err)
+	}
+
+	return &config, nil
+}
+
+// applyConfig - read the config file and use its values for flags that were not set on the command line
+func applyConfig(flags *pflag.FlagSet) error {
+	fp := configFile
+	if fp == "" {
+		fp = os.Getenv("KLARISTA_CONFIG")
+	}
+	if fp == "" {
+		if !fileExists(defaultConfigFile) {
+			return nil
+		}
+		fp = defaultConfigFile
+	}
+
+	config, err := loadConfig(fp)
+	if err != nil {
+		return &InputError{Err: err}
+	}
+
+	Logger.Debugf("Using config file %s", fp)
+
+	for name, value := range config.flagValues() {
+		if value == "" || flags.Lookup(name) == nil || flags.Changed(name) {
+			continue
+		}
+		if err = flags.Set(name, value); err != nil {
+			return NewInputError(`Invalid value "%s" for %s in config file %s, %v`, value, name, fp, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// remoteStateRecordFile - local record of the remote state version the local state is based on
+const remoteStateRecordFile = ".remote-state.json"
+
+// RemoteStateVersion - identifies one version of the remote state object
+type RemoteStateVersion struct {
+	Exists    bool   `json:"exists"`
+	ETag      string `json:"etag,omitempty"`
+	VersionID string `json:"version_id,omitempty"`
+}
+
+func (v *RemoteStateVersion) Equal(other *RemoteStateVersion) bool {
+	if v.Exists != other.Exists {
+		return false
+	}
+	if !v.Exists {
+		return true
+	}
+	if v.VersionID != "" && other.VersionID != "" {
+		return v.VersionID == other.VersionID
+	}
+	return v.ETag == other.ETag
+}
+
+func (v *RemoteStateVersion) String() string {
+	if v == nil {
+		return "<unknown>"
+	}
+	if !v.Exists {
+		return "<none>"
+	}
+	if v.VersionID != "" {
+		return fmt.Sprintf("version %s (etag %s)", v.VersionID, v.ETag)
+	}
+	return fmt.Sprintf("etag %s", v.ETag)
+}
+
+// StateConflictError - returned when the remote state changed since it was read
+type StateConflictError struct {
+	Cluster   string
+	Base      *RemoteStateVersion
+	Current   *RemoteStateVersion
+	LocalPath string
+}
+
+func (e *StateConflictError) Error() string {
+	return fmt.Sprintf(
+		`Remote state for cluster "%s" changed since it was read (expected %s, found %s). `+
+			`Your state was saved to "%s". Review the differences, then run "klarista state push %s --force" to overwrite the remote state`,
+		e.Cluster,
+		e.Base,
+		e.Current,
+		e.LocalPath,
+		e.Cluster,
+	)
+}
+
+// statRemoteState - describe the current version of the remote state
+func statRemoteState(backend StateBackend) (*RemoteStateVersion, error) {
+	object, err := backend.Stat(remoteStateKey)
+	if err != nil {
+		if err == ErrStateNotFound {
+			return &RemoteStateVersion{Exists: false}, nil
+		}
+		return nil, err
+	}
+	return object.Version(), nil
+}
+
+// readRemoteStateRecord - read the remote state version recorded in the local state dir
+func readRemoteStateRecord() (*RemoteStateVersion, error) {
+	if !fileExists(remoteStateRecordFile) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(remoteStateRecordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var version RemoteStateVersion
+	if err = json.Unmarshal(data, &version); err != nil {
+		Logger.Warnf("Ignoring invalid %s, %v", remoteStateRecordFile, err)
+		return nil, nil
+	}
+
+	return &version, nil
+}
+
+func writeRemoteStateRecord(version *RemoteStateVersion) error {
+	data, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(remoteStateRecordFile, data, 0644)
+}
+
+// downloadRemoteStateVersion - save the given version of the remote state to fp
+func downloadRemoteStateVersion(backend StateBackend, version *RemoteStateVersion, fp string) error {
+	file, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	object, err := backend.Read(remoteStateKey, version.VersionID, file)
+	if err != nil {
+		return err
+	}
+
+	// Without version IDs, only the current version can be read
+	if !version.Equal(object.Version()) {
+		return fmt.Errorf("State version %s is no longer available", version)
+	}
+
+	return nil
+}
+
+// digestTarFile - map each file in a state archive to the sha256 of its content
+func digestTarFile(fp string) (map[string]string, error) {
+	digests := map[string]string{}
+
+	err := useStateArchive(fp, func(hdr *tar.Header, r io.Reader) error {
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if hdr.Typeflag == tar.TypeDir || isStateMetadataPath(name) {
+			return nil
+		}
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, r); err != nil {
+			return err
+		}
+		digests[name] = fmt.Sprintf("%x", hash.Sum(nil))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return digests, nil
+}
+
+// formatThreeWayReport - describe which files differ between base, local and remote state
+//
+// base may be nil when the version the local state was based on is unknown, in
+// which case every difference is reported as a conflict.
+func formatThreeWayReport(base, local, remote map[string]string) string {
+	paths := map[string]bool{}
+	for _, m := range []map[string]string{base, local, remote} {
+		for p := range m {
+			paths[p] = true
+		}
+	}
+
+	var sorted []string
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+	for _, p := range sorted {
+		if local[p] == remote[p] {
+			continue
+		}
+
+		var status string
+		switch {
+		case base == nil:
+			status = "conflict"
+		case local[p] == base[p]:
+			status = "changed remotely"
+		case remote[p] == base[p]:
+			status = "changed locally"
+		default:
+			status = "conflict"
+		}
+
+		lines = append(lines, fmt.Sprintf("%-18s %s", status, p))
+	}
+
+	if len(lines) == 0 {
+		return "Local and remote state contain identical files"
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -8,186 +8,447 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ghodss/yaml"
+	"github.com/spf13/cast"
 	"github.com/spf13/cobra"
 )
 
+// createPhases - the phases of the create command, in order
+var createPhases = []*Phase{
+	{
+		Name:        "tf-state",
+		Description: "Create the state bucket with terraform",
+		Inputs:      PhaseInputs{Vars: true, Assets: []string{"tf_state/*.tf"}},
+	},
+	{
+		Name:        "tf",
+		Description: "Apply the cluster terraform",
+		Inputs:      PhaseInputs{Vars: true, Assets: []string{"tf/*.tf", "tf/*.tfvars"}},
+		Outputs:     []string{"tf/output.json"},
+	},
+	{
+		Name:        "kops-replace",
+		Description: "Render the kops cluster and instance group templates and replace them in the kops state",
+		Inputs:      PhaseInputs{Assets: []string{"kops/*"}, Files: []string{"tf/output.json"}},
+	},
+	{
+		Name:        "kops-update",
+		Description: "Generate the kops terraform",
+		After:       []string{"kops-replace"},
+		Outputs:     []string{"tf/kubernetes.tf"},
+	},
+	{
+		Name:        "patch-terraform",
+		Description: "Post-process the terraform generated by kops",
+		After:       []string{"kops-update"},
+		Outputs:     []string{"tf/kubernetes.tf"},
+	},
+	{
+		Name:        "tf-finish",
+		Description: "Apply the cluster terraform with the kops terraform",
+		Inputs:      PhaseInputs{Vars: true, Assets: []string{"tf/*.tf", "tf/*.tfvars"}, Files: []string{"tf/kubernetes.tf"}},
+		Outputs:     []string{"tf/output.json"},
+	},
+	{
+		Name:        "rolling-update",
+		Description: "Roll the instance groups of an existing cluster, or wait for a new cluster to come online",
+		After:       []string{"kops-update", "tf-finish"},
+	},
+	{
+		Name:        "validate",
+		Description: "Wait for the cluster to pass validation",
+		After:       []string{"tf", "rolling-update"},
+	},
+	{
+		Name:        "k8s-manifests",
+		Description: "Apply the kubernetes manifests",
+		Inputs:      PhaseInputs{Assets: []string{"k8s/*.yaml"}, Files: []string{"tf/output.json"}},
+	},
+	{
+		Name:        "kubeconfig",
+		Description: "Write the cluster kubeconfig and environment file",
+		Inputs:      PhaseInputs{Files: []string{"tf/output.json"}, Flags: []string{"client-authentication-api-version"}},
+	},
+	{
+		Name:        "authenticate",
+		Description: "Wait for the cluster to accept requests with the cluster kubeconfig",
+		After:       []string{"validate", "k8s-manifests", "kubeconfig"},
+	},
+}
+
 // createCmd represents the create command
 var createCmd = &cobra.Command{
 	Use:   "create <name>",
 	Short: "Create a new cluster",
-	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		name := args[0]
-		localStateDir := path.Join(os.TempDir(), name)
-		stateBucketName := strings.ReplaceAll(name, ".", "-") + "-state"
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+		return runCreate(cmd, args[0], "")
+	},
+}
 
-		always, _ := cmd.Flags().GetBool("always")
-		fast, _ := cmd.Flags().GetBool("fast")
-		yes, _ := cmd.Flags().GetBool("yes")
-		autoFlags := getAutoFlags(yes)
+// runCreate - create or update a cluster, applying the saved plan with the given ID if it is set
+func runCreate(cmd *cobra.Command, name string, planID string) (err error) {
+	stateBucketName := getStateBucketName(name)
+
+	always, _ := cmd.Flags().GetBool("always")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	fast, _ := cmd.Flags().GetBool("fast")
+	fromPhase, _ := cmd.Flags().GetString("from-phase")
+	onlyPhases, _ := cmd.Flags().GetStringSlice("only-phase")
+	resume, _ := cmd.Flags().GetBool("resume")
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	yes, _ := cmd.Flags().GetBool("yes")
+	autoFlags := getAutoFlags(yes)
+
+	if dryRun {
+		runner = NewDryRunRunner()
+		defer printDryRunPlan(os.Stdout, currentCommand)
+	} else {
+		if err := useRecordReplay(name); err != nil {
+			return err
+		}
+		defer finishRecordReplay(&err)
+	}
 
-		clientAuthAPIVersion, _ := cmd.Flags().GetString("client-authentication-api-version")
+	localStateDir, err := getLocalStateDir(name)
+	if err != nil {
+		return err
+	}
 
-		pwd, err := os.Getwd()
-		if err != nil {
-			panic(err)
+	clientAuthAPIVersion, _ := cmd.Flags().GetString("client-authentication-api-version")
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(localStateDir, 0755); err != nil {
+		return err
+	}
+
+	if !rootCmd.PersistentFlags().Changed("input") {
+		if inputs, err = getInitialInputs(localStateDir); err != nil {
+			return err
+		}
+	}
+
+	assetWriter := NewAssetWriter(pwd, localStateDir, assets)
+	inputProcessor := NewInputProcessor(assetWriter)
+
+	if err = assetWriter.Digest("{tf_vars,tf_state}/*"); err != nil {
+		return err
+	}
+	inputIds, err := inputProcessor.Digest(inputs)
+	if err != nil {
+		return err
+	}
+
+	// Fail before anything runs, rather than deep inside terraform or kops
+	if _, err = validateClusterInputs(name, inputs); err != nil {
+		return err
+	}
+
+	var plan *SavedPlan
+	if planID != "" {
+		// Plans are stored with the remote state, which needs the AWS env
+		if err = setAwsEnv(localStateDir, inputIds); err != nil {
+			return err
 		}
 
-		if err = os.MkdirAll(localStateDir, 0755); err != nil {
-			panic(err)
+		backend, err := getStateBackend(name)
+		if err != nil {
+			return err
 		}
 
-		if !rootCmd.PersistentFlags().Changed("input") {
-			inputs = getInitialInputs(localStateDir)
+		if plan, err = readSavedPlan(backend, planID, path.Join(os.TempDir(), name+".plan")); err != nil {
+			return err
 		}
+		defer os.RemoveAll(plan.dir)
 
-		assetWriter := NewAssetWriter(pwd, localStateDir, assets)
-		inputProcessor := NewInputProcessor(assetWriter)
+		if err = plan.check(name, inputProcessor.Checksum()); err != nil {
+			return err
+		}
 
-		assetWriter.Digest("{tf_vars,tf_state}/*")
-		inputIds := inputProcessor.Digest(inputs)
+		current, err := statRemoteState(backend)
+		if err != nil {
+			return &StateError{Err: err}
+		}
+		if err = plan.checkState(current); err != nil {
+			return err
+		}
+	}
+
+	phases, err := NewPhaseRunner(
+		createPhases,
+		PhaseOptions{Always: always, Resume: resume, From: fromPhase, Only: onlyPhases, Plan: planID},
+		PhaseSources{
+			Dir:    localStateDir,
+			Vars:   inputProcessor.Checksum(),
+			Assets: assets,
+			Flags:  cmd.Flags(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	phasePlan, err := phases.Plan()
+	if err != nil {
+		return err
+	}
+
+	Logger.Infof(`Phases of cluster "%s", according to the local state:`, name)
+	if !printPhasePlan(phasePlan) {
+		Logger.Infof(`No changes to apply for cluster "%s". Use --always to override`, name)
+		return nil
+	}
+
+	Logger.Infof(`Applying changes to cluster "%s"`, name)
+
+	if plan == nil {
+		if err = setAwsEnv(localStateDir, inputIds); err != nil {
+			return err
+		}
+	}
+
+	err = useRemoteState(name, RemoteStateOptions{Read: true, Write: true}, func() error {
+		if plan != nil {
+			// Checked again under the state lock, in case the remote state changed since it was checked
+			current, err := readRemoteStateRecord()
+			if err != nil {
+				return &StateError{Err: err}
+			}
+			if err = plan.checkState(current); err != nil {
+				return err
+			}
+			Logger.Infof("Applying plan %s, saved %s", plan.ID, plan.CreatedAt.Format(time.RFC3339))
 
-		if !always && !inputProcessor.Changed() {
-			Logger.Infof(`No changes to apply for cluster "%s". Use --always to override`, name)
-			return
+			// A failed apply changes the remote state, so the rest of the plan has to be saved again
+			resumeCommand = fmt.Sprintf("%s plan %s --out", os.Args[0], name)
 		}
 
-		Logger.Infof(`Applying changes to cluster "%s"`, name)
+		return phases.Run("tf-state", func() error {
+			if !isStateBucketManaged() {
+				Logger.Infof(`Using existing state bucket "%s"`, stateBucketName)
+				return nil
+			}
 
-		setAwsEnv(localStateDir, inputIds)
+			return useWorkDir(path.Join(localStateDir, "tf_state"), func() error {
+				if plan != nil {
+					// Keep the provider versions that the plan was made with
+					if err := shell("terraform", "init"); err != nil {
+						return err
+					}
+					planFile, err := plan.terraformPlanFile("tf_state")
+					if err != nil {
+						return err
+					}
+					return shell("terraform", "apply", "-compact-warnings", planFile)
+				}
 
-		useRemoteState(name, stateBucketName, true, true, func() {
-			useWorkDir(path.Join(localStateDir, "tf_state"), func() {
-				shell("terraform", "init", "-upgrade")
+				if err := shell("terraform", "init", "-upgrade"); err != nil {
+					return err
+				}
 
-				shell(
-					"bash",
-					"-c",
-					fmt.Sprintf(
-						`terraform apply -auto-approve -compact-warnings -var "cluster_name=%s" -var "state_bucket_name=%s" %s`,
-						name,
-						stateBucketName,
-						getVarFileFlags(inputIds),
-					),
+				return shell(
+					"terraform",
+					"apply",
+					"-auto-approve",
+					"-compact-warnings",
+					"-var", "cluster_name="+name,
+					"-var", "state_bucket_name="+stateBucketName,
+					getVarFileFlags(inputIds),
 				)
 			})
 		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = assetWriter.Digest(); err != nil {
+		return err
+	}
+
+	backend, err := getStateBackend(name)
+	if err != nil {
+		return err
+	}
+
+	Logger.Infof(`Writing output to "%s"`, backend.Location(remoteStateKey))
+
+	err = useRemoteState(name, RemoteStateOptions{Read: true, Write: true}, func() error {
+		return useWorkDir("tf", func() error {
+			if err := assetWriter.Digest(); err != nil {
+				return err
+			}
 
-		assetWriter.Digest()
-
-		Logger.Infof(`Writing output to "s3://%s"`, stateBucketName)
+			// terraform is initialized once, by the first phase that applies it
+			var isTerraformInitialized bool
+			initTerraform := func() error {
+				if isTerraformInitialized {
+					return nil
+				}
+				// Keep the provider versions that a saved plan was made with
+				args := []string{"init", "-upgrade"}
+				if plan != nil {
+					args = []string{"init"}
+				}
+				if err := shell("terraform", args); err != nil {
+					return err
+				}
+				isTerraformInitialized = true
+				return nil
+			}
 
-		useRemoteState(name, stateBucketName, true, true, func() {
-			useWorkDir("tf", func() {
-				assetWriter.Digest()
+			// Write terraform output for the kops templates and the kubeconfig
+			writeTerraformOutput := func() error {
+				terraformOutputBytes, err := getTerraformOutputJSONBytes()
+				if err != nil {
+					return err
+				}
 
-				shell("terraform", "init", "-upgrade")
+				assets.AddBytes(path.Join("tf", "output.json"), terraformOutputBytes)
+				return assetWriter.Digest()
+			}
 
-				shell(
-					"bash",
-					"-c",
-					fmt.Sprintf(
-						`terraform apply %s -compact-warnings -var "cluster_name=%s" -var "state_bucket_name=%s" %s`,
-						autoFlags,
-						name,
-						stateBucketName,
-						getVarFileFlags(inputIds),
-					),
-				)
+			err := phases.Run("tf", func() error {
+				if err := initTerraform(); err != nil {
+					return err
+				}
 
-				terraformOutputBytes, err := getTerraformOutputJSONBytes()
-				if err != nil {
-					panic(err)
+				if plan != nil {
+					planFile, err := plan.terraformPlanFile("tf")
+					if err != nil {
+						return err
+					}
+					if err := shell("terraform", "apply", "-compact-warnings", planFile); err != nil {
+						return err
+					}
+					return writeTerraformOutput()
 				}
 
-				var terraformOutput map[string]interface{}
-				err = json.Unmarshal(terraformOutputBytes, &terraformOutput)
+				err := shell(
+					"terraform",
+					"apply",
+					autoFlags,
+					"-compact-warnings",
+					"-var", "cluster_name="+name,
+					"-var", "state_bucket_name="+stateBucketName,
+					getVarFileFlags(inputIds),
+				)
 				if err != nil {
-					panic(err)
+					return err
 				}
 
-				assets.AddBytes(path.Join("tf", "output.json"), terraformOutputBytes)
-				assetWriter.Digest()
+				return writeTerraformOutput()
+			})
+			if err != nil {
+				return err
+			}
 
-				awsIamClusterAdminRoleArn := terraformOutput["aws_iam_cluster_admin_role_arn"].(string)
+			if err = os.Setenv("CLUSTER", name); err != nil {
+				return err
+			}
 
-				if err = os.Setenv("CLUSTER", name); err != nil {
-					panic(err)
-				}
+			if err = setKopsStateStoreEnv(name); err != nil {
+				return err
+			}
 
-				if err = os.Setenv("KOPS_STATE_STORE", "s3://"+stateBucketName+"/kops"); err != nil {
-					panic(err)
-				}
+			if err = os.Setenv("KOPS_FEATURE_FLAGS", "-TerraformManagedFiles"); err != nil {
+				return err
+			}
+
+			adminKubeconfigPath := path.Join(localStateDir, ".kubeconfig.admin.yaml")
+			kubeconfigPath := path.Join(localStateDir, "kubeconfig.yaml")
 
-				if err = os.Setenv("KOPS_FEATURE_FLAGS", "-TerraformManagedFiles"); err != nil {
-					panic(err)
+			// Export the cluster kubeconfig with temporary admin creds, once
+			var isAdminKubeconfigExported bool
+			exportAdminKubeconfig := func() error {
+				if isAdminKubeconfigExported {
+					return nil
+				}
+				err := shell(
+					"kops",
+					"export",
+					"kubeconfig",
+					name,
+					"--admin",
+					"--kubeconfig",
+					adminKubeconfigPath,
+				)
+				if err != nil {
+					return err
 				}
+				if err = os.Setenv("KUBECONFIG", adminKubeconfigPath); err != nil {
+					return err
+				}
+				isAdminKubeconfigExported = true
+				return nil
+			}
 
-				adminKubeconfigPath := path.Join(localStateDir, ".kubeconfig.admin.yaml")
-				kubeconfigPath := path.Join(localStateDir, "kubeconfig.yaml")
+			// Recorded by kops-replace, since the cluster exists once it is replaced
+			newCluster, err := phases.Get("new_cluster")
+			if err != nil {
+				return err
+			}
+			isNewCluster := newCluster == "true"
 
-				// Export the cluster kubeconfig with temporary admin creds
-				exportAdminKubeconfig := func() {
-					shell(
-						"kops",
-						"export",
-						"kubeconfig",
-						name,
-						"--admin",
-						"--kubeconfig",
-						adminKubeconfigPath,
-					)
-					if err = os.Setenv("KUBECONFIG", adminKubeconfigPath); err != nil {
-						panic(err)
-					}
+			err = phases.Run("kops-replace", func() error {
+				getCluster := NewCommand("kops", "get", "cluster", name)
+				getCluster.Capture = true
+				getCluster.Quiet = true
+				_, err := runner.Run(getCluster)
+				if err != nil {
+					Logger.Debug(err)
+				}
+				isNewCluster = err != nil
+				if err := phases.Set("new_cluster", strconv.FormatBool(isNewCluster)); err != nil {
+					return err
 				}
 
-				var isNewCluster bool
-				shell(
-					"bash",
-					"-c",
-					"kops get cluster $CLUSTER &> /dev/null",
-					func(err error) {
-						Logger.Debug(err)
-						isNewCluster = true
-					},
-				)
+				// --force is required to replace a cluster that doesn't exist
+				// or to create a new node group in an existing cluster
+				replace := NewCommand("kops", "replace", "--force", "-f", "-")
+
+				rendered, err := plan.rendered(savedPlanKopsFile, "output.json")
+				if err != nil {
+					return err
+				}
+				if rendered != nil {
+					return shellInput(rendered, replace)
+				}
 
-				shell(
-					"bash",
-					"-c",
-					fmt.Sprintf(
-						`
-							kops replace \
-								%s \
-								-f <(
-									kops toolbox template \
-										--name "$CLUSTER" \
-										--set-string "cluster_name=$CLUSTER" \
-										--values output.json \
-										--template <(cat ../kops/*) \
-										--format-yaml
-								)
-						`,
-						// --force is required to replace a cluster that doesn't exist
-						// or to create a new node group in an existing cluster
-						"--force",
-					),
+				template, err := newKopsTemplateCommand(
+					name,
+					"kops/*",
+					"--set-string", "cluster_name="+name,
+					"--set-string", "kops_state_store="+os.Getenv("KOPS_STATE_STORE"),
 				)
+				if err != nil {
+					return err
+				}
+				return shellPipe(template, replace)
+			})
+			if err != nil {
+				return err
+			}
 
+			err = phases.Run("kops-update", func() error {
 				if isNewCluster {
-					if err = os.Setenv("KUBECONFIG", kubeconfigPath); err != nil {
-						panic(err)
+					if err := os.Setenv("KUBECONFIG", kubeconfigPath); err != nil {
+						return err
 					}
-				} else {
-					exportAdminKubeconfig()
+				} else if err := exportAdminKubeconfig(); err != nil {
+					return err
 				}
 
-				shell(
+				err := shell(
 					"kops",
 					"update",
 					"cluster",
@@ -209,14 +470,27 @@ var createCmd = &cobra.Command{
 					}(),
 					"--allow-kops-downgrade",
 				)
+				if err != nil {
+					return err
+				}
 
 				if isNewCluster {
-					exportAdminKubeconfig()
+					return exportAdminKubeconfig()
 				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
 
+			err = phases.Run("patch-terraform", func() error {
 				NewByteSlice := func(b []byte) *([]byte) { return &b }
 
-				useWorkDir(pwd, func() {
+				return useWorkDir(pwd, func() error {
+					if skipInDryRun("post-process the terraform generated by kops in %s", path.Join(localStateDir, "tf")) {
+						return nil
+					}
+
 					kopsTfHclFile := path.Join(localStateDir, "tf", "kubernetes.tf")
 					kopsTfJsonFile := path.Join(localStateDir, "tf", "kubernetes.tf.json")
 					// Kops >= 1.23 does not support terraform json output
@@ -224,14 +498,14 @@ var createCmd = &cobra.Command{
 						// Remove the old generated terraform json if it still exists
 						if fileExists(kopsTfJsonFile) {
 							if err = os.Remove(kopsTfJsonFile); err != nil {
-								panic(err)
+								return err
 							}
 						}
 
 						// Sad hackery 😞
 						file, err := os.OpenFile(kopsTfHclFile, os.O_RDWR, 0644)
 						if err != nil {
-							Logger.Fatal(err)
+							return err
 						}
 						defer file.Close()
 
@@ -266,34 +540,34 @@ var createCmd = &cobra.Command{
 						}
 
 						if err := scanner.Err(); err != nil {
-							Logger.Fatal(err)
+							return err
 						}
 
 						// Move cursor back to beginning
 						if _, err := file.Seek(0, 0); err != nil {
-							Logger.Fatal(err)
+							return err
 						}
 
 						// Truncate the file
 						if err := file.Truncate(0); err != nil {
-							Logger.Fatal(err)
+							return err
 						}
 
 						// Replace file contents
 						if _, err := file.Write(kopsHCLBytes); err != nil {
-							Logger.Fatal(err)
+							return err
 						}
 					} else {
 						// Read the generated kops terraform
 						kopsJSONBytes, err := ioutil.ReadFile(kopsTfJsonFile)
 						if err != nil {
-							panic(err)
+							return err
 						}
 
 						var kopsJSON map[string]interface{}
 						err = json.Unmarshal(kopsJSONBytes, &kopsJSON)
 						if err != nil {
-							panic(err)
+							return err
 						}
 
 						// Remove duplicate output
@@ -309,7 +583,7 @@ var createCmd = &cobra.Command{
 						// Get terraform json output
 						terraformOutputJSON, err := getTerraformOutputJSON()
 						if err != nil {
-							panic(err)
+							return err
 						}
 
 						kopsResources := kopsJSON["resource"].(map[string]interface{})
@@ -360,135 +634,131 @@ var createCmd = &cobra.Command{
 
 						kopsJSONBytes, err = json.MarshalIndent(kopsJSON, "", "  ")
 						if err != nil {
-							panic(err)
+							return err
 						}
 
 						err = ioutil.WriteFile(kopsTfJsonFile, kopsJSONBytes, 0644)
 						if err != nil {
-							panic(err)
+							return err
 						}
 					}
+					return nil
 				})
+			})
+			if err != nil {
+				return err
+			}
+
+			err = phases.Run("tf-finish", func() error {
+				if err := initTerraform(); err != nil {
+					return err
+				}
 
 				// Finish provisioning
-				shell(
-					"bash",
-					"-c",
-					fmt.Sprintf(
-						`terraform apply -refresh=false %s -compact-warnings -var "cluster_name=%s" -var "state_bucket_name=%s" %s`,
-						autoFlags,
-						name,
-						stateBucketName,
-						getVarFileFlags(inputIds),
-					),
+				err := shell(
+					"terraform",
+					"apply",
+					"-refresh=false",
+					autoFlags,
+					"-compact-warnings",
+					"-var", "cluster_name="+name,
+					"-var", "state_bucket_name="+stateBucketName,
+					getVarFileFlags(inputIds),
 				)
-
-				// Write kops terraform output
-				terraformOutputBytes, err = getTerraformOutputJSONBytes()
 				if err != nil {
-					panic(err)
+					return err
 				}
 
-				assets.AddBytes(path.Join("tf", "output.json"), terraformOutputBytes)
-				assetWriter.Digest()
+				// Write kops terraform output
+				return writeTerraformOutput()
+			})
+			if err != nil {
+				return err
+			}
 
+			err = phases.Run("rolling-update", func() error {
 				if isNewCluster {
 					Logger.Info("Waiting 3m for the cluster to come online")
-					time.Sleep(3 * time.Minute)
-				} else {
-					shell(
-						"bash",
-						"-c",
-						fmt.Sprintf(
-							"kops rolling-update cluster %s %s %s --yes",
-							name,
-							func() string {
-								if fast {
-									return "--cloudonly"
-								}
-								return ""
-							}(),
-							func() string {
-								if isDebug() {
-									return "-v7"
-								}
-								return ""
-							}(),
-						),
-					)
-				}
-
-				// Wait until the only remaining validation failures are expected
-				for {
-					var validateBytes []byte
-					validateArgs := []interface{}{
-						"validate",
-						"cluster",
-						name,
-						"-o",
-						"json",
-					}
-					if isDebug() {
-						validateArgs = append(validateArgs, "-v7")
+					if err := runner.Sleep(3 * time.Minute); err != nil {
+						return err
 					}
-					validateArgs = append(
-						validateArgs,
-						func(err error) {
-							Logger.Warn(err)
-						},
-						func(output []byte) {
-							validateBytes = output
-						},
-					)
-					shell("kops", validateArgs...)
-
-					var validateJSON map[string]interface{}
-					json.Unmarshal(validateBytes, &validateJSON)
-
-					if validateJSON != nil {
+					return phases.Set("new_cluster", "false")
+				}
+
+				if err := exportAdminKubeconfig(); err != nil {
+					return err
+				}
+
+				return shell(
+					"kops",
+					"rolling-update",
+					"cluster",
+					name,
+					func() string {
+						if fast {
+							return "--cloudonly"
+						}
+						return ""
+					}(),
+					func() string {
 						if isDebug() {
-							Logger.Debug(FormatStruct(validateJSON))
+							return "-v7"
 						}
+						return ""
+					}(),
+					"--yes",
+				)
+			})
+			if err != nil {
+				return err
+			}
 
-						if validateJSON["failures"] == nil {
-							break
-						}
+			err = phases.Run("validate", func() error {
+				if err := exportAdminKubeconfig(); err != nil {
+					return err
+				}
+				return waitForClusterValidation(name, timeout)
+			})
+			if err != nil {
+				return err
+			}
 
-						failures := validateJSON["failures"].([]interface{})
-						expectedFailureCount := 0
+			err = phases.Run("k8s-manifests", func() error {
+				if err := exportAdminKubeconfig(); err != nil {
+					return err
+				}
 
-						for _, f := range failures {
-							failure := f.(map[string]interface{})
-							if strings.HasPrefix(failure["name"].(string), "kube-system/aws-iam-authenticator") {
-								expectedFailureCount++
-							}
-						}
+				// Create kubernetes resources
+				apply := NewCommand("kubectl", "apply", "-f", "-")
 
-						if len(failures) == expectedFailureCount {
-							break
-						}
-					}
+				rendered, err := plan.rendered(savedPlanManifestsFile, "output.json")
+				if err != nil {
+					return err
+				}
+				if rendered != nil {
+					return shellInput(rendered, apply)
+				}
 
-					Logger.Info("Cluster validation failed, trying again in 30s")
-					time.Sleep(30 * time.Second)
+				template, err := newKopsTemplateCommand(name, "k8s/*.yaml")
+				if err != nil {
+					return err
 				}
+				return shellPipe(template, apply)
+			})
+			if err != nil {
+				return err
+			}
 
-				// Create kubernetes resources
-				shell(
-					"bash",
-					"-c",
-					`
-						kops toolbox template \
-							--name "$CLUSTER" \
-							--values output.json \
-							--template <(cat ../k8s/*.yaml) \
-							--format-yaml |
-						kubectl apply -f -
-					`,
-				)
+			return phases.Run("kubeconfig", func() error {
+				terraformOutput, err := readTerraformOutputFile("output.json")
+				if err != nil {
+					return err
+				}
+
+				awsIamClusterAdminRoleArn := cast.ToString(terraformOutput["aws_iam_cluster_admin_role_arn"])
 
 				if err = os.Setenv("KUBECONFIG", kubeconfigPath); err != nil {
-					panic(err)
+					return err
 				}
 
 				// Build cluster kubeconfig
@@ -496,63 +766,155 @@ var createCmd = &cobra.Command{
 
 				var kubeconfigBytes []byte
 				if kubeconfigBytes, err = yaml.Marshal(kubeconfig); err != nil {
-					panic(err)
+					return err
 				}
 
-				if err = os.Remove(kubeconfigPath); err != nil {
-					panic(err)
+				if err = os.Remove(kubeconfigPath); err != nil && !os.IsNotExist(err) {
+					return err
 				}
 
 				assets.AddBytes("kubeconfig.yaml", kubeconfigBytes)
-				assetWriter.Digest("kubeconfig.yaml")
+				if err = assetWriter.Digest("kubeconfig.yaml"); err != nil {
+					return err
+				}
 
 				// Build environment file
-				assets.AddBytes(".env", generateDefaultEnvironmentFile(name))
-				assetWriter.Digest(".env")
-
-				// Commit input checksum
-				inputProcessor.Commit()
+				envBytes, err := generateDefaultEnvironmentFile(name)
+				if err != nil {
+					return err
+				}
+				assets.AddBytes(".env", envBytes)
+				return assetWriter.Digest(".env")
 			})
 		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Wait until the cluster is reachable with iam authenticator
+	err = phases.Run("authenticate", func() error {
+		if err := os.Setenv("KUBECONFIG", path.Join(localStateDir, "kubeconfig.yaml")); err != nil {
+			return err
+		}
 
-		// Wait until the cluster is reachable with iam authenticator
-		useWorkDir(pwd, func() {
-			var isReady bool
+		return useWorkDir(pwd, func() error {
+			authDeadline := time.Now().Add(timeout)
 
 			for {
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							Logger.Debugf("Recovered: %s", r)
-						} else {
-							isReady = true
-						}
-					}()
-					shell(
-						"bash",
-						"-c",
-						"kubectl get pods -n kube-system -o name > /dev/null",
-					)
-				}()
+				err := shell(
+					"kubectl",
+					"get",
+					"pods",
+					"-n", "kube-system",
+					"-o", "name",
+					func(output []byte) {},
+				)
+				if err == nil {
+					return nil
+				}
+				Logger.Debug(err)
 
-				if isReady {
-					break
+				if timeout > 0 && time.Now().After(authDeadline) {
+					return &TimeoutError{Operation: "cluster authentication", Timeout: timeout}
 				}
 
 				Logger.Info("Cluster authentication failed, trying again in 30s")
-				time.Sleep(30 * time.Second)
+				if err := runner.Sleep(30 * time.Second); err != nil {
+					return err
+				}
 			}
 		})
+	})
+	if err != nil {
+		return err
+	}
 
-		Logger.Info("☕️ Your cluster is ready!")
-		Logger.Infof(`Output written to "%s"`, localStateDir)
-	},
+	if isDryRun() {
+		return nil
+	}
+
+	Logger.Info("☕️ Your cluster is ready!")
+	Logger.Infof(`Output written to "%s"`, localStateDir)
+
+	return nil
+}
+
+// waitForClusterValidation - wait until the only remaining kops validation failures are expected
+func waitForClusterValidation(name string, timeout time.Duration) error {
+	validateDeadline := time.Now().Add(timeout)
+	for {
+		var validateBytes []byte
+		validateArgs := []interface{}{
+			"validate",
+			"cluster",
+			name,
+			"-o",
+			"json",
+		}
+		if isDebug() {
+			validateArgs = append(validateArgs, "-v7")
+		}
+		validateArgs = append(
+			validateArgs,
+			func(output []byte) {
+				validateBytes = output
+			},
+		)
+		if err := shell("kops", validateArgs...); err != nil {
+			Logger.Warn(err)
+		}
+
+		var validateJSON map[string]interface{}
+		json.Unmarshal(validateBytes, &validateJSON)
+
+		if validateJSON != nil {
+			if isDebug() {
+				Logger.Debug(FormatStruct(validateJSON))
+			}
+
+			if validateJSON["failures"] == nil {
+				return nil
+			}
+
+			if failures, ok := validateJSON["failures"].([]interface{}); ok {
+				expectedFailureCount := 0
+
+				for _, f := range failures {
+					failure, _ := f.(map[string]interface{})
+					if name, _ := failure["name"].(string); strings.HasPrefix(name, "kube-system/aws-iam-authenticator") {
+						expectedFailureCount++
+					}
+				}
+
+				if len(failures) == expectedFailureCount {
+					return nil
+				}
+			}
+		}
+
+		if timeout > 0 && time.Now().After(validateDeadline) {
+			return &TimeoutError{Operation: "cluster validation", Timeout: timeout}
+		}
+
+		Logger.Info("Cluster validation failed, trying again in 30s")
+		if err := runner.Sleep(30 * time.Second); err != nil {
+			return err
+		}
+	}
 }
 
 func init() {
 	rootCmd.AddCommand(createCmd)
-	createCmd.Flags().Bool("always", false, "Always try to apply changes, even if the checksum has not changed")
+	createCmd.Flags().Bool("always", false, "Run every phase, even if its inputs didn't change")
+	createCmd.Flags().Bool("dry-run", false, "Print the commands that would run, without running them or touching AWS")
 	createCmd.Flags().Bool("fast", false, "Apply updates as quickly as possible. This is not safe in production")
+	createCmd.Flags().String("from-phase", "", "Run the given phase and every phase after it. One of "+strings.Join(getPhaseNames(createPhases), ", "))
+	createCmd.Flags().StringSlice("only-phase", nil, "Run only the given phases")
+	createCmd.Flags().StringVar(&recordFile, "record", "", "Record the external commands and their results to a fixture file")
+	createCmd.Flags().StringVar(&replayFile, "replay", "", "Replay the external commands from a fixture file instead of running them")
+	createCmd.Flags().Bool("resume", false, "Skip the phases that completed with the same inputs. This is the default without --always, --from-phase or --only-phase")
+	createCmd.Flags().Duration("timeout", 30*time.Minute, "Time to wait for the cluster to pass validation and accept requests. 0 waits forever")
 	createCmd.Flags().Bool("yes", false, "Skip confirmation")
 	createCmd.Flags().String("client-authentication-api-version", "client.authentication.k8s.io/v1beta1", "Version of the Kubernetes Client Authentication API to use when generating the Kubeconfig file")
 }
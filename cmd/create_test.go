@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bfmiv/klarista/test/toolchain"
+)
+
+func TestWaitForClusterValidation(t *testing.T) {
+	const name = "dev2-test.bfmiv.com"
+
+	tests := []struct {
+		name string
+		// script the responses of kops validate cluster
+		script func(tc *toolchain.Toolchain)
+		// timeout, if set, is expected to be reached
+		timeout time.Duration
+		// calls is the expected number of validations, or the minimum if a timeout is expected
+		calls int
+	}{
+		{
+			name: "valid",
+			script: func(tc *toolchain.Toolchain) {
+				tc.On("kops", "validate", "cluster").Stdout(`{}`)
+			},
+			calls: 1,
+		},
+		{
+			name: "only aws-iam-authenticator failures",
+			script: func(tc *toolchain.Toolchain) {
+				tc.On("kops", "validate", "cluster").
+					Stdout(`{"failures":[{"type":"Pod","name":"kube-system/aws-iam-authenticator-7xqnd"}]}`).
+					Exit(2)
+			},
+			calls: 1,
+		},
+		{
+			name: "fails, then valid",
+			script: func(tc *toolchain.Toolchain) {
+				tc.On("kops", "validate", "cluster").Times(2).Exit(1)
+				tc.On("kops", "validate", "cluster").Once().
+					Stdout(`{"failures":[{"type":"Node","name":"ip-172-70-0-10.ec2.internal"}]}`).
+					Exit(2)
+				tc.On("kops", "validate", "cluster").Stdout(`{}`)
+			},
+			calls: 4,
+		},
+		{
+			name: "times out",
+			script: func(tc *toolchain.Toolchain) {
+				tc.On("kops", "validate", "cluster").Exit(1)
+			},
+			timeout: 100 * time.Millisecond,
+			calls:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, r := useTestToolchain(t)
+			tt.script(tc)
+
+			err := waitForClusterValidation(name, tt.timeout)
+
+			calls := len(tc.CallsTo("kops", "validate", "cluster", name))
+
+			if tt.timeout > 0 {
+				var timeoutErr *TimeoutError
+				if !errors.As(err, &timeoutErr) {
+					t.Fatalf("waitForClusterValidation() = %v, want a TimeoutError", err)
+				}
+				if calls < tt.calls {
+					t.Errorf("kops validate was called %d times, want at least %d", calls, tt.calls)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("waitForClusterValidation() = %v, want nil", err)
+				}
+				if calls != tt.calls {
+					t.Errorf("kops validate was called %d times, want %d", calls, tt.calls)
+				}
+			}
+
+			// Every failed validation but the last waits before trying again
+			if len(r.sleeps) != calls-1 {
+				t.Errorf("waited %d times after %d validations, want %d", len(r.sleeps), calls, calls-1)
+			}
+		})
+	}
+}
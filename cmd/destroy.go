@@ -1,10 +1,9 @@
 package cmd
 
 import (
-	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
-	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -13,116 +12,152 @@ import (
 var destroyCmd = &cobra.Command{
 	Use:   "destroy <name>",
 	Short: "Destroy an existing cluster",
-	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
 		name := args[0]
-		localStateDir := path.Join(os.TempDir(), name)
-		stateBucketName := strings.ReplaceAll(name, ".", "-") + "-state"
+		stateBucketName := getStateBucketName(name)
 
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
 		yes, _ := cmd.Flags().GetBool("yes")
 		autoFlags := getAutoFlags(yes)
 
+		if dryRun {
+			runner = NewDryRunRunner()
+			defer printDryRunPlan(os.Stdout, currentCommand)
+		} else {
+			if err := useRecordReplay(name); err != nil {
+				return err
+			}
+			defer finishRecordReplay(&err)
+		}
+
+		localStateDir, err := getLocalStateDir(name)
+		if err != nil {
+			return err
+		}
+
 		pwd, err := os.Getwd()
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		if !rootCmd.PersistentFlags().Changed("input") {
-			inputs = getInitialInputs(localStateDir)
+			if inputs, err = getInitialInputs(localStateDir); err != nil {
+				return err
+			}
 		}
 
 		assetWriter := NewAssetWriter(pwd, localStateDir, assets)
 		inputProcessor := NewInputProcessor(assetWriter)
 
-		assetWriter.Digest()
+		if err := assetWriter.Digest(); err != nil {
+			return err
+		}
 
-		inputIds := inputProcessor.Digest(inputs)
+		inputIds, err := inputProcessor.Digest(inputs)
+		if err != nil {
+			return err
+		}
 
-		setAwsEnv(localStateDir, inputIds)
+		if err := setAwsEnv(localStateDir, inputIds); err != nil {
+			return err
+		}
 
-		if err = os.Setenv("KOPS_STATE_STORE", "s3://"+stateBucketName+"/kops"); err != nil {
-			panic(err)
+		if err := setKopsStateStoreEnv(name); err != nil {
+			return err
 		}
 
 		Logger.Infof(`Destroying cluster "%s"`, name)
 
-		useRemoteState(name, stateBucketName, true, true, func() {
-			if err = os.Setenv("CLUSTER", name); err != nil {
-				panic(err)
+		// A destroy that fails partway keeps the local state and writes it back, so
+		// that it can be run again. The state bucket is only destroyed last
+		return useRemoteState(name, RemoteStateOptions{Read: true, Write: true}, func() error {
+			if err := os.Setenv("CLUSTER", name); err != nil {
+				return err
 			}
 
-			if err = os.Setenv("KUBECONFIG", path.Join(localStateDir, "kubeconfig.yaml")); err != nil {
-				panic(err)
+			if err := os.Setenv("KUBECONFIG", path.Join(localStateDir, "kubeconfig.yaml")); err != nil {
+				return err
 			}
 
-			useWorkDir("tf", func() {
-				defer func() {
-					if r := recover(); r != nil {
-						Logger.Infof("Recovered: %s", r)
-					}
-				}()
-
-				shell("terraform", "init")
-
-				shell(
-					"bash",
-					"-c",
-					fmt.Sprintf(
-						`
-							terraform destroy \
-								-compact-warnings \
-								-var "cluster_name=%s" \
-								-var "state_bucket_name=%s" \
-								%s \
-								%s
-						`,
-						name,
-						stateBucketName,
-						autoFlags,
-						getVarFileFlags(inputIds),
-					),
+			err := useWorkDir("tf", func() error {
+				if err := shell("terraform", "init"); err != nil {
+					return err
+				}
+
+				err := shell(
+					"terraform",
+					"destroy",
+					"-compact-warnings",
+					"-var", "cluster_name="+name,
+					"-var", "state_bucket_name="+stateBucketName,
+					autoFlags,
+					getVarFileFlags(inputIds),
 				)
+				if err != nil {
+					return err
+				}
 
-				shell(
-					"bash",
-					"-c",
-					`
-						if kops get cluster $CLUSTER > /dev/null; then
-							kops delete cluster $CLUSTER --yes
-						fi
-					`,
-				)
+				// The cluster may never have been created, or already be deleted
+				if err := shell("kops", "get", "cluster", name, func(output []byte) {}); err != nil {
+					Logger.Debug(err)
+					return nil
+				}
+
+				return shell("kops", "delete", "cluster", name, "--yes")
 			})
+			if err != nil {
+				return err
+			}
 
-			useWorkDir("tf_state", func() {
-				shell("terraform", "init")
-
-				shell(
-					"bash",
-					"-c",
-					fmt.Sprintf(
-						`
-							terraform destroy \
-								-compact-warnings \
-								-var "cluster_name=%s" \
-								-var "state_bucket_name=%s" \
-								%s \
-								%s
-						`,
-						name,
-						stateBucketName,
-						autoFlags,
-						getVarFileFlags(inputIds),
-					),
+			err = useWorkDir("tf_state", func() error {
+				if !isStateBucketManaged() {
+					Logger.Infof(`Keeping existing state bucket "%s"`, stateBucketName)
+					return nil
+				}
+
+				if err := shell("terraform", "init"); err != nil {
+					return err
+				}
+
+				return shell(
+					"terraform",
+					"destroy",
+					"-compact-warnings",
+					"-var", "cluster_name="+name,
+					"-var", "state_bucket_name="+stateBucketName,
+					autoFlags,
+					getVarFileFlags(inputIds),
 				)
 			})
+			if err != nil {
+				return err
+			}
+
+			if skipInDryRun("remove the local state in %s", localStateDir) {
+				return nil
+			}
 
-			shell("bash", "-c", "ls -a1 | tail -n +3 | xargs rm -rf")
+			entries, err := ioutil.ReadDir(".")
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err = os.RemoveAll(entry.Name()); err != nil {
+					return err
+				}
+			}
+			return nil
 		})
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(destroyCmd)
+	destroyCmd.Flags().Bool("dry-run", false, "Print the commands that would run, without running them or touching AWS")
+	destroyCmd.Flags().StringVar(&recordFile, "record", "", "Record the external commands and their results to a fixture file")
+	destroyCmd.Flags().StringVar(&replayFile, "replay", "", "Replay the external commands from a fixture file instead of running them")
 	destroyCmd.Flags().Bool("yes", false, "Skip confirmation")
 }
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/bfmiv/klarista/test/toolchain"
+)
+
+func TestDestroyFailsPartway(t *testing.T) {
+	const name = "dev2-lavender.bfmiv.com"
+
+	input, err := ioutil.ReadFile(path.Join("..", "test", "fixtures", name, "input.tfvars"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// script the failure
+		script func(tc *toolchain.Toolchain)
+		// deleted is whether kops delete cluster is expected to run
+		deleted bool
+	}{
+		{
+			name: "terraform destroy fails",
+			script: func(tc *toolchain.Toolchain) {
+				tc.On("terraform", "destroy").Once().Exit(1)
+			},
+		},
+		{
+			name: "kops delete fails",
+			script: func(tc *toolchain.Toolchain) {
+				tc.On("kops", "delete", "cluster").Exit(1)
+			},
+			deleted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, _ := useTestToolchain(t)
+			tt.script(tc)
+
+			tmpDir := t.TempDir()
+			t.Setenv("TMPDIR", tmpDir)
+
+			workDir := t.TempDir()
+			if err := ioutil.WriteFile(path.Join(workDir, "input.tfvars"), input, 0644); err != nil {
+				t.Fatal(err)
+			}
+			useTestWorkDir(t, workDir)
+
+			stateDir := path.Join(tmpDir, "state")
+			err := executeTestCommand(t, "--state-backend", "local", "--state-local-dir", stateDir, "destroy", name, "--yes")
+
+			var toolErr *ToolError
+			if !errors.As(err, &toolErr) {
+				t.Fatalf("destroy = %v, want a ToolError", err)
+			}
+			if code := getExitCode(err); code != exitCodeTool {
+				t.Errorf("exit code = %d, want %d", code, exitCodeTool)
+			}
+
+			if deleted := len(tc.CallsTo("kops", "delete", "cluster", name)) > 0; deleted != tt.deleted {
+				t.Errorf("kops delete cluster called = %t, want %t", deleted, tt.deleted)
+			}
+
+			// The state bucket is only destroyed once the cluster is
+			for _, call := range tc.CallsTo("terraform", "destroy") {
+				if strings.HasSuffix(call.Dir, "/tf_state") {
+					t.Errorf("%s was called in %s", call, call.Dir)
+				}
+			}
+
+			localStateDir := path.Join(tmpDir, name)
+			if !fileExists(path.Join(localStateDir, "tf", "main.tf")) {
+				t.Errorf("the local state in %s was removed", localStateDir)
+			}
+
+			// The local state is written back, so that destroy can be run again
+			backend := NewLocalStateBackend(path.Join(stateDir, getStateBucketName(name)))
+			if current, err := statRemoteState(backend); err != nil || !current.Exists {
+				t.Errorf("the state was not written to %s: %v", backend.Location(remoteStateKey), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,584 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"golang.org/x/crypto/scrypt"
+)
+
+// State encryption schemes
+const (
+	stateEncryptionNone       = "none"
+	stateEncryptionKms        = "kms"
+	stateEncryptionPassphrase = "passphrase"
+)
+
+// Environment variables holding the state passphrase
+const (
+	statePassphraseEnv    = "KLARISTA_STATE_PASSPHRASE"
+	stateOldPassphraseEnv = "KLARISTA_STATE_OLD_PASSPHRASE"
+)
+
+// remoteStateMetadataEncryption - object metadata recording how the state was encrypted
+const remoteStateMetadataEncryption = "Klarista-Encryption"
+
+// encryptedStateMagic - prefix of every encrypted state object
+var encryptedStateMagic = []byte("KLARISTA-ENC\x01")
+
+// encryptedStateChunkSize - size of each independently authenticated plaintext chunk
+const encryptedStateChunkSize = 64 * 1024
+
+// stateEncryption - encryption scheme used to write the remote state
+var stateEncryption string
+
+// stateEncryptionKeyArn - KMS key used to wrap state data keys
+var stateEncryptionKeyArn string
+
+// inputEncryptionKeyArn - "encryption_key_arn" from the cluster inputs, if any
+var inputEncryptionKeyArn string
+
+// ErrStateDecryption - returned when an encrypted state object cannot be decrypted
+var ErrStateDecryption = errors.New("failed to decrypt state")
+
+// EncryptionHeader - describes how an encrypted state object was encrypted
+//
+// The header is authenticated together with every chunk of the object.
+type EncryptionHeader struct {
+	Scheme      string `json:"scheme"`
+	KeyID       string `json:"key_id,omitempty"`
+	WrappedKey  []byte `json:"wrapped_key"`
+	Salt        []byte `json:"salt,omitempty"`
+	NoncePrefix []byte `json:"nonce_prefix"`
+	ChunkSize   int    `json:"chunk_size"`
+}
+
+// StateKeyProvider - generates and unwraps state data keys
+type StateKeyProvider interface {
+	// GenerateKey returns a new data key and a header holding its wrapped form
+	GenerateKey() ([]byte, *EncryptionHeader, error)
+	// UnwrapKey returns the data key wrapped in header
+	UnwrapKey(header *EncryptionHeader) ([]byte, error)
+}
+
+// KmsStateKeyProvider - wraps data keys with a KMS key
+type KmsStateKeyProvider struct {
+	client  kmsiface.KMSAPI
+	keyID   string
+	context map[string]*string
+}
+
+func NewKmsStateKeyProvider(sess *session.Session, keyID, clusterName string) *KmsStateKeyProvider {
+	return &KmsStateKeyProvider{
+		client: kms.New(sess),
+		keyID:  keyID,
+		context: map[string]*string{
+			"klarista:cluster": aws.String(clusterName),
+		},
+	}
+}
+
+func (p *KmsStateKeyProvider) GenerateKey() ([]byte, *EncryptionHeader, error) {
+	result, err := p.client.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:             aws.String(p.keyID),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: p.context,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate data key with %s, %v", p.keyID, err)
+	}
+
+	return result.Plaintext, &EncryptionHeader{
+		Scheme:     stateEncryptionKms,
+		KeyID:      aws.StringValue(result.KeyId),
+		WrappedKey: result.CiphertextBlob,
+	}, nil
+}
+
+func (p *KmsStateKeyProvider) UnwrapKey(header *EncryptionHeader) ([]byte, error) {
+	result, err := p.client.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    header.WrappedKey,
+		EncryptionContext: p.context,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: KMS could not decrypt the data key of %s, %v", ErrStateDecryption, header.KeyID, err)
+	}
+	return result.Plaintext, nil
+}
+
+// PassphraseStateKeyProvider - wraps data keys with a key derived from a passphrase
+//
+// Unwrapping tries each passphrase in turn, so state written with an old
+// passphrase can still be read while it is being rotated.
+type PassphraseStateKeyProvider struct {
+	passphrases []string
+}
+
+func NewPassphraseStateKeyProvider(passphrases ...string) *PassphraseStateKeyProvider {
+	p := &PassphraseStateKeyProvider{}
+	for _, passphrase := range passphrases {
+		if passphrase != "" {
+			p.passphrases = append(p.passphrases, passphrase)
+		}
+	}
+	return p
+}
+
+func deriveStateKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func (p *PassphraseStateKeyProvider) GenerateKey() ([]byte, *EncryptionHeader, error) {
+	if len(p.passphrases) == 0 {
+		return nil, nil, fmt.Errorf("State encryption with a passphrase requires %s to be set", statePassphraseEnv)
+	}
+
+	dataKey, err := randomBytes(32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	salt, err := randomBytes(16)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kek, err := deriveStateKey(p.passphrases[0], salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newStateAead(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dataKey, &EncryptionHeader{
+		Scheme:     stateEncryptionPassphrase,
+		WrappedKey: aead.Seal(nonce, nonce, dataKey, nil),
+		Salt:       salt,
+	}, nil
+}
+
+func (p *PassphraseStateKeyProvider) UnwrapKey(header *EncryptionHeader) ([]byte, error) {
+	if len(p.passphrases) == 0 {
+		return nil, fmt.Errorf("%w: the state is encrypted with a passphrase, but %s is not set", ErrStateDecryption, statePassphraseEnv)
+	}
+
+	for _, passphrase := range p.passphrases {
+		kek, err := deriveStateKey(passphrase, header.Salt)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := newStateAead(kek)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(header.WrappedKey) < aead.NonceSize() {
+			return nil, fmt.Errorf("%w: the wrapped data key is truncated", ErrStateDecryption)
+		}
+
+		nonce, wrapped := header.WrappedKey[:aead.NonceSize()], header.WrappedKey[aead.NonceSize():]
+		if dataKey, err := aead.Open(nil, nonce, wrapped, nil); err == nil {
+			return dataKey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: wrong passphrase", ErrStateDecryption)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newStateAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce - nonce of the nth chunk of an encrypted state object
+func chunkNonce(prefix []byte, n uint64) []byte {
+	nonce := make([]byte, len(prefix)+8)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[len(prefix):], n)
+	return nonce
+}
+
+// chunkAdditionalData - data authenticated with each chunk
+//
+// Marking the final chunk lets truncated objects be detected.
+func chunkAdditionalData(header []byte, final bool) []byte {
+	flag := byte(0)
+	if final {
+		flag = 1
+	}
+	return append(append([]byte{}, header...), flag)
+}
+
+// encryptState - copy r to w, encrypted with a new data key from provider
+//
+// The output is the magic prefix, the length-prefixed JSON header, then a
+// sequence of AES-GCM sealed chunks, each prefixed with its final flag and
+// length.
+func encryptState(w io.Writer, r io.Reader, provider StateKeyProvider) error {
+	dataKey, header, err := provider.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	aead, err := newStateAead(dataKey)
+	if err != nil {
+		return err
+	}
+
+	if header.NoncePrefix, err = randomBytes(aead.NonceSize() - 8); err != nil {
+		return err
+	}
+	header.ChunkSize = encryptedStateChunkSize
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(encryptedStateMagic); err != nil {
+		return err
+	}
+	if err = binary.Write(w, binary.BigEndian, uint32(len(headerBytes))); err != nil {
+		return err
+	}
+	if _, err = w.Write(headerBytes); err != nil {
+		return err
+	}
+
+	buffered := bufio.NewReaderSize(r, encryptedStateChunkSize)
+	plaintext := make([]byte, encryptedStateChunkSize)
+
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(buffered, plaintext)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// The chunk is final if nothing follows it
+		_, peekErr := buffered.Peek(1)
+		final := peekErr == io.EOF
+
+		sealed := aead.Seal(nil, chunkNonce(header.NoncePrefix, n), plaintext[:size], chunkAdditionalData(headerBytes, final))
+
+		flag := byte(0)
+		if final {
+			flag = 1
+		}
+		if _, err = w.Write([]byte{flag}); err != nil {
+			return err
+		}
+		if err = binary.Write(w, binary.BigEndian, uint32(len(sealed))); err != nil {
+			return err
+		}
+		if _, err = w.Write(sealed); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// isEncryptedState - whether r starts with an encrypted state object
+func isEncryptedState(r *bufio.Reader) (bool, error) {
+	magic, err := r.Peek(len(encryptedStateMagic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(magic, encryptedStateMagic), nil
+}
+
+// readEncryptionHeader - read the header of an encrypted state object
+func readEncryptionHeader(r io.Reader) (*EncryptionHeader, []byte, error) {
+	magic := make([]byte, len(encryptedStateMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(magic, encryptedStateMagic) {
+		return nil, nil, fmt.Errorf("%w: not an encrypted state object", ErrStateDecryption)
+	}
+
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, nil, err
+	}
+	if size > 1<<20 {
+		return nil, nil, fmt.Errorf("%w: the encryption header is too large", ErrStateDecryption)
+	}
+
+	headerBytes := make([]byte, size)
+	if _, err := io.ReadFull(r, headerBytes); err != nil {
+		return nil, nil, err
+	}
+
+	var header EncryptionHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid encryption header, %v", ErrStateDecryption, err)
+	}
+
+	return &header, headerBytes, nil
+}
+
+// decryptState - copy the encrypted state object r to w in plain text
+func decryptState(w io.Writer, r io.Reader, providers map[string]StateKeyProvider) error {
+	header, headerBytes, err := readEncryptionHeader(r)
+	if err != nil {
+		return err
+	}
+
+	provider, ok := providers[header.Scheme]
+	if !ok {
+		return fmt.Errorf(`%w: unknown encryption scheme "%s"`, ErrStateDecryption, header.Scheme)
+	}
+
+	dataKey, err := provider.UnwrapKey(header)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newStateAead(dataKey)
+	if err != nil {
+		return err
+	}
+
+	if len(header.NoncePrefix)+8 != aead.NonceSize() {
+		return fmt.Errorf("%w: invalid nonce prefix", ErrStateDecryption)
+	}
+
+	maxSealedSize := uint32(header.ChunkSize + aead.Overhead())
+
+	for n := uint64(0); ; n++ {
+		var flag [1]byte
+		if _, err = io.ReadFull(r, flag[:]); err != nil {
+			return fmt.Errorf("%w: the state is truncated", ErrStateDecryption)
+		}
+
+		var size uint32
+		if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+			return fmt.Errorf("%w: the state is truncated", ErrStateDecryption)
+		}
+		if size > maxSealedSize {
+			return fmt.Errorf("%w: chunk %d is too large", ErrStateDecryption, n)
+		}
+
+		sealed := make([]byte, size)
+		if _, err = io.ReadFull(r, sealed); err != nil {
+			return fmt.Errorf("%w: the state is truncated", ErrStateDecryption)
+		}
+
+		final := flag[0] == 1
+		plaintext, err := aead.Open(nil, chunkNonce(header.NoncePrefix, n), sealed, chunkAdditionalData(headerBytes, final))
+		if err != nil {
+			return fmt.Errorf("%w: chunk %d failed authentication", ErrStateDecryption, n)
+		}
+
+		if _, err = w.Write(plaintext); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// EncryptedStateBackend - state backend that encrypts the state object before writing it
+//
+// Encrypted state is decrypted when it is read, whatever the configured
+// encryption scheme, and plain text state is read as is. The state lock is
+// never encrypted.
+type EncryptedStateBackend struct {
+	StateBackend
+	clusterName string
+}
+
+func NewEncryptedStateBackend(backend StateBackend, clusterName string) *EncryptedStateBackend {
+	return &EncryptedStateBackend{
+		StateBackend: backend,
+		clusterName:  clusterName,
+	}
+}
+
+// getStateEncryptionKeyArn - KMS key used to encrypt the state
+func getStateEncryptionKeyArn() string {
+	if stateEncryptionKeyArn != "" {
+		return stateEncryptionKeyArn
+	}
+	return inputEncryptionKeyArn
+}
+
+func newKmsSession() (*session.Session, error) {
+	return session.NewSession()
+}
+
+// keyProvider - provider of new data keys for the configured encryption scheme, or nil
+func (b *EncryptedStateBackend) keyProvider() (StateKeyProvider, error) {
+	switch stateEncryption {
+	case stateEncryptionNone, "":
+		return nil, nil
+	case stateEncryptionKms:
+		keyArn := getStateEncryptionKeyArn()
+		if keyArn == "" {
+			return nil, fmt.Errorf(`State encryption with KMS requires "encryption_key_arn" in the inputs or --state-encryption-key-arn`)
+		}
+		sess, err := newKmsSession()
+		if err != nil {
+			return nil, err
+		}
+		return NewKmsStateKeyProvider(sess, keyArn, b.clusterName), nil
+	case stateEncryptionPassphrase:
+		return NewPassphraseStateKeyProvider(os.Getenv(statePassphraseEnv)), nil
+	default:
+		return nil, NewInputError(
+			`Unknown state encryption "%s". Expected one of [%s, %s, %s]`,
+			stateEncryption,
+			stateEncryptionNone,
+			stateEncryptionKms,
+			stateEncryptionPassphrase,
+		)
+	}
+}
+
+// unwrapKeyProviders - providers able to unwrap the data key of each encryption scheme
+func (b *EncryptedStateBackend) unwrapKeyProviders() (map[string]StateKeyProvider, error) {
+	sess, err := newKmsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]StateKeyProvider{
+		stateEncryptionKms: NewKmsStateKeyProvider(sess, getStateEncryptionKeyArn(), b.clusterName),
+		stateEncryptionPassphrase: NewPassphraseStateKeyProvider(
+			os.Getenv(statePassphraseEnv),
+			os.Getenv(stateOldPassphraseEnv),
+		),
+	}, nil
+}
+
+func (b *EncryptedStateBackend) Read(key, versionID string, w io.Writer) (*StateObject, error) {
+	if key != remoteStateKey {
+		return b.StateBackend.Read(key, versionID, w)
+	}
+
+	pr, pw := io.Pipe()
+
+	type readResult struct {
+		object *StateObject
+		err    error
+	}
+	done := make(chan readResult, 1)
+
+	go func() {
+		object, err := b.StateBackend.Read(key, versionID, pw)
+		pw.CloseWithError(err)
+		done <- readResult{object, err}
+	}()
+
+	err := func() error {
+		buffered := bufio.NewReader(pr)
+
+		encrypted, err := isEncryptedState(buffered)
+		if err != nil {
+			return err
+		}
+
+		if !encrypted {
+			_, err = io.Copy(w, buffered)
+			return err
+		}
+
+		providers, err := b.unwrapKeyProviders()
+		if err != nil {
+			return err
+		}
+
+		if err = decryptState(w, buffered, providers); err != nil {
+			return err
+		}
+
+		// Anything after the final chunk was not authenticated
+		if n, _ := io.Copy(io.Discard, buffered); n > 0 {
+			return fmt.Errorf("%w: unexpected data after the final chunk", ErrStateDecryption)
+		}
+
+		return nil
+	}()
+
+	// Unblock the backend if decryption stopped early
+	pr.CloseWithError(io.ErrClosedPipe)
+	result := <-done
+
+	if err != nil {
+		return nil, err
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return result.object, nil
+}
+
+func (b *EncryptedStateBackend) Write(key string, r io.Reader, metadata map[string]string) (*StateObject, error) {
+	if key != remoteStateKey {
+		return b.StateBackend.Write(key, r, metadata)
+	}
+
+	provider, err := b.keyProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	if provider == nil {
+		return b.StateBackend.Write(key, r, metadata)
+	}
+
+	encryptedMetadata := map[string]string{}
+	for k, v := range metadata {
+		encryptedMetadata[k] = v
+	}
+	encryptedMetadata[remoteStateMetadataEncryption] = stateEncryption
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encryptState(pw, r, provider))
+	}()
+
+	object, err := b.StateBackend.Write(key, pr, encryptedMetadata)
+	pr.CloseWithError(io.ErrClosedPipe)
+
+	return object, err
+}
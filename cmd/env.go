@@ -5,7 +5,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -14,60 +13,74 @@ import (
 var envCmd = &cobra.Command{
 	Use:   "env <name>",
 	Short: "Print the cluster environment",
-	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
 		name := args[0]
-		stateBucketName := strings.ReplaceAll(name, ".", "-") + "-state"
 		localStateDir := path.Join(os.TempDir(), name)
 		localEnvFile := path.Join(localStateDir, ".env")
 
-		readEnv := func() string {
-			b, err := ioutil.ReadFile(localEnvFile)
-			if err != nil {
-				panic(err)
+		readEnv := func() (string, error) {
+			if _, err := os.Stat(localEnvFile); err != nil {
+				return "", nil
 			}
-			return string(b)
+			b, err := ioutil.ReadFile(localEnvFile)
+			return string(b), err
 		}
 
-		var result string
-
-		_, err := os.Stat(localEnvFile)
-		if err == nil {
-			result = readEnv()
+		result, err := readEnv()
+		if err != nil {
+			return err
 		}
 
 		if result == "" {
 			pwd, err := os.Getwd()
 			if err != nil {
-				panic(err)
+				return err
 			}
 
 			if !rootCmd.PersistentFlags().Changed("input") {
-				inputs = getInitialInputs(localStateDir)
+				if inputs, err = getInitialInputs(localStateDir); err != nil {
+					return err
+				}
 			}
 
 			assetWriter := NewAssetWriter(pwd, localStateDir, assets)
 			inputProcessor := NewInputProcessor(assetWriter)
 
-			assetWriter.Digest("{tf_vars,tf_state}/*")
+			if err := assetWriter.Digest("{tf_vars,tf_state}/*"); err != nil {
+				return err
+			}
 
-			inputIds := inputProcessor.Digest(inputs)
+			inputIds, err := inputProcessor.Digest(inputs)
+			if err != nil {
+				return err
+			}
 
-			setAwsEnv(localStateDir, inputIds)
+			if err := setAwsEnv(localStateDir, inputIds); err != nil {
+				return err
+			}
 
-			useRemoteState(name, stateBucketName, true, false, func() {
-				_, err := os.Stat(localEnvFile)
-				if err == nil {
-					result = readEnv()
-				}
+			err = useRemoteState(name, RemoteStateOptions{Read: true}, func() (err error) {
+				result, err = readEnv()
+				return err
 			})
+			if err != nil {
+				return err
+			}
 		}
 
 		if result == "" {
-			result = string(generateDefaultEnvironmentFile(name))
+			data, err := generateDefaultEnvironmentFile(name)
+			if err != nil {
+				return err
+			}
+			result = string(data)
 		}
 
 		fmt.Print(result)
+		return nil
 	},
 }
 
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes
+const (
+	// exitCodeError - any other error
+	exitCodeError = 1
+	// exitCodeInput - invalid arguments, flags, config or input files
+	exitCodeInput = 2
+	// exitCodeTool - terraform, kops or kubectl failed
+	exitCodeTool = 3
+	// exitCodeState - the remote state couldn't be read, written, locked or verified
+	exitCodeState = 4
+	// exitCodeTimeout - the cluster didn't become ready in time
+	exitCodeTimeout = 5
+	// exitCodeSignal - added to the number of the signal that interrupted klarista, like a shell
+	exitCodeSignal = 128
+)
+
+// InputError - invalid arguments, flags, config or input files
+type InputError struct {
+	Err error
+}
+
+func NewInputError(format string, args ...interface{}) *InputError {
+	return &InputError{Err: fmt.Errorf(format, args...)}
+}
+
+func (e *InputError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+// ToolError - an external command failed
+type ToolError struct {
+	Command string
+	Dir     string
+	// ExitCode is the exit status of the command, or -1 if it didn't run to completion
+	ExitCode int
+	Err      error
+}
+
+// NewToolError - describe the failure of c, unless err is nil
+func NewToolError(c *Command, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var toolErr *ToolError
+	if errors.As(err, &toolErr) {
+		return err
+	}
+
+	exitCode := -1
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+
+	return &ToolError{
+		Command:  strings.Join(strings.Fields(c.String()), " "),
+		Dir:      c.Dir,
+		ExitCode: exitCode,
+		Err:      err,
+	}
+}
+
+func (e *ToolError) Error() string {
+	if e.ExitCode >= 0 {
+		return fmt.Sprintf("`%s` failed with exit status %d (in %s)", e.Command, e.ExitCode, e.Dir)
+	}
+	return fmt.Sprintf("`%s` failed (in %s), %v", e.Command, e.Dir, e.Err)
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+// StateError - the remote state couldn't be read, written, locked or verified
+type StateError struct {
+	Err error
+}
+
+func NewStateError(format string, args ...interface{}) *StateError {
+	return &StateError{Err: fmt.Errorf(format, args...)}
+}
+
+func (e *StateError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError - klarista gave up waiting
+type TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Timed out after %s waiting for %s", e.Timeout, e.Operation)
+}
+
+// InterruptedError - klarista was stopped by a signal
+type InterruptedError struct {
+	Signal os.Signal
+	// Err is the error the interrupted command failed with, if any
+	Err error
+}
+
+func (e *InterruptedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Interrupted by %s, %v", signalName(e.Signal), e.Err)
+	}
+	return fmt.Sprintf("Interrupted by %s", signalName(e.Signal))
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// getExitCode - the exit code for an error returned by a command
+func getExitCode(err error) int {
+	var inputErr *InputError
+	var toolErr *ToolError
+	var stateErr *StateError
+	var timeoutErr *TimeoutError
+	var lockedErr *StateLockedError
+	var conflictErr *StateConflictError
+	var downgradeErr *StateDowngradeError
+	var integrityErr *StateIntegrityError
+	var interruptedErr *InterruptedError
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &interruptedErr):
+		if sig, ok := interruptedErr.Signal.(syscall.Signal); ok {
+			return exitCodeSignal + int(sig)
+		}
+		return exitCodeSignal
+	case errors.As(err, &timeoutErr):
+		return exitCodeTimeout
+	case errors.As(err, &inputErr):
+		return exitCodeInput
+	case errors.As(err, &toolErr):
+		return exitCodeTool
+	case errors.As(err, &stateErr),
+		errors.As(err, &lockedErr),
+		errors.As(err, &conflictErr),
+		errors.As(err, &downgradeErr),
+		errors.As(err, &integrityErr):
+		return exitCodeState
+	}
+
+	return exitCodeError
+}
+
+// recoverError - return a panic in a command as its error
+//
+// Deferred by every command as a last resort. Helpers return their errors, so
+// a panic with an error still gets an exit code, but one raised in another
+// goroutine is not recovered here. Runtime errors and panics with other values
+// are bugs, and keep panicking.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		*err = panicError(r)
+	}
+}
+
+// recoverStateError - like recoverError, for commands that only work on the remote state
+//
+// Errors without a more specific type are reported as a StateError.
+func recoverStateError(err *error) {
+	if r := recover(); r != nil {
+		*err = panicError(r)
+	}
+	if *err != nil && getExitCode(*err) == exitCodeError {
+		*err = &StateError{Err: *err}
+	}
+}
+
+// panicError - the error a panic was raised with, or panic again if it is a bug
+func panicError(r interface{}) error {
+	if isDebug() {
+		Logger.Debugf("Recovered: %v", r)
+		os.Stderr.Write(debug.Stack())
+	}
+
+	if _, ok := r.(runtime.Error); ok {
+		panic(r)
+	}
+
+	err, ok := r.(error)
+	if !ok {
+		panic(r)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecoverError(t *testing.T) {
+	inputErr := NewInputError("bad input")
+
+	tests := []struct {
+		name  string
+		panic func()
+		// want is the returned error, or nil if the panic is expected to continue
+		want error
+	}{
+		{
+			name:  "error",
+			panic: func() { panic(inputErr) },
+			want:  inputErr,
+		},
+		{
+			name: "runtime error",
+			panic: func() {
+				var m map[string]int
+				m["key"] = 1
+			},
+		},
+		{
+			name:  "not an error",
+			panic: func() { panic("bug") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var recovered interface{}
+			var err error
+
+			func() {
+				defer func() {
+					recovered = recover()
+				}()
+				func() {
+					defer recoverError(&err)
+					tt.panic()
+				}()
+			}()
+
+			if tt.want != nil {
+				if recovered != nil {
+					t.Fatalf("recoverError panicked with %v", recovered)
+				}
+				if !errors.Is(err, tt.want) {
+					t.Errorf("err = %v, want %v", err, tt.want)
+				}
+				return
+			}
+
+			if recovered == nil {
+				t.Errorf("recoverError returned %v, want it to keep panicking", err)
+			}
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -15,52 +14,64 @@ import (
 var getCmd = &cobra.Command{
 	Use:   "get <name> <path>",
 	Short: "Get a file from the cluster state",
-	Args:  cobra.MinimumNArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
+	Args:  clusterNameArgs(cobra.MinimumNArgs(2)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
 		name := args[0]
 		requestedPath := args[1]
 		localStateDir := path.Join(os.TempDir(), name)
 		pathOnly, _ := cmd.Flags().GetBool("path")
-		stateBucketName := strings.ReplaceAll(name, ".", "-") + "-state"
 
 		pwd, err := os.Getwd()
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		if !rootCmd.PersistentFlags().Changed("input") {
-			inputs = getInitialInputs(localStateDir)
+			if inputs, err = getInitialInputs(localStateDir); err != nil {
+				return err
+			}
 		}
 
 		assetWriter := NewAssetWriter(pwd, localStateDir, assets)
 		inputProcessor := NewInputProcessor(assetWriter)
 
-		assetWriter.Digest("tf_vars/*")
+		if err := assetWriter.Digest("tf_vars/*"); err != nil {
+			return err
+		}
 
-		inputIds := inputProcessor.Digest(inputs)
+		inputIds, err := inputProcessor.Digest(inputs)
+		if err != nil {
+			return err
+		}
 
-		setAwsEnv(localStateDir, inputIds)
+		if err := setAwsEnv(localStateDir, inputIds); err != nil {
+			return err
+		}
 
 		var result string
 
-		useRemoteState(name, stateBucketName, true, false, func() {
-			var err error
+		err = useRemoteState(name, RemoteStateOptions{Read: true}, func() error {
 			if pathOnly {
+				var err error
 				result, err = filepath.Abs(requestedPath)
-				if err != nil {
-					panic(err)
-				}
-			} else {
-				var content []byte
-				content, err = ioutil.ReadFile(requestedPath)
-				if err != nil {
-					panic(err)
-				}
-				result = string(content)
+				return err
+			}
+
+			content, err := ioutil.ReadFile(requestedPath)
+			if err != nil {
+				return err
 			}
+			result = string(content)
+			return nil
 		})
+		if err != nil {
+			return err
+		}
 
 		fmt.Print(result)
+		return nil
 	},
 }
 
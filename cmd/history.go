@@ -0,0 +1,326 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Remote state object metadata keys, as returned by S3
+const (
+	remoteStateMetadataVersion      = "Klarista-Version"
+	remoteStateMetadataUser         = "Klarista-User"
+	remoteStateMetadataCommand      = "Klarista-Command"
+	remoteStateMetadataRestoredFrom = "Klarista-Restored-From"
+)
+
+// getRemoteStateMetadata - metadata of a state object whose content has the given layout version
+//
+// The layout version is what lets older klaristas refuse to overwrite the
+// object, so every write must record it.
+func getRemoteStateMetadata(stateVersion int) map[string]string {
+	return map[string]string{
+		remoteStateMetadataVersion:      Version,
+		remoteStateMetadataStateVersion: strconv.Itoa(stateVersion),
+		remoteStateMetadataUser:         getCurrentUsername() + "@" + getCurrentHostname(),
+		remoteStateMetadataCommand:      currentCommand,
+	}
+}
+
+// findRemoteStateVersion - look up the remote state version with the given ID
+func findRemoteStateVersion(backend StateBackend, versionID string) (*StateObject, error) {
+	versions, err := backend.Versions(remoteStateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range versions {
+		if v.VersionID == versionID {
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("State version %s does not exist at %s", versionID, backend.Location(remoteStateKey))
+}
+
+// diffStateDigests - describe files that were added, removed or modified between two tarballs
+func diffStateDigests(from, to map[string]string) []string {
+	paths := map[string]bool{}
+	for p := range from {
+		paths[p] = true
+	}
+	for p := range to {
+		paths[p] = true
+	}
+
+	var sorted []string
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+	for _, p := range sorted {
+		a, inFrom := from[p]
+		b, inTo := to[p]
+		switch {
+		case !inFrom:
+			lines = append(lines, "+ "+p)
+		case !inTo:
+			lines = append(lines, "- "+p)
+		case a != b:
+			lines = append(lines, "~ "+p)
+		}
+	}
+
+	return lines
+}
+
+// stateHistoryCmd represents the state history command
+var stateHistoryCmd = &cobra.Command{
+	Use:   "history <name>",
+	Short: "List stored versions of the remote klarista state",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		backend, err := getStateBackend(name)
+		if err != nil {
+			return err
+		}
+
+		versions, err := backend.Versions(remoteStateKey)
+		if err != nil {
+			return err
+		}
+
+		if len(versions) == 0 {
+			Logger.Warnf("No state found at %s", backend.Location(remoteStateKey))
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tTIME\tSIZE\tKLARISTA\tUSER\t")
+		for _, v := range versions {
+			versionID := v.VersionID
+			if v.IsLatest {
+				versionID += " (current)"
+			}
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%s\t%s\t\n",
+				versionID,
+				v.LastModified.Local().Format(time.RFC3339),
+				formatByteSize(v.Size),
+				valueOrDash(v.Metadata[remoteStateMetadataVersion]),
+				valueOrDash(v.Metadata[remoteStateMetadataUser]),
+			)
+		}
+		w.Flush()
+		return nil
+	},
+}
+
+// stateDiffCmd represents the state diff command
+var stateDiffCmd = &cobra.Command{
+	Use:   "diff <name> <version> [version]",
+	Short: "Show which files changed between two versions of the remote klarista state",
+	Long:  "Show which files changed between two versions of the remote klarista state. If the second version is omitted, the current version is used.",
+	Args:  clusterNameArgs(cobra.RangeArgs(2, 3)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		backend, err := getStateBackend(name)
+		if err != nil {
+			return err
+		}
+
+		var versions []*RemoteStateVersion
+		for _, id := range args[1:] {
+			version, err := findRemoteStateVersion(backend, id)
+			if err != nil {
+				return err
+			}
+			versions = append(versions, version.Version())
+		}
+
+		if len(versions) == 1 {
+			current, err := statRemoteState(backend)
+			if err != nil {
+				return err
+			}
+			if !current.Exists {
+				return NewStateError("No state found at %s", backend.Location(remoteStateKey))
+			}
+			versions = append(versions, current)
+		}
+
+		var digests []map[string]string
+
+		err = useTempDir(func(tmpdir string) error {
+			for i, version := range versions {
+				fp := path.Join(tmpdir, fmt.Sprintf("%d.%s", i, remoteStateKey))
+				if err := downloadRemoteStateVersion(backend, version, fp); err != nil {
+					return fmt.Errorf("Failed to download file, %v", err)
+				}
+				digest, err := digestTarFile(fp)
+				if err != nil {
+					return err
+				}
+				digests = append(digests, digest)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		lines := diffStateDigests(digests[0], digests[1])
+		if len(lines) == 0 {
+			Logger.Infof("No differences between %s and %s", versions[0], versions[1])
+			return nil
+		}
+
+		fmt.Println(strings.Join(lines, "\n"))
+		return nil
+	},
+}
+
+// stateRollbackCmd represents the state rollback command
+var stateRollbackCmd = &cobra.Command{
+	Use:   "rollback <name> <version>",
+	Short: "Restore an earlier version of the remote klarista state",
+	Long:  "Restore an earlier version of the remote klarista state by copying it to a new current version. Later versions are kept in the history.",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(2)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		versionID := args[1]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		yes, _ := cmd.Flags().GetBool("yes")
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		backend, err := getStateBackend(name)
+		if err != nil {
+			return err
+		}
+
+		version, err := findRemoteStateVersion(backend, versionID)
+		if err != nil {
+			return err
+		}
+
+		if version.IsLatest {
+			Logger.Infof("Version %s is already the current state", versionID)
+			return nil
+		}
+
+		if !yes && !confirm(fmt.Sprintf(`Restore state version %s for cluster "%s"?`, versionID, name)) {
+			Logger.Info("Rollback cancelled")
+			return nil
+		}
+
+		lock := NewStateLock(lockTTL)
+		if err = acquireStateLock(backend, name, lock); err != nil {
+			return err
+		}
+		defer func() {
+			if err := releaseStateLock(backend, lock); err != nil {
+				Logger.Errorf("Failed to release state lock, %v", err)
+			}
+		}()
+
+		if err := checkStateDowngrade(backend); err != nil {
+			return err
+		}
+
+		err = useTempDir(func(tmpdir string) error {
+			fp := path.Join(tmpdir, remoteStateKey)
+			if err := downloadRemoteStateVersion(backend, version.Version(), fp); err != nil {
+				return fmt.Errorf("Failed to download file, %v", err)
+			}
+
+			if _, err := checkStateArchive(fp); err != nil {
+				return err
+			}
+
+			// The restored version keeps its own layout, which may be older than this klarista's
+			stateVersion, err := readArchiveStateVersion(fp)
+			if err != nil {
+				return err
+			}
+			metadata := getRemoteStateMetadata(stateVersion)
+			metadata[remoteStateMetadataRestoredFrom] = versionID
+
+			file, err := os.Open(fp)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			if _, err = backend.Write(remoteStateKey, file, metadata); err != nil {
+				return fmt.Errorf("Failed to upload file, %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		Logger.Infof(`Restored state version %s for cluster "%s"`, versionID, name)
+		return nil
+	},
+}
+
+func formatByteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func init() {
+	stateCmd.AddCommand(stateHistoryCmd)
+	stateCmd.AddCommand(stateDiffCmd)
+	stateCmd.AddCommand(stateRollbackCmd)
+	stateRollbackCmd.Flags().Bool("yes", false, "Skip confirmation")
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStateRollbackRecordsRestoredLayout(t *testing.T) {
+	const name = "dev2-test.bfmiv.com"
+
+	t.Setenv("TMPDIR", t.TempDir())
+	stateDir := t.TempDir()
+
+	previousBackend, previousDir := stateBackendName, stateLocalDir
+	stateBackendName, stateLocalDir = stateBackendLocal, stateDir
+	t.Cleanup(func() {
+		stateBackendName, stateLocalDir = previousBackend, previousDir
+	})
+
+	backend, err := getStateBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A version written before the first layout migration, followed by the current layout
+	var restored *StateObject
+	for _, stateVersion := range []int{0, getStateLayoutVersion()} {
+		dir := t.TempDir()
+		if err := os.MkdirAll(path.Join(dir, "tf"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if stateVersion > 0 {
+			if err := writeStateMigrationRecord(dir, &StateMigrationRecord{StateVersion: stateVersion}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var buf bytes.Buffer
+		if _, err := writeStateArchive(&buf, dir, stateCompressionGzip); err != nil {
+			t.Fatal(err)
+		}
+		written, err := backend.Write(remoteStateKey, &buf, getRemoteStateMetadata(stateVersion))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored == nil {
+			restored = written
+		}
+	}
+
+	err = executeTestCommand(
+		t,
+		"state", "rollback", name, restored.VersionID, "--yes",
+		"--state-backend", stateBackendLocal,
+		"--state-local-dir", stateDir,
+	)
+	if err != nil {
+		t.Fatalf("state rollback = %v", err)
+	}
+
+	current, err := backend.Stat(remoteStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := current.Metadata[remoteStateMetadataRestoredFrom]; got != restored.VersionID {
+		t.Errorf("%s = %q, want %q", remoteStateMetadataRestoredFrom, got, restored.VersionID)
+	}
+	if got, want := current.Metadata[remoteStateMetadataStateVersion], "0"; got != want {
+		t.Errorf("%s = %q, want %q", remoteStateMetadataStateVersion, got, want)
+	}
+}
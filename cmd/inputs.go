@@ -0,0 +1,645 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/tryfunc"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	"github.com/zclconf/go-cty/cty/gocty"
+)
+
+// ClusterInputs - the inputs of a cluster, as declared in assets/tf/variables.tf
+type ClusterInputs struct {
+	AwsAuthorizedAccounts         []string                   `cty:"aws_authorized_accounts"`
+	AwsProfile                    string                     `cty:"aws_profile"`
+	AwsRegion                     string                     `cty:"aws_region"`
+	AwsProviderDefaultTags        cty.Value                  `cty:"aws_provider_default_tags"`
+	ClusterName                   string                     `cty:"cluster_name"`
+	StateBucketName               string                     `cty:"state_bucket_name"`
+	K8sVersion                    string                     `cty:"k8s_version"`
+	ClusterImage                  string                     `cty:"cluster_image"`
+	K8sAPIIngressSources          []string                   `cty:"k8s_api_ingress_sources"`
+	ClusterMasterSize             string                     `cty:"cluster_master_size"`
+	ClusterMastersPerSubnet       int                        `cty:"cluster_masters_per_subnet"`
+	ClusterNodeInstanceGroups     []*InstanceGroupInput      `cty:"cluster_node_instance_groups"`
+	ClusterVpcCidr                string                     `cty:"cluster_vpc_cidr"`
+	ClusterAdditionalPoliciesNode []*IAMPolicyStatementInput `cty:"cluster_additional_policies_node"`
+	EncryptionKeyArn              string                     `cty:"encryption_key_arn"`
+	PublicSubnets                 []*SubnetInput             `cty:"public_subnets"`
+	PrivateSubnets                []*SubnetInput             `cty:"private_subnets"`
+	NatElasticIPIds               []string                   `cty:"nat_elastic_ip_ids"`
+}
+
+// InstanceGroupInput - a node instance group, rendered into a kops InstanceGroup
+type InstanceGroupInput struct {
+	// AvailabilityZones defaults to every availability zone of the cluster
+	AvailabilityZones []string                    `cty:"availability_zones"`
+	Metadata          *InstanceGroupMetadataInput `cty:"metadata"`
+	Spec              *InstanceGroupSpecInput     `cty:"spec"`
+}
+
+type InstanceGroupMetadataInput struct {
+	Name string `cty:"name"`
+}
+
+type InstanceGroupSpecInput struct {
+	MachineType string         `cty:"machineType"`
+	MinSize     int            `cty:"minSize"`
+	MaxSize     int            `cty:"maxSize"`
+	NodeLabels  cty.Value      `cty:"nodeLabels"`
+	Taints      []*TaintInput  `cty:"taints"`
+	Volumes     []*VolumeInput `cty:"volumes"`
+}
+
+type TaintInput struct {
+	Effect string `cty:"effect"`
+	Key    string `cty:"key"`
+	Value  string `cty:"value"`
+}
+
+type VolumeInput struct {
+	Device    string `cty:"device"`
+	Size      int    `cty:"size"`
+	Type      string `cty:"type"`
+	Encrypted bool   `cty:"encrypted"`
+	Key       string `cty:"key"`
+}
+
+type IAMPolicyStatementInput struct {
+	Effect   string   `cty:"Effect"`
+	Action   []string `cty:"Action"`
+	Resource []string `cty:"Resource"`
+}
+
+type SubnetInput struct {
+	CidrBlock        string `cty:"cidr_block"`
+	AvailabilityZone string `cty:"availability_zone"`
+}
+
+// InputValue - the value of a variable, and where it was set
+type InputValue struct {
+	Value cty.Value
+	Input *ResolvedInput
+}
+
+// InputViolation - a problem with the cluster inputs
+type InputViolation struct {
+	// Path is the variable or the value within it, e.g. private_subnets[0].cidr_block
+	Path    string
+	Message string
+	// Range is where the value was set, if it was set in a file
+	Range hcl.Range
+	// Warning is set for problems that terraform and kops accept, but are likely mistakes
+	Warning bool
+}
+
+func (v *InputViolation) String() string {
+	if v.Range.Filename == "" {
+		return fmt.Sprintf("%s: %s", v.Path, v.Message)
+	}
+	// YAML inputs are parsed as the JSON they convert to, so their positions don't match the file
+	if getInputFormat(v.Range.Filename) == inputFormatYAML {
+		return fmt.Sprintf("%s: %s: %s", getDisplayPath(v.Range.Filename), v.Path, v.Message)
+	}
+	return fmt.Sprintf(
+		"%s:%d,%d: %s: %s",
+		getDisplayPath(v.Range.Filename),
+		v.Range.Start.Line,
+		v.Range.Start.Column,
+		v.Path,
+		v.Message,
+	)
+}
+
+// inputFunctions - the functions available to the validation rules of variables
+var inputFunctions = map[string]function.Function{
+	"can":      tryfunc.CanFunc,
+	"contains": stdlib.ContainsFunc,
+	"length":   lengthFunc,
+	"lower":    stdlib.LowerFunc,
+	"regex":    stdlib.RegexFunc,
+	"try":      tryfunc.TryFunc,
+	"upper":    stdlib.UpperFunc,
+}
+
+// lengthFunc - the length of a string or a collection, like the terraform function
+var lengthFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "value", Type: cty.DynamicPseudoType},
+	},
+	Type: function.StaticReturnType(cty.Number),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		if args[0].Type() == cty.String {
+			return stdlib.Strlen(args[0])
+		}
+		return stdlib.Length(args[0])
+	},
+})
+
+// inputChecker - collects the violations of the cluster inputs
+type inputChecker struct {
+	values     map[string]*InputValue
+	violations []*InputViolation
+}
+
+// report - a value that terraform or kops would reject
+func (c *inputChecker) report(path cty.Path, format string, args ...interface{}) {
+	c.add(path, false, fmt.Sprintf(format, args...))
+}
+
+// warn - a value that terraform and kops accept, but is likely a mistake
+func (c *inputChecker) warn(path cty.Path, format string, args ...interface{}) {
+	c.add(path, true, fmt.Sprintf(format, args...))
+}
+
+func (c *inputChecker) add(path cty.Path, warning bool, message string) {
+	violation := &InputViolation{
+		Path:    formatInputPath(path),
+		Message: message,
+		Warning: warning,
+	}
+
+	if step, ok := path[0].(cty.GetAttrStep); ok {
+		if value := c.values[step.Name]; value != nil {
+			violation.Range = value.Input.RangeAt(path[1:])
+		}
+	}
+
+	c.violations = append(c.violations, violation)
+}
+
+// readClusterInputs - resolve the values of the cluster variables like terraform, and check them
+func readClusterInputs(clusterName string, files []string) (*ClusterInputs, []*InputViolation, error) {
+	variables, err := getClusterVariables()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &inputChecker{values: map[string]*InputValue{}}
+
+	resolved, violations, err := resolveClusterInputs(clusterName, files)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.violations = violations
+
+	for name, input := range resolved.Attrs {
+		c.values[name] = &InputValue{Value: input.Value(), Input: input}
+	}
+
+	// Convert the values to the declared types
+	converted := map[string]cty.Value{}
+	for _, variable := range variables {
+		converted[variable.Name] = c.convert(variable)
+	}
+
+	inputs := &ClusterInputs{}
+	c.decode(inputs, converted)
+
+	c.checkValidationRules(variables, converted)
+	c.checkNetwork(inputs, converted)
+	c.checkInstanceGroups(inputs, converted)
+
+	return inputs, c.violations, nil
+}
+
+// convert - the value of a variable converted to its declared type, or null if it can't be
+func (c *inputChecker) convert(variable *ClusterVariable) cty.Value {
+	path := cty.GetAttrPath(variable.Name)
+
+	value := c.values[variable.Name]
+	if value == nil {
+		c.report(path, "No value for required variable")
+		return cty.NullVal(variable.Type)
+	}
+
+	if !value.Value.IsWhollyKnown() {
+		return cty.NullVal(variable.Type)
+	}
+
+	if value.Value.IsNull() {
+		if variable.Default == nil {
+			c.report(path, "Must be set, the variable has no default")
+		}
+		return cty.NullVal(variable.Type)
+	}
+
+	val := value.Value
+	if variable.TypeDefaults != nil {
+		val = variable.TypeDefaults.Apply(val)
+	}
+
+	val, err := convert.Convert(val, variable.Type)
+	if err != nil {
+		var pathErr cty.PathError
+		if errors.As(err, &pathErr) {
+			c.report(append(path, pathErr.Path...), "Invalid value for type %s, %s", formatInputType(variable.Type, pathErr.Path), pathErr.Error())
+		} else {
+			c.report(path, "Invalid value for type %s, %v", formatInputType(variable.Type, nil), err)
+		}
+		return cty.NullVal(variable.Type)
+	}
+
+	return val
+}
+
+// decode - copy the converted values into the typed model
+func (c *inputChecker) decode(inputs *ClusterInputs, converted map[string]cty.Value) {
+	target := reflect.ValueOf(inputs).Elem()
+
+	for i := 0; i < target.NumField(); i++ {
+		name := target.Type().Field(i).Tag.Get("cty")
+		value, ok := converted[name]
+		if !ok || value.IsNull() {
+			continue
+		}
+
+		// Null attributes of objects are read as zero values
+		value, _ = cty.Transform(value, func(_ cty.Path, v cty.Value) (cty.Value, error) {
+			if !v.IsNull() {
+				return v, nil
+			}
+			switch v.Type() {
+			case cty.String:
+				return cty.StringVal(""), nil
+			case cty.Number:
+				return cty.Zero, nil
+			case cty.Bool:
+				return cty.False, nil
+			}
+			return v, nil
+		})
+
+		if err := gocty.FromCtyValue(value, target.Field(i).Addr().Interface()); err != nil {
+			var pathErr cty.PathError
+			if errors.As(err, &pathErr) {
+				c.report(append(cty.GetAttrPath(name), pathErr.Path...), "%s", pathErr.Error())
+			} else {
+				c.report(cty.GetAttrPath(name), "%v", err)
+			}
+		}
+	}
+}
+
+// checkValidationRules - evaluate the validation blocks of the variables
+//
+// Rules that can't be evaluated, e.g. because they call a function klarista
+// doesn't implement, are left to terraform.
+func (c *inputChecker) checkValidationRules(variables []*ClusterVariable, converted map[string]cty.Value) {
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{"var": cty.ObjectVal(converted)},
+		Functions: inputFunctions,
+	}
+
+	for _, variable := range variables {
+		if converted[variable.Name].IsNull() {
+			continue
+		}
+
+		for _, validation := range variable.Validations {
+			result, diags := validation.Condition.Value(ctx)
+			if diags.HasErrors() {
+				Logger.Debugf(`Skipping a validation rule of variable "%s", %s`, variable.Name, formatDiagnostics(diags))
+				continue
+			}
+
+			result, err := convert.Convert(result, cty.Bool)
+			if err != nil || !result.IsKnown() || result.IsNull() {
+				continue
+			}
+
+			if result.False() {
+				c.report(cty.GetAttrPath(variable.Name), "%s", validation.ErrorMessage)
+			}
+		}
+	}
+}
+
+// subnetKinds - the subnet variables, in the order terraform lists their availability zones
+var subnetKinds = []string{"private_subnets", "public_subnets"}
+
+// checkNetwork - check the VPC, the subnets and the availability zones they imply
+//
+// The cluster terraform creates one availability zone per distinct zone of
+// the subnets, and the kops templates pair the private and public subnets of
+// each zone by index, with one master instance group per zone.
+func (c *inputChecker) checkNetwork(inputs *ClusterInputs, converted map[string]cty.Value) {
+	var vpc *net.IPNet
+	if inputs.ClusterVpcCidr != "" {
+		vpc = c.parseCIDR(cty.GetAttrPath("cluster_vpc_cidr"), inputs.ClusterVpcCidr)
+	}
+
+	azPattern := regexp.MustCompile("^" + regexp.QuoteMeta(inputs.AwsRegion) + "[a-z]$")
+
+	type subnet struct {
+		path cty.Path
+		cidr *net.IPNet
+	}
+	var subnets []*subnet
+
+	subnetsByKind := map[string][]*SubnetInput{
+		"private_subnets": inputs.PrivateSubnets,
+		"public_subnets":  inputs.PublicSubnets,
+	}
+
+	for _, kind := range subnetKinds {
+		zones := map[string]int{}
+
+		for i, s := range subnetsByKind[kind] {
+			path := cty.GetAttrPath(kind).IndexInt(i)
+
+			if cidr := c.parseCIDR(path.GetAttr("cidr_block"), s.CidrBlock); cidr != nil {
+				if vpc != nil && !containsCIDR(vpc, cidr) {
+					c.report(path.GetAttr("cidr_block"), "%s is outside cluster_vpc_cidr %s", s.CidrBlock, vpc)
+				}
+
+				for _, other := range subnets {
+					if containsCIDR(other.cidr, cidr) || containsCIDR(cidr, other.cidr) {
+						c.report(path.GetAttr("cidr_block"), "%s overlaps %s (%s)", s.CidrBlock, formatInputPath(other.path), other.cidr)
+					}
+				}
+				subnets = append(subnets, &subnet{path: path.GetAttr("cidr_block"), cidr: cidr})
+			}
+
+			if inputs.AwsRegion != "" && !azPattern.MatchString(s.AvailabilityZone) {
+				c.report(path.GetAttr("availability_zone"), `"%s" is not an availability zone of aws_region "%s"`, s.AvailabilityZone, inputs.AwsRegion)
+			}
+
+			if j, ok := zones[s.AvailabilityZone]; ok {
+				c.report(path.GetAttr("availability_zone"), `"%s" already has a subnet, %s[%d]. Each availability zone has one private and one public subnet`, s.AvailabilityZone, kind, j)
+			} else {
+				zones[s.AvailabilityZone] = i
+			}
+		}
+	}
+
+	// kops pairs the subnets of each availability zone by index
+	for i, public := range inputs.PublicSubnets {
+		if i < len(inputs.PrivateSubnets) && public.AvailabilityZone != inputs.PrivateSubnets[i].AvailabilityZone {
+			c.report(
+				cty.GetAttrPath("public_subnets").IndexInt(i).GetAttr("availability_zone"),
+				`"%s" doesn't match private_subnets[%d] ("%s"). Subnets are paired by index, so list the availability zones in the same order`,
+				public.AvailabilityZone,
+				i,
+				inputs.PrivateSubnets[i].AvailabilityZone,
+			)
+		}
+	}
+	if len(inputs.PublicSubnets) != len(inputs.PrivateSubnets) && !converted["public_subnets"].IsNull() && !converted["private_subnets"].IsNull() {
+		c.report(
+			cty.GetAttrPath("public_subnets"),
+			"Has %d subnets, but private_subnets has %d. Each availability zone has one private and one public subnet",
+			len(inputs.PublicSubnets),
+			len(inputs.PrivateSubnets),
+		)
+	}
+
+	// Each availability zone runs a master and an etcd member
+	zones := getClusterAvailabilityZones(inputs)
+	if len(zones)%2 == 0 && len(zones) > 0 {
+		c.warn(
+			cty.GetAttrPath("private_subnets"),
+			"The cluster runs a master and an etcd member in each of its %d availability zones (%s). etcd tolerates no more failures with %d members than with %d, so an odd number of availability zones is recommended",
+			len(zones),
+			strings.Join(zones, ", "),
+			len(zones),
+			len(zones)-1,
+		)
+	}
+
+	if !converted["cluster_masters_per_subnet"].IsNull() && inputs.ClusterMastersPerSubnet < 1 {
+		c.report(cty.GetAttrPath("cluster_masters_per_subnet"), "Must be at least 1, found %d", inputs.ClusterMastersPerSubnet)
+	}
+}
+
+// checkInstanceGroups - check the node instance groups
+func (c *inputChecker) checkInstanceGroups(inputs *ClusterInputs, converted map[string]cty.Value) {
+	zones := map[string]bool{}
+	for _, s := range inputs.PrivateSubnets {
+		zones[s.AvailabilityZone] = true
+	}
+
+	names := map[string]int{}
+
+	for i, group := range inputs.ClusterNodeInstanceGroups {
+		path := cty.GetAttrPath("cluster_node_instance_groups").IndexInt(i)
+
+		if group.Metadata != nil {
+			if j, ok := names[group.Metadata.Name]; ok {
+				c.report(path.GetAttr("metadata").GetAttr("name"), `"%s" is already used by cluster_node_instance_groups[%d]`, group.Metadata.Name, j)
+			} else {
+				names[group.Metadata.Name] = i
+			}
+		}
+
+		if group.Spec != nil {
+			if group.Spec.MinSize < 0 {
+				c.report(path.GetAttr("spec").GetAttr("minSize"), "Must be at least 0, found %d", group.Spec.MinSize)
+			}
+			if group.Spec.MinSize > group.Spec.MaxSize {
+				c.report(path.GetAttr("spec").GetAttr("minSize"), "%d is greater than maxSize %d", group.Spec.MinSize, group.Spec.MaxSize)
+			}
+		}
+
+		for j, zone := range group.AvailabilityZones {
+			if len(zones) > 0 && !zones[zone] {
+				c.report(path.GetAttr("availability_zones").IndexInt(j), `"%s" has no private subnet. Nodes run in the private subnets of the cluster`, zone)
+			}
+		}
+	}
+}
+
+func (c *inputChecker) parseCIDR(path cty.Path, value string) *net.IPNet {
+	ip, cidr, err := net.ParseCIDR(value)
+	if err != nil || ip.To4() == nil {
+		c.report(path, `"%s" is not an IPv4 CIDR block`, value)
+		return nil
+	}
+	if !ip.Equal(cidr.IP) {
+		c.report(path, `"%s" has host bits set, did you mean %s?`, value, cidr)
+		return nil
+	}
+	return cidr
+}
+
+// containsCIDR - whether inner is within outer
+func containsCIDR(outer, inner *net.IPNet) bool {
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// getClusterAvailabilityZones - the availability zones of the cluster, in the order the cluster terraform lists them
+func getClusterAvailabilityZones(inputs *ClusterInputs) []string {
+	var zones []string
+	seen := map[string]bool{}
+	for _, s := range append(append([]*SubnetInput{}, inputs.PrivateSubnets...), inputs.PublicSubnets...) {
+		if !seen[s.AvailabilityZone] {
+			seen[s.AvailabilityZone] = true
+			zones = append(zones, s.AvailabilityZone)
+		}
+	}
+	return zones
+}
+
+// getExprRangeAt - the range of the value at path within expr, or of the closest enclosing value
+func getExprRangeAt(expr hcl.Expression, path cty.Path) hcl.Range {
+	for _, step := range path {
+		next := getExprStep(expr, step)
+		if next == nil {
+			break
+		}
+		expr = next
+	}
+	return expr.Range()
+}
+
+func getExprStep(expr hcl.Expression, step cty.PathStep) hcl.Expression {
+	switch s := step.(type) {
+	case cty.IndexStep:
+		if s.Key.Type() == cty.Number {
+			exprs, diags := hcl.ExprList(expr)
+			if diags.HasErrors() {
+				return nil
+			}
+			i, accuracy := s.Key.AsBigFloat().Int64()
+			if accuracy == 0 && i >= 0 && int(i) < len(exprs) {
+				return exprs[i]
+			}
+			return nil
+		}
+		if s.Key.Type() == cty.String {
+			return getObjectItem(expr, s.Key.AsString())
+		}
+	case cty.GetAttrStep:
+		return getObjectItem(expr, s.Name)
+	}
+	return nil
+}
+
+func getObjectItem(expr hcl.Expression, key string) hcl.Expression {
+	items, diags := hcl.ExprMap(expr)
+	if diags.HasErrors() {
+		return nil
+	}
+	for _, item := range items {
+		k, diags := item.Key.Value(nil)
+		if !diags.HasErrors() && k.Type() == cty.String && k.IsKnown() && !k.IsNull() && k.AsString() == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// formatInputPath - describe a path within the cluster variables, e.g. private_subnets[0].cidr_block
+func formatInputPath(path cty.Path) string {
+	var b strings.Builder
+	for _, step := range path {
+		switch s := step.(type) {
+		case cty.GetAttrStep:
+			if b.Len() > 0 {
+				b.WriteString(".")
+			}
+			b.WriteString(s.Name)
+		case cty.IndexStep:
+			switch s.Key.Type() {
+			case cty.Number:
+				i, _ := s.Key.AsBigFloat().Int64()
+				fmt.Fprintf(&b, "[%d]", i)
+			case cty.String:
+				fmt.Fprintf(&b, "[%q]", s.Key.AsString())
+			}
+		}
+	}
+	return b.String()
+}
+
+// formatInputType - describe the type at path within ty
+func formatInputType(ty cty.Type, path cty.Path) string {
+	for _, step := range path {
+		switch s := step.(type) {
+		case cty.GetAttrStep:
+			if ty.IsObjectType() && ty.HasAttribute(s.Name) {
+				ty = ty.AttributeType(s.Name)
+				continue
+			}
+		case cty.IndexStep:
+			if ty.IsCollectionType() {
+				ty = ty.ElementType()
+				continue
+			}
+		}
+		break
+	}
+	return ty.FriendlyName()
+}
+
+func formatDiagnostics(diags hcl.Diagnostics) string {
+	var messages []string
+	for _, diag := range diags {
+		if diag.Severity != hcl.DiagError {
+			continue
+		}
+		if diag.Detail != "" {
+			messages = append(messages, diag.Summary+"; "+diag.Detail)
+		} else {
+			messages = append(messages, diag.Summary)
+		}
+	}
+	return strings.Join(messages, ", ")
+}
+
+// getDisplayPath - fp relative to the working directory, if it is within it
+func getDisplayPath(fp string) string {
+	pwd, err := os.Getwd()
+	if err != nil || !filepath.IsAbs(fp) {
+		return fp
+	}
+	if rel, err := filepath.Rel(pwd, fp); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return fp
+}
+
+// validateClusterInputs - log every violation of the cluster inputs, and fail if there are any
+func validateClusterInputs(clusterName string, files []string) (*ClusterInputs, error) {
+	inputs, violations, err := readClusterInputs(clusterName, files)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkInputViolations(violations, fmt.Sprintf(`the inputs of cluster "%s"`, clusterName)); err != nil {
+		return nil, err
+	}
+	return inputs, nil
+}
+
+// checkInputViolations - log every violation, and fail if there are any besides warnings
+func checkInputViolations(violations []*InputViolation, subject string) error {
+	problems := 0
+	for _, violation := range violations {
+		if violation.Warning {
+			Logger.Warn(violation)
+			continue
+		}
+		Logger.Error(violation)
+		problems++
+	}
+
+	if problems == 1 {
+		return NewInputError("Found 1 problem with %s", subject)
+	}
+	if problems > 1 {
+		return NewInputError("Found %d problems with %s", problems, subject)
+	}
+	return nil
+}
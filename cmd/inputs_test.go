@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// getTestSubnetsHCL - a subnet variable, with subnet i's cidr_block on line 3+4i and its availability_zone on line 4+4i
+func getTestSubnetsHCL(kind string, subnets ...[2]string) string {
+	lines := []string{kind + " = ["}
+	for _, s := range subnets {
+		lines = append(
+			lines,
+			"  {",
+			fmt.Sprintf("    cidr_block        = %q", s[0]),
+			fmt.Sprintf("    availability_zone = %q", s[1]),
+			"  },",
+		)
+	}
+	return strings.Join(append(lines, "]"), "\n") + "\n"
+}
+
+// testInputSettings - the settings of a test cluster, read before the input under test
+const testInputSettings = `aws_profile      = "dev"
+aws_region       = "us-east-1"
+cluster_vpc_cidr = "172.70.0.0/24"
+`
+
+// getTestInput - hcl, followed by the subnets of three availability zones unless hcl sets them
+func getTestInput(hcl string) string {
+	defaults := map[string][][2]string{
+		"private_subnets": {{"172.70.0.0/27", "us-east-1a"}, {"172.70.0.32/27", "us-east-1b"}, {"172.70.0.64/27", "us-east-1c"}},
+		"public_subnets":  {{"172.70.0.96/27", "us-east-1a"}, {"172.70.0.128/27", "us-east-1b"}, {"172.70.0.160/27", "us-east-1c"}},
+	}
+
+	input := hcl
+	if input != "" && !strings.HasSuffix(input, "\n") {
+		input += "\n"
+	}
+	for _, kind := range subnetKinds {
+		if !strings.Contains("\n"+hcl, "\n"+kind+" = [") {
+			input += getTestSubnetsHCL(kind, defaults[kind]...)
+		}
+	}
+	return input
+}
+
+func TestReadClusterInputs(t *testing.T) {
+	type violation struct {
+		path string
+		// file is the base name of the file the value was set in
+		file    string
+		line    int
+		message string
+		warning bool
+	}
+
+	tests := []struct {
+		name string
+		// input is the start of the input file, see getTestInput
+		input string
+		want  *violation
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:  "null without a default",
+			input: `aws_region = null`,
+			want:  &violation{path: "aws_region", file: "input.tfvars", line: 1, message: "Must be set, the variable has no default"},
+		},
+		{
+			name:  "invalid type",
+			input: "\n" + `cluster_masters_per_subnet = "many"`,
+			want:  &violation{path: "cluster_masters_per_subnet", file: "input.tfvars", line: 2, message: "Invalid value for type number"},
+		},
+		{
+			name: "invalid type within a value",
+			input: strings.Join([]string{
+				"cluster_node_instance_groups = [",
+				"  {",
+				`    metadata = { name = "nodes" }`,
+				"    spec = {",
+				`      machineType = "t3.large"`,
+				`      minSize     = "lots"`,
+				"      maxSize     = 3",
+				"    }",
+				"  }",
+				"]",
+			}, "\n"),
+			want: &violation{path: "cluster_node_instance_groups[0].spec.minSize", file: "input.tfvars", line: 6, message: "a number is required"},
+		},
+		{
+			name:  "validation rule",
+			input: `private_subnets = []`,
+			want:  &violation{path: "private_subnets", file: "input.tfvars", line: 1, message: "You must define at least one private subnet."},
+		},
+		{
+			name:  "not a CIDR block",
+			input: `cluster_vpc_cidr = "172.70.0.0"`,
+			want:  &violation{path: "cluster_vpc_cidr", file: "input.tfvars", line: 1, message: `"172.70.0.0" is not an IPv4 CIDR block`},
+		},
+		{
+			name:  "host bits set",
+			input: `cluster_vpc_cidr = "172.70.0.1/24"`,
+			want:  &violation{path: "cluster_vpc_cidr", file: "input.tfvars", line: 1, message: "did you mean 172.70.0.0/24?"},
+		},
+		{
+			name:  "subnet outside the VPC",
+			input: `cluster_vpc_cidr = "172.70.0.0/25"`,
+			want:  &violation{path: "public_subnets[1].cidr_block", file: "input.tfvars", line: 22, message: "172.70.0.128/27 is outside cluster_vpc_cidr 172.70.0.0/25"},
+		},
+		{
+			name: "overlapping subnets",
+			input: getTestSubnetsHCL(
+				"private_subnets",
+				[2]string{"172.70.0.0/27", "us-east-1a"},
+				[2]string{"172.70.0.0/28", "us-east-1b"},
+				[2]string{"172.70.0.64/27", "us-east-1c"},
+			),
+			want: &violation{path: "private_subnets[1].cidr_block", file: "input.tfvars", line: 7, message: "172.70.0.0/28 overlaps private_subnets[0].cidr_block (172.70.0.0/27)"},
+		},
+		{
+			name: "availability zone of another region",
+			input: getTestSubnetsHCL(
+				"private_subnets",
+				[2]string{"172.70.0.0/27", "us-east-1a"},
+				[2]string{"172.70.0.32/27", "us-east-1b"},
+				[2]string{"172.70.0.64/27", "us-west-2c"},
+			),
+			want: &violation{path: "private_subnets[2].availability_zone", file: "input.tfvars", line: 12, message: `"us-west-2c" is not an availability zone of aws_region "us-east-1"`},
+		},
+		{
+			name: "two subnets in an availability zone",
+			input: getTestSubnetsHCL(
+				"public_subnets",
+				[2]string{"172.70.0.96/27", "us-east-1a"},
+				[2]string{"172.70.0.128/27", "us-east-1b"},
+				[2]string{"172.70.0.160/27", "us-east-1a"},
+			),
+			want: &violation{path: "public_subnets[2].availability_zone", file: "input.tfvars", line: 12, message: `"us-east-1a" already has a subnet, public_subnets[0]`},
+		},
+		{
+			name: "subnets in a different order",
+			input: getTestSubnetsHCL(
+				"public_subnets",
+				[2]string{"172.70.0.96/27", "us-east-1b"},
+				[2]string{"172.70.0.128/27", "us-east-1a"},
+				[2]string{"172.70.0.160/27", "us-east-1c"},
+			),
+			want: &violation{path: "public_subnets[0].availability_zone", file: "input.tfvars", line: 4, message: `"us-east-1b" doesn't match private_subnets[0] ("us-east-1a")`},
+		},
+		{
+			name: "fewer public than private subnets",
+			input: getTestSubnetsHCL(
+				"public_subnets",
+				[2]string{"172.70.0.96/27", "us-east-1a"},
+				[2]string{"172.70.0.128/27", "us-east-1b"},
+			),
+			want: &violation{path: "public_subnets", file: "input.tfvars", line: 1, message: "Has 2 subnets, but private_subnets has 3"},
+		},
+		{
+			name: "even number of availability zones",
+			input: getTestSubnetsHCL(
+				"private_subnets",
+				[2]string{"172.70.0.0/27", "us-east-1a"},
+				[2]string{"172.70.0.32/27", "us-east-1b"},
+			) + getTestSubnetsHCL(
+				"public_subnets",
+				[2]string{"172.70.0.96/27", "us-east-1a"},
+				[2]string{"172.70.0.128/27", "us-east-1b"},
+			),
+			want: &violation{path: "private_subnets", file: "input.tfvars", line: 1, message: "2 availability zones (us-east-1a, us-east-1b)", warning: true},
+		},
+		{
+			name:  "no masters",
+			input: `cluster_masters_per_subnet = 0`,
+			want:  &violation{path: "cluster_masters_per_subnet", file: "input.tfvars", line: 1, message: "Must be at least 1, found 0"},
+		},
+		{
+			name: "duplicate instance group name",
+			input: strings.Join([]string{
+				"cluster_node_instance_groups = [",
+				`  { metadata = { name = "nodes" }, spec = { machineType = "t3.large", minSize = 1, maxSize = 3 } },`,
+				`  { metadata = { name = "nodes" }, spec = { machineType = "t3.xlarge", minSize = 1, maxSize = 3 } },`,
+				"]",
+			}, "\n"),
+			want: &violation{path: "cluster_node_instance_groups[1].metadata.name", file: "input.tfvars", line: 3, message: `"nodes" is already used by cluster_node_instance_groups[0]`},
+		},
+		{
+			name: "negative minSize",
+			input: strings.Join([]string{
+				"cluster_node_instance_groups = [",
+				`  { metadata = { name = "nodes" }, spec = { machineType = "t3.large", minSize = -1, maxSize = 3 } },`,
+				"]",
+			}, "\n"),
+			want: &violation{path: "cluster_node_instance_groups[0].spec.minSize", file: "input.tfvars", line: 2, message: "Must be at least 0, found -1"},
+		},
+		{
+			name: "minSize greater than maxSize",
+			input: strings.Join([]string{
+				"cluster_node_instance_groups = [",
+				`  { metadata = { name = "nodes" }, spec = { machineType = "t3.large", minSize = 4, maxSize = 3 } },`,
+				"]",
+			}, "\n"),
+			want: &violation{path: "cluster_node_instance_groups[0].spec.minSize", file: "input.tfvars", line: 2, message: "4 is greater than maxSize 3"},
+		},
+		{
+			name: "instance group in an availability zone without a subnet",
+			input: strings.Join([]string{
+				"cluster_node_instance_groups = [",
+				"  {",
+				`    availability_zones = ["us-east-1a", "us-east-1d"]`,
+				`    metadata           = { name = "nodes" }`,
+				`    spec               = { machineType = "t3.large", minSize = 1, maxSize = 3 }`,
+				"  },",
+				"]",
+			}, "\n"),
+			want: &violation{path: "cluster_node_instance_groups[0].availability_zones[1]", file: "input.tfvars", line: 3, message: `"us-east-1d" has no private subnet`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := []string{path.Join(dir, "settings.tfvars"), path.Join(dir, "input.tfvars")}
+			for i, content := range []string{testInputSettings, getTestInput(tt.input)} {
+				if err := ioutil.WriteFile(files[i], []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, violations, err := readClusterInputs("dev2-test.bfmiv.com", files)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == nil {
+				for _, v := range violations {
+					t.Errorf("unexpected violation %s", v)
+				}
+				return
+			}
+
+			for _, v := range violations {
+				if v.Path == tt.want.path &&
+					filepath.Base(v.Range.Filename) == tt.want.file &&
+					v.Range.Start.Line == tt.want.line &&
+					strings.Contains(v.Message, tt.want.message) &&
+					v.Warning == tt.want.warning {
+					return
+				}
+			}
+
+			var got []string
+			for _, v := range violations {
+				got = append(got, fmt.Sprintf("%s (warning: %t)", v, v.Warning))
+			}
+			t.Errorf(
+				"want a violation %s:%d: %s: %s (warning: %t), got\n%s",
+				tt.want.file,
+				tt.want.line,
+				tt.want.path,
+				tt.want.message,
+				tt.want.warning,
+				strings.Join(got, "\n"),
+			)
+		})
+	}
+}
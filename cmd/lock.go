@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/thanhpk/randstr"
+)
+
+// remoteStateLockKey - object key of the remote state lock
+const remoteStateLockKey = "klarista.state.lock"
+
+// runID - unique identifier of this klarista invocation
+var runID = randstr.Hex(8)
+
+// currentCommand - the klarista command line being executed
+var currentCommand string
+
+// lockTTL - duration after which an abandoned lock may be taken over
+var lockTTL time.Duration
+
+// StateLock - remote state lock
+type StateLock struct {
+	Owner     string    `json:"owner"`
+	Hostname  string    `json:"hostname"`
+	RunID     string    `json:"run_id"`
+	Command   string    `json:"command"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func NewStateLock(ttl time.Duration) *StateLock {
+	now := time.Now().UTC()
+	return &StateLock{
+		Owner:     getCurrentUsername(),
+		Hostname:  getCurrentHostname(),
+		RunID:     runID,
+		Command:   currentCommand,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+func (l *StateLock) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// IsOwnedByCurrentUser - whether the lock was taken by this user on this host
+func (l *StateLock) IsOwnedByCurrentUser() bool {
+	return l.Owner == getCurrentUsername() && l.Hostname == getCurrentHostname()
+}
+
+func (l *StateLock) String() string {
+	return fmt.Sprintf(
+		"%s@%s (run %s, command %q) since %s, expires %s",
+		l.Owner,
+		l.Hostname,
+		l.RunID,
+		l.Command,
+		l.CreatedAt.Local().Format(time.RFC1123),
+		l.ExpiresAt.Local().Format(time.RFC1123),
+	)
+}
+
+// StateLockedError - returned when the remote state is locked by another run
+type StateLockedError struct {
+	Cluster string
+	Holder  *StateLock
+}
+
+func (e *StateLockedError) Error() string {
+	return fmt.Sprintf(
+		`State for cluster "%s" is locked by %s. If you are sure that run is no longer active, use "klarista state unlock %s"`,
+		e.Cluster,
+		e.Holder,
+		e.Cluster,
+	)
+}
+
+func getCurrentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
+
+func getCurrentHostname() string {
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "unknown"
+}
+
+// acquireStateLock - take the remote state lock for this run
+func acquireStateLock(backend StateBackend, clusterName string, lock *StateLock) error {
+	if err := backend.Lock(lock); err != nil {
+		if lockedErr, ok := err.(*StateLockedError); ok {
+			lockedErr.Cluster = clusterName
+		}
+		return err
+	}
+
+	Logger.Debugf("Acquired state lock %s", backend.Location(remoteStateLockKey))
+
+	return nil
+}
+
+// releaseStateLock - release the remote state lock if it is still held by this run
+func releaseStateLock(backend StateBackend, lock *StateLock) error {
+	if err := backend.Unlock(lock, false); err != nil {
+		return err
+	}
+
+	Logger.Debugf("Released state lock %s", backend.Location(remoteStateLockKey))
+
+	return nil
+}
+
+// keepStateLockAlive - periodically extend the lock expiry until stop is called
+func keepStateLockAlive(backend StateBackend, lock *StateLock, ttl time.Duration) (stop func()) {
+	done := make(chan bool)
+	stopped := make(chan bool)
+	ticker := time.NewTicker(ttl / 3)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				ticker.Stop()
+				close(stopped)
+				return
+			case <-ticker.C:
+				lock.ExpiresAt = time.Now().UTC().Add(ttl)
+				if err := backend.Lock(lock); err != nil {
+					Logger.Warnf("Failed to refresh state lock, %v", err)
+				} else {
+					Logger.Debugf("Refreshed state lock until %s", lock.ExpiresAt)
+				}
+			}
+		}
+	}()
+
+	// Wait for an in-flight refresh so it cannot recreate a released lock
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// stateMigrationsPath - record of the migrations applied to the state, relative to the state dir
+const stateMigrationsPath = ".klarista/migrations.json"
+
+// remoteStateMetadataStateVersion - object metadata recording the state layout version
+const remoteStateMetadataStateVersion = "Klarista-State-Version"
+
+// allowDowngrade - write state last written by a newer klarista
+var allowDowngrade bool
+
+// StateMigration - one change to the layout of the state directory
+//
+// Migrations are applied in order, once per state, when the state is read.
+// They must be idempotent, since read-only commands apply them without
+// writing the result back.
+type StateMigration struct {
+	ID          string
+	Description string
+	Migrate     func(dir string) error
+}
+
+// stateMigrations - every migration, oldest first. Only ever append to this list
+var stateMigrations = []*StateMigration{
+	{
+		ID:          "0001-remove-kubernetes-tf-json",
+		Description: "Remove tf/kubernetes.tf.json generated by kops < 1.23 once tf/kubernetes.tf exists",
+		Migrate: func(dir string) error {
+			hclFile := path.Join(dir, "tf", "kubernetes.tf")
+			jsonFile := path.Join(dir, "tf", "kubernetes.tf.json")
+			if fileExists(hclFile) && fileExists(jsonFile) {
+				return os.Remove(jsonFile)
+			}
+			return nil
+		},
+	},
+}
+
+// getStateLayoutVersion - version of the state layout written by this build
+func getStateLayoutVersion() int {
+	return len(stateMigrations)
+}
+
+// StateMigrationRecord - migrations applied to a state directory
+type StateMigrationRecord struct {
+	StateVersion int                            `json:"state_version"`
+	Applied      []*StateAppliedMigrationRecord `json:"applied"`
+}
+
+// StateAppliedMigrationRecord - one migration applied to a state directory
+type StateAppliedMigrationRecord struct {
+	ID              string    `json:"id"`
+	AppliedAt       time.Time `json:"applied_at"`
+	KlaristaVersion string    `json:"klarista_version"`
+}
+
+// IsApplied - whether the migration with the given ID was applied
+func (r *StateMigrationRecord) IsApplied(id string) bool {
+	for _, m := range r.Applied {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// readStateMigrationRecord - read the migrations applied to the state in dir
+func readStateMigrationRecord(dir string) (*StateMigrationRecord, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, stateMigrationsPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &StateMigrationRecord{}, nil
+		}
+		return nil, err
+	}
+
+	var record StateMigrationRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, %v", stateMigrationsPath, err)
+	}
+
+	return &record, nil
+}
+
+// readArchiveStateVersion - the state layout version recorded in the state archive at fp
+func readArchiveStateVersion(fp string) (int, error) {
+	record := &StateMigrationRecord{}
+
+	err := useStateArchive(fp, func(hdr *tar.Header, r io.Reader) error {
+		if path.Clean(hdr.Name) != stateMigrationsPath {
+			return nil
+		}
+		if err := json.NewDecoder(r).Decode(record); err != nil {
+			return fmt.Errorf("Failed to parse %s, %v", stateMigrationsPath, err)
+		}
+		return nil
+	})
+
+	return record.StateVersion, err
+}
+
+func writeStateMigrationRecord(dir string, record *StateMigrationRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fp := path.Join(dir, stateMigrationsPath)
+	if err = os.MkdirAll(path.Dir(fp), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fp, data, 0644)
+}
+
+// migrateState - apply pending migrations to the state in dir
+func migrateState(dir string) error {
+	record, err := readStateMigrationRecord(dir)
+	if err != nil {
+		return err
+	}
+
+	if record.StateVersion > getStateLayoutVersion() {
+		Logger.Warnf(
+			"The state layout version is %d, but this klarista only supports up to %d. Upgrade klarista to avoid losing changes",
+			record.StateVersion,
+			getStateLayoutVersion(),
+		)
+		return nil
+	}
+
+	applied := false
+	for _, migration := range stateMigrations {
+		if record.IsApplied(migration.ID) {
+			continue
+		}
+
+		Logger.Infof("Applying state migration %s: %s", migration.ID, migration.Description)
+
+		if err = migration.Migrate(dir); err != nil {
+			return fmt.Errorf("State migration %s failed, %v", migration.ID, err)
+		}
+
+		record.Applied = append(record.Applied, &StateAppliedMigrationRecord{
+			ID:              migration.ID,
+			AppliedAt:       time.Now().UTC(),
+			KlaristaVersion: Version,
+		})
+		applied = true
+	}
+
+	if !applied && record.StateVersion == getStateLayoutVersion() {
+		return nil
+	}
+
+	record.StateVersion = getStateLayoutVersion()
+
+	return writeStateMigrationRecord(dir, record)
+}
+
+// StateDowngradeError - returned when writing state last written by a newer klarista
+type StateDowngradeError struct {
+	Location string
+	Reason   string
+}
+
+func (e *StateDowngradeError) Error() string {
+	return fmt.Sprintf(
+		"Refusing to write state to %s: %s. Upgrade klarista, or use --allow-downgrade to write it anyway",
+		e.Location,
+		e.Reason,
+	)
+}
+
+var semverPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)`)
+
+// compareVersions - compare two klarista versions, if both are release versions
+func compareVersions(a, b string) (int, bool) {
+	ma := semverPattern.FindStringSubmatch(a)
+	mb := semverPattern.FindStringSubmatch(b)
+	if ma == nil || mb == nil {
+		return 0, false
+	}
+
+	for i := 1; i <= 3; i++ {
+		na, _ := strconv.Atoi(ma[i])
+		nb, _ := strconv.Atoi(mb[i])
+		if na != nb {
+			if na < nb {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+
+	return 0, true
+}
+
+// checkStateDowngrade - refuse to overwrite state last written by a newer klarista
+func checkStateDowngrade(backend StateBackend) error {
+	if allowDowngrade {
+		return nil
+	}
+
+	object, err := backend.Stat(remoteStateKey)
+	if err != nil {
+		if err == ErrStateNotFound {
+			return nil
+		}
+		return err
+	}
+
+	location := backend.Location(remoteStateKey)
+
+	if v := object.Metadata[remoteStateMetadataStateVersion]; v != "" {
+		stateVersion, err := strconv.Atoi(v)
+		if err == nil && stateVersion > getStateLayoutVersion() {
+			return &StateDowngradeError{
+				Location: location,
+				Reason:   fmt.Sprintf("its layout version is %d, but this klarista only supports up to %d", stateVersion, getStateLayoutVersion()),
+			}
+		}
+	}
+
+	writer := object.Metadata[remoteStateMetadataVersion]
+	if cmp, ok := compareVersions(writer, Version); ok && cmp > 0 {
+		return &StateDowngradeError{
+			Location: location,
+			Reason:   fmt.Sprintf("it was last written by klarista %s, which is newer than %s", writer, Version),
+		}
+	}
+
+	return nil
+}
+
+// checkLocalStateDowngrade - refuse to write a local state dir migrated by a newer klarista
+func checkLocalStateDowngrade(dir, location string) error {
+	if allowDowngrade {
+		return nil
+	}
+
+	record, err := readStateMigrationRecord(dir)
+	if err != nil {
+		return err
+	}
+
+	if record.StateVersion > getStateLayoutVersion() {
+		return &StateDowngradeError{
+			Location: location,
+			Reason:   fmt.Sprintf("the local state layout version is %d, but this klarista only supports up to %d", record.StateVersion, getStateLayoutVersion()),
+		}
+	}
+
+	return nil
+}
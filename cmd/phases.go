@@ -0,0 +1,567 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/packr/v2"
+	"github.com/gobwas/glob"
+	"github.com/spf13/pflag"
+)
+
+// statePhasesPath - record of the completed phases, relative to the state dir
+const statePhasesPath = ".klarista/phases.json"
+
+// resumeCommand - the command line that resumes a failed command, if it can be resumed
+var resumeCommand string
+
+// Phase - one named step of a command that can be rerun on its own
+//
+// A phase runs when it didn't complete before, when the checksum of its
+// inputs changed since it completed, or when a phase it runs after ran.
+type Phase struct {
+	Name        string
+	Description string
+	Inputs      PhaseInputs
+	// After lists earlier phases that the phase runs again after
+	After []string
+	// Outputs lists the state dir files that the phase writes for later phases
+	Outputs []string
+}
+
+// PhaseInputs - what a phase depends on
+type PhaseInputs struct {
+	// Vars - the input tfvars
+	Vars bool
+	// Assets - globs of the embedded assets that the phase renders or applies
+	Assets []string
+	// Files - state dir files written by earlier phases
+	Files []string
+	// Flags - command flags that change what the phase does
+	Flags []string
+}
+
+// PhaseOptions - select the phases to run
+type PhaseOptions struct {
+	// Always runs every phase, even if its inputs didn't change
+	Always bool
+	// Resume skips the phases that already completed with the same inputs.
+	// This is the default, unless phases are selected with another option
+	Resume bool
+	// From runs the named phase and every phase after it
+	From string
+	// Only runs the named phases
+	Only []string
+	// Plan is the ID of the saved plan being applied, which runs every phase
+	Plan string
+}
+
+// PhaseSources - where the inputs of phases are read from
+type PhaseSources struct {
+	// Dir is the local state dir
+	Dir string
+	// Vars is the checksum of the input tfvars
+	Vars   string
+	Assets *packr.Box
+	Flags  *pflag.FlagSet
+}
+
+// PhaseRecord - phases completed in a state directory, in order
+type PhaseRecord struct {
+	Completed []*CompletedPhaseRecord `json:"completed"`
+	// Values are found by one phase and used by later phases
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// CompletedPhaseRecord - one completed phase
+type CompletedPhaseRecord struct {
+	Name      string `json:"name"`
+	InputHash string `json:"input_hash"`
+	// Inputs maps each input of the phase to its checksum, or to its value for flags
+	Inputs          map[string]string `json:"inputs,omitempty"`
+	CompletedAt     time.Time         `json:"completed_at"`
+	KlaristaVersion string            `json:"klarista_version"`
+}
+
+// Get - the record of the completed phase with the given name, or nil
+func (r *PhaseRecord) Get(name string) *CompletedPhaseRecord {
+	for _, p := range r.Completed {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// PhaseRunner - run the selected phases of a command, and record the phases that complete
+//
+// The record is kept in the local state dir, so it is written to the remote
+// state with the rest of the state.
+type PhaseRunner struct {
+	dir     string
+	phases  []*Phase
+	opts    PhaseOptions
+	sources PhaseSources
+	// ran holds the phases run by this command
+	ran map[string]bool
+}
+
+func NewPhaseRunner(phases []*Phase, opts PhaseOptions, sources PhaseSources) (*PhaseRunner, error) {
+	r := &PhaseRunner{
+		dir:     sources.Dir,
+		phases:  phases,
+		opts:    opts,
+		sources: sources,
+		ran:     map[string]bool{},
+	}
+
+	selected := 0
+	if opts.Always {
+		selected++
+	}
+	if opts.Resume {
+		selected++
+	}
+	if opts.From != "" {
+		selected++
+	}
+	if len(opts.Only) > 0 {
+		selected++
+	}
+	if selected > 1 {
+		return nil, NewInputError("--always, --resume, --from-phase and --only-phase can't be used together")
+	}
+
+	for _, name := range append([]string{opts.From}, opts.Only...) {
+		if name != "" && r.index(name) == -1 {
+			return nil, NewInputError(
+				`Unknown phase "%s". Expected one of [%s]`,
+				name,
+				strings.Join(getPhaseNames(phases), ", "),
+			)
+		}
+	}
+
+	return r, nil
+}
+
+// getPhaseNames - the names of phases, in order
+func getPhaseNames(phases []*Phase) []string {
+	var names []string
+	for _, p := range phases {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func (r *PhaseRunner) index(name string) int {
+	for i, p := range r.phases {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Explicit - whether phases were selected with --from-phase or --only-phase
+func (r *PhaseRunner) Explicit() bool {
+	return r.opts.From != "" || len(r.opts.Only) > 0
+}
+
+// Run - call cb if the named phase has to run, and record that it completed
+func (r *PhaseRunner) Run(name string, cb func() error) error {
+	i := r.index(name)
+	if i == -1 {
+		return fmt.Errorf(`Unknown phase "%s"`, name)
+	}
+	phase := r.phases[i]
+
+	// The inputs are read before the phase runs, since it may change them
+	inputs, err := r.digest(phase)
+	if err != nil {
+		return err
+	}
+	record, err := r.read()
+	if err != nil {
+		return err
+	}
+	run, reason := r.decide(phase, record.Get(phase.Name), inputs)
+
+	if !run {
+		if reason != "" {
+			Logger.Infof(`Skipping phase "%s", %s`, phase.Name, reason)
+		}
+		return nil
+	}
+
+	Logger.Infof(`Running phase "%s" (%s): %s`, phase.Name, reason, phase.Description)
+
+	// The phases that run after this one have to run again, even if this one fails
+	dependents := r.dependents(phase)
+	err = r.update(func(record *PhaseRecord) {
+		var completed []*CompletedPhaseRecord
+		for _, p := range record.Completed {
+			if p.Name != phase.Name && !dependents[p.Name] {
+				completed = append(completed, p)
+			}
+		}
+		record.Completed = completed
+	})
+	if err != nil {
+		return err
+	}
+
+	completed := false
+	defer func() {
+		// A saved plan can't be resumed, since the remote state changed
+		if !completed && !isDryRun() && r.opts.Plan == "" {
+			resumeCommand = getResumeCommand()
+		}
+	}()
+
+	if err := cb(); err != nil {
+		return err
+	}
+	completed = true
+
+	r.ran[phase.Name] = true
+
+	return r.update(func(record *PhaseRecord) {
+		record.Completed = append(record.Completed, &CompletedPhaseRecord{
+			Name:            phase.Name,
+			InputHash:       hashPhaseInputs(inputs),
+			Inputs:          inputs,
+			CompletedAt:     time.Now().UTC(),
+			KlaristaVersion: Version,
+		})
+	})
+}
+
+// decide - whether phase has to run, and why
+func (r *PhaseRunner) decide(phase *Phase, completed *CompletedPhaseRecord, inputs map[string]string) (bool, string) {
+	switch {
+	case len(r.opts.Only) > 0:
+		for _, name := range r.opts.Only {
+			if name == phase.Name {
+				return true, "selected with --only-phase"
+			}
+		}
+		return false, ""
+	case r.opts.From != "":
+		if r.index(phase.Name) >= r.index(r.opts.From) {
+			return true, "selected with --from-phase"
+		}
+		return false, ""
+	case r.opts.Plan != "":
+		return true, fmt.Sprintf("applying plan %s", r.opts.Plan)
+	case r.opts.Always:
+		return true, "--always"
+	case completed == nil:
+		for _, after := range phase.After {
+			if r.ran[after] {
+				return true, fmt.Sprintf(`runs after "%s"`, after)
+			}
+		}
+		return true, "not completed"
+	case completed.InputHash != hashPhaseInputs(inputs):
+		changed := diffPhaseInputs(completed.Inputs, inputs)
+		if len(changed) == 0 {
+			return true, "inputs changed"
+		}
+		return true, "changed " + strings.Join(changed, ", ")
+	default:
+		return false, fmt.Sprintf("which is up to date since %s", completed.CompletedAt.Local().Format(time.RFC3339))
+	}
+}
+
+// dependents - the phases that run again after phase, directly or through other phases
+func (r *PhaseRunner) dependents(phase *Phase) map[string]bool {
+	dependents := map[string]bool{phase.Name: true}
+	for _, p := range r.phases {
+		for _, after := range p.After {
+			if dependents[after] {
+				dependents[p.Name] = true
+			}
+		}
+	}
+	delete(dependents, phase.Name)
+	return dependents
+}
+
+// digest - map each input of phase to its checksum, or to its value for flags
+func (r *PhaseRunner) digest(phase *Phase) (map[string]string, error) {
+	inputs := map[string]string{}
+
+	if phase.Inputs.Vars {
+		inputs["inputs"] = r.sources.Vars
+	}
+
+	if len(phase.Inputs.Assets) > 0 && r.sources.Assets != nil {
+		var globs []glob.Glob
+		for _, pattern := range phase.Inputs.Assets {
+			globs = append(globs, glob.MustCompile(pattern, '/'))
+		}
+
+		for _, file := range r.sources.Assets.List() {
+			for _, g := range globs {
+				if !g.Match(file) {
+					continue
+				}
+				data, err := r.sources.Assets.Find(file)
+				if err != nil {
+					return nil, err
+				}
+				inputs[file] = fmt.Sprintf("%x", sha256.Sum256(data))
+				break
+			}
+		}
+	}
+
+	for _, file := range phase.Inputs.Files {
+		data, err := ioutil.ReadFile(path.Join(r.dir, file))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			inputs[file] = ""
+			continue
+		}
+		inputs[file] = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+
+	for _, name := range phase.Inputs.Flags {
+		if r.sources.Flags == nil {
+			continue
+		}
+		if flag := r.sources.Flags.Lookup(name); flag != nil {
+			inputs["--"+name] = flag.Value.String()
+		}
+	}
+
+	return inputs, nil
+}
+
+// hashPhaseInputs - the checksum of all the inputs of a phase
+func hashPhaseInputs(inputs map[string]string) string {
+	var keys []string
+	for key := range inputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%s\n", key, inputs[key])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// diffPhaseInputs - the inputs that were added, removed or changed
+func diffPhaseInputs(before, after map[string]string) []string {
+	var changed []string
+	for key, value := range after {
+		if previous, ok := before[key]; !ok || previous != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// PhasePlan - whether a phase will run, and why
+type PhasePlan struct {
+	Phase  *Phase
+	Run    bool
+	Maybe  bool
+	Reason string
+}
+
+// Plan - predict which phases will run, from the current state dir
+//
+// A phase that depends on a file written by an earlier phase may only be
+// known to run once the earlier phase has run.
+func (r *PhaseRunner) Plan() ([]*PhasePlan, error) {
+	record, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []*PhasePlan
+	running := map[string]*PhasePlan{}
+	outputs := map[string]*PhasePlan{}
+
+	for _, phase := range r.phases {
+		inputs, err := r.digest(phase)
+		if err != nil {
+			return nil, err
+		}
+		run, reason := r.decide(phase, record.Get(phase.Name), inputs)
+		plan := &PhasePlan{Phase: phase, Run: run, Reason: reason}
+
+		if !run && r.opts.From == "" && len(r.opts.Only) == 0 {
+			for _, after := range phase.After {
+				p := running[after]
+				if p == nil || (plan.Run && !plan.Maybe) {
+					continue
+				}
+				plan.Run = true
+				plan.Maybe = p.Maybe
+				plan.Reason = fmt.Sprintf(`runs after "%s"`, after)
+				if p.Maybe {
+					plan.Reason = fmt.Sprintf(`if "%s" runs`, after)
+				}
+			}
+		}
+
+		if !plan.Run && r.opts.From == "" && len(r.opts.Only) == 0 {
+			for _, file := range phase.Inputs.Files {
+				if p := outputs[file]; p != nil {
+					plan.Run = true
+					plan.Maybe = true
+					plan.Reason = fmt.Sprintf(`if "%s" changes %s`, p.Phase.Name, file)
+					break
+				}
+			}
+		}
+
+		if plan.Run {
+			running[phase.Name] = plan
+			for _, file := range phase.Outputs {
+				outputs[file] = plan
+			}
+		}
+
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+// printPhasePlan - log which phases will run, and report whether any will
+func printPhasePlan(plans []*PhasePlan) bool {
+	willRun := false
+	for _, plan := range plans {
+		switch {
+		case plan.Maybe:
+			Logger.Infof("  %-16s may run, %s", plan.Phase.Name, plan.Reason)
+		case plan.Run:
+			Logger.Infof("  %-16s will run, %s", plan.Phase.Name, plan.Reason)
+		case plan.Reason != "":
+			Logger.Infof("  %-16s up to date", plan.Phase.Name)
+		default:
+			Logger.Infof("  %-16s not selected", plan.Phase.Name)
+		}
+		willRun = willRun || plan.Run
+	}
+	return willRun
+}
+
+// Get - a value recorded by an earlier phase
+func (r *PhaseRunner) Get(key string) (string, error) {
+	record, err := r.read()
+	if err != nil {
+		return "", err
+	}
+	return record.Values[key], nil
+}
+
+// Set - record a value for later phases, including phases run by a later command
+func (r *PhaseRunner) Set(key, value string) error {
+	return r.update(func(record *PhaseRecord) {
+		if record.Values == nil {
+			record.Values = map[string]string{}
+		}
+		record.Values[key] = value
+	})
+}
+
+func (r *PhaseRunner) read() (*PhaseRecord, error) {
+	record, err := readPhaseRecord(r.dir)
+	if err != nil {
+		return nil, &StateError{Err: err}
+	}
+	return record, nil
+}
+
+func (r *PhaseRunner) update(cb func(*PhaseRecord)) error {
+	if isDryRun() {
+		return nil
+	}
+
+	record, err := r.read()
+	if err != nil {
+		return err
+	}
+	cb(record)
+
+	if err := writePhaseRecord(r.dir, record); err != nil {
+		return &StateError{Err: err}
+	}
+	return nil
+}
+
+// readPhaseRecord - read the phases completed in the state in dir
+func readPhaseRecord(dir string) (*PhaseRecord, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, statePhasesPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &PhaseRecord{}, nil
+		}
+		return nil, err
+	}
+
+	var record PhaseRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, %v", statePhasesPath, err)
+	}
+
+	return &record, nil
+}
+
+func writePhaseRecord(dir string, record *PhaseRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fp := path.Join(dir, statePhasesPath)
+	if err = os.MkdirAll(path.Dir(fp), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fp, data, 0644)
+}
+
+// getResumeCommand - the current command line, with the phase selection flags replaced by --resume
+func getResumeCommand() string {
+	var args []string
+	for i := 0; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		switch {
+		case arg == "--from-phase" || arg == "--only-phase":
+			i++
+			continue
+		case arg == "--always",
+			arg == "--resume",
+			strings.HasPrefix(arg, "--always="),
+			strings.HasPrefix(arg, "--resume="),
+			strings.HasPrefix(arg, "--from-phase="),
+			strings.HasPrefix(arg, "--only-phase="):
+			continue
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(append(args, "--resume"), " ")
+}
@@ -0,0 +1,665 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+)
+
+// Plan report formats
+const (
+	planFormatText = "text"
+	planFormatJSON = "json"
+)
+
+// PlanReport - the changes that create would make to a cluster
+type PlanReport struct {
+	// PlanID is the ID the plan was saved under with --out
+	PlanID     string           `json:"plan_id,omitempty"`
+	Cluster    string           `json:"cluster"`
+	NewCluster bool             `json:"new_cluster"`
+	Terraform  []*TerraformPlan `json:"terraform"`
+	Kops       *KopsPlan        `json:"kops"`
+	Kubernetes *KubernetesPlan  `json:"kubernetes"`
+}
+
+// HasChanges - whether create would change anything
+func (r *PlanReport) HasChanges() bool {
+	for _, tf := range r.Terraform {
+		if len(tf.Changes) > 0 {
+			return true
+		}
+	}
+	return r.NewCluster || len(r.Kops.Changes) > 0 || r.Kubernetes.Changed
+}
+
+// TerraformPlan - the changes terraform would make to the resources of one module
+type TerraformPlan struct {
+	Module  string                     `json:"module"`
+	Changes []*TerraformResourceChange `json:"changes"`
+}
+
+// TerraformResourceChange - the change terraform would make to one resource
+type TerraformResourceChange struct {
+	Address string `json:"address"`
+	// Actions are terraform plan actions, e.g. ["create"] or ["delete", "create"] to replace
+	Actions []string `json:"actions"`
+}
+
+// KopsPlan - the changes the kops templates would make to the kops state
+type KopsPlan struct {
+	// Skipped explains why the templates weren't compared with the kops state
+	Skipped string `json:"skipped,omitempty"`
+	// Rendered is the output of the kops templates
+	Rendered string            `json:"rendered,omitempty"`
+	Changes  []*KopsSpecChange `json:"changes"`
+	// Update is the preview printed by kops update cluster for the current kops state
+	Update string `json:"update,omitempty"`
+}
+
+// KopsSpecChange - a resource added by the kops templates, or a field they change
+type KopsSpecChange struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Field is empty when the resource is added
+	Field   string      `json:"field,omitempty"`
+	Current interface{} `json:"current,omitempty"`
+	Planned interface{} `json:"planned,omitempty"`
+}
+
+// KubernetesPlan - the changes the k8s manifests would make to the cluster
+type KubernetesPlan struct {
+	// Skipped explains why the manifests weren't compared with the cluster
+	Skipped string `json:"skipped,omitempty"`
+	Changed bool   `json:"changed"`
+	// Diff is the output of kubectl diff
+	Diff string `json:"diff,omitempty"`
+}
+
+// planCmd represents the plan command
+var planCmd = &cobra.Command{
+	Use:   "plan <name>",
+	Short: "Show the changes that create would make to a cluster",
+	Long:  "Show the changes that create would make to a cluster, without making them. Runs terraform plan, renders the kops templates and compares them with the kops state, previews kops update cluster, and diffs the k8s manifests against the cluster.",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
+		name := args[0]
+		stateBucketName := getStateBucketName(name)
+
+		format, _ := cmd.Flags().GetString("format")
+		out, _ := cmd.Flags().GetBool("out")
+		if format != planFormatText && format != planFormatJSON {
+			return NewInputError(`Unknown format "%s". Expected one of [%s, %s]`, format, planFormatText, planFormatJSON)
+		}
+
+		if err := useRecordReplay(name); err != nil {
+			return err
+		}
+		defer finishRecordReplay(&err)
+
+		localStateDir, err := getLocalStateDir(name)
+		if err != nil {
+			return err
+		}
+
+		pwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+
+		if err = os.MkdirAll(localStateDir, 0755); err != nil {
+			return err
+		}
+
+		if !rootCmd.PersistentFlags().Changed("input") {
+			if inputs, err = getInitialInputs(localStateDir); err != nil {
+				return err
+			}
+		}
+
+		assetWriter := NewAssetWriter(pwd, localStateDir, assets)
+		inputProcessor := NewInputProcessor(assetWriter)
+
+		if err := assetWriter.Digest("{tf_vars,tf_state}/*"); err != nil {
+			return err
+		}
+		inputIds, err := inputProcessor.Digest(inputs)
+		if err != nil {
+			return err
+		}
+
+		if err := setAwsEnv(localStateDir, inputIds); err != nil {
+			return err
+		}
+
+		report := &PlanReport{
+			Cluster:    name,
+			Kops:       &KopsPlan{},
+			Kubernetes: &KubernetesPlan{},
+		}
+
+		// The remote state version, the rendered templates and the output they were rendered with are saved with --out
+		var state *RemoteStateVersion
+		var manifests []byte
+		var outputChecksum string
+
+		// A fixed directory, so that the commands are the same every time
+		err = useTempDir(name+".plan", func(planDir string) error {
+			err := useRemoteState(name, RemoteStateOptions{Read: true}, func() (err error) {
+				if state, err = readRemoteStateRecord(); err != nil {
+					return &StateError{Err: err}
+				}
+
+				terraformArgs := []interface{}{
+					"-var", "cluster_name=" + name,
+					"-var", "state_bucket_name=" + stateBucketName,
+					getVarFileFlags(inputIds),
+				}
+
+				if isStateBucketManaged() {
+					err := useWorkDir(path.Join(localStateDir, "tf_state"), func() error {
+						plan, err := planTerraform("tf_state", path.Join(planDir, "tf_state.tfplan"), terraformArgs...)
+						if err != nil {
+							return err
+						}
+						report.Terraform = append(report.Terraform, plan)
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+				}
+
+				if err := assetWriter.Digest(); err != nil {
+					return err
+				}
+
+				return useWorkDir("tf", func() error {
+					plan, err := planTerraform("tf", path.Join(planDir, "tf.tfplan"), terraformArgs...)
+					if err != nil {
+						return err
+					}
+					report.Terraform = append(report.Terraform, plan)
+
+					if err = os.Setenv("CLUSTER", name); err != nil {
+						return err
+					}
+
+					if err = setKopsStateStoreEnv(name); err != nil {
+						return err
+					}
+
+					if err = os.Setenv("KOPS_FEATURE_FLAGS", "-TerraformManagedFiles"); err != nil {
+						return err
+					}
+
+					getCluster := NewCommand("kops", "get", "cluster", name)
+					getCluster.Capture = true
+					getCluster.Quiet = true
+					if _, err := runner.Run(getCluster); err != nil {
+						Logger.Debug(err)
+						report.NewCluster = true
+					}
+
+					// The templates are rendered with the output of the last terraform apply
+					if !fileExists("output.json") {
+						reason := "The terraform output is not available until the cluster terraform is applied"
+						report.Kops.Skipped = reason
+						report.Kubernetes.Skipped = reason
+						return nil
+					}
+
+					output, err := ioutil.ReadFile("output.json")
+					if err != nil {
+						return err
+					}
+					outputChecksum = getOutputChecksum(output)
+
+					rendered, err := renderKopsTemplates(
+						name,
+						"kops/*",
+						"--set-string", "cluster_name="+name,
+						"--set-string", "kops_state_store="+os.Getenv("KOPS_STATE_STORE"),
+					)
+					if err != nil {
+						return err
+					}
+					report.Kops.Rendered = string(rendered)
+
+					if report.NewCluster {
+						reason := fmt.Sprintf(`Cluster "%s" doesn't exist yet`, name)
+						report.Kops.Skipped = reason
+						report.Kubernetes.Skipped = reason
+						return nil
+					}
+
+					var currentBytes []byte
+					err = shell("kops", "get", "--name", name, "-o", "yaml", func(output []byte) {
+						currentBytes = output
+					})
+					if err != nil {
+						return err
+					}
+
+					report.Kops.Changes, err = diffKopsResources([]byte(report.Kops.Rendered), currentBytes)
+					if err != nil {
+						return err
+					}
+
+					// Without --yes, kops only previews the changes
+					err = shell(
+						"kops",
+						"update",
+						"cluster",
+						name,
+						"--create-kube-config=false",
+						"--target", "terraform",
+						"--out", path.Join(planDir, "kops"),
+						"--allow-kops-downgrade",
+						func(output []byte) {
+							report.Kops.Update = strings.TrimSpace(string(output))
+						},
+					)
+					if err != nil {
+						return err
+					}
+
+					err = shell(
+						"kops",
+						"export",
+						"kubeconfig",
+						name,
+						"--admin",
+						"--kubeconfig",
+						path.Join(planDir, "kubeconfig.yaml"),
+					)
+					if err != nil {
+						return err
+					}
+					if err = os.Setenv("KUBECONFIG", path.Join(planDir, "kubeconfig.yaml")); err != nil {
+						return err
+					}
+
+					if manifests, err = renderKopsTemplates(name, "k8s/*.yaml"); err != nil {
+						return err
+					}
+					report.Kubernetes.Diff, report.Kubernetes.Changed, err = diffKubernetesManifests(manifests)
+					return err
+				})
+			})
+			if err != nil {
+				return err
+			}
+
+			if !out {
+				return nil
+			}
+
+			plan := NewSavedPlan(name, inputProcessor.Checksum(), state)
+			plan.OutputChecksum = outputChecksum
+			report.PlanID = plan.ID
+
+			artifacts := map[string][]byte{}
+			for _, tf := range report.Terraform {
+				data, err := ioutil.ReadFile(path.Join(planDir, tf.Module+".tfplan"))
+				if err != nil {
+					return err
+				}
+				artifacts[tf.Module+".tfplan"] = data
+			}
+			if report.Kops.Rendered != "" {
+				artifacts[savedPlanKopsFile] = []byte(report.Kops.Rendered)
+			}
+			if manifests != nil {
+				artifacts[savedPlanManifestsFile] = manifests
+			}
+			if artifacts[savedPlanReportFile], err = json.MarshalIndent(report, "", "  "); err != nil {
+				return err
+			}
+
+			backend, err := getStateBackend(name)
+			if err != nil {
+				return err
+			}
+			if err = writeSavedPlan(backend, plan, artifacts); err != nil {
+				return err
+			}
+
+			Logger.Infof(`Saved plan %s to "%s". Run "klarista apply %s --plan %s" to apply it`, plan.ID, backend.Location(getSavedPlanKey(plan.ID)), name, plan.ID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if format == planFormatJSON {
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+
+		printPlanReport(os.Stdout, report)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+	planCmd.Flags().String("format", planFormatText, "Report format. One of text, json")
+	planCmd.Flags().Bool("out", false, "Save the plan to the remote state, to apply it later with apply --plan")
+	planCmd.Flags().StringVar(&recordFile, "record", "", "Record the external commands and their results to a fixture file")
+	planCmd.Flags().StringVar(&replayFile, "replay", "", "Replay the external commands from a fixture file instead of running them")
+}
+
+// planTerraform - plan the terraform module in the current directory, and read the planned changes
+func planTerraform(module, planFile string, args ...interface{}) (*TerraformPlan, error) {
+	if err := shell("terraform", "init", "-upgrade"); err != nil {
+		return nil, err
+	}
+
+	err := shell("terraform", append([]interface{}{"plan", "-input=false", "-compact-warnings", "-out", planFile}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var planBytes []byte
+	err = shell("terraform", "show", "-json", planFile, func(output []byte) {
+		planBytes = output
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var plan struct {
+		ResourceChanges []struct {
+			Address string `json:"address"`
+			Change  struct {
+				Actions []string `json:"actions"`
+			} `json:"change"`
+		} `json:"resource_changes"`
+	}
+	if err := json.Unmarshal(planBytes, &plan); err != nil {
+		return nil, fmt.Errorf("Failed to read the %s terraform plan, %v", module, err)
+	}
+
+	result := &TerraformPlan{Module: module, Changes: []*TerraformResourceChange{}}
+	for _, rc := range plan.ResourceChanges {
+		actions := rc.Change.Actions
+		if len(actions) == 0 || (len(actions) == 1 && (actions[0] == "no-op" || actions[0] == "read")) {
+			continue
+		}
+		result.Changes = append(result.Changes, &TerraformResourceChange{
+			Address: rc.Address,
+			Actions: actions,
+		})
+	}
+
+	return result, nil
+}
+
+// renderKopsTemplates - the output of the kops templates in the state dir matching pattern
+func renderKopsTemplates(name string, pattern string, flags ...string) ([]byte, error) {
+	c, err := newKopsTemplateCommand(name, pattern, flags...)
+	if err != nil {
+		return nil, err
+	}
+	c.Capture = true
+
+	output, err := runner.Run(c)
+	if err != nil {
+		return nil, NewToolError(c, err)
+	}
+	return output, nil
+}
+
+// diffKubernetesManifests - diff manifests against the cluster, and report whether they differ
+func diffKubernetesManifests(manifests []byte) (string, bool, error) {
+	c := NewCommand("kubectl", "diff", "-f", "-")
+	c.Stdin = manifests
+	c.Capture = true
+
+	output, err := runner.Run(c)
+	if err == nil {
+		return "", false, nil
+	}
+
+	// kubectl diff exits with 1 when there are differences
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return strings.TrimRight(string(output), "\n"), true, nil
+	}
+
+	return "", false, NewToolError(c, err)
+}
+
+var yamlDocumentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// parseKopsResources - parse kops resources in YAML, keyed by kind and name, in order
+func parseKopsResources(data []byte) ([]string, map[string]map[string]interface{}, error) {
+	var keys []string
+	resources := map[string]map[string]interface{}{}
+
+	for _, doc := range yamlDocumentSeparator.Split(string(data), -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		var resource map[string]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &resource); err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse kops resource, %v", err)
+		}
+		if resource == nil {
+			continue
+		}
+
+		metadata, _ := resource["metadata"].(map[string]interface{})
+		key := fmt.Sprintf("%v/%v", resource["kind"], metadata["name"])
+		if _, ok := resources[key]; !ok {
+			keys = append(keys, key)
+		}
+		resources[key] = resource
+	}
+
+	return keys, resources, nil
+}
+
+// diffKopsResources - the resources that the rendered templates add, and the spec fields they change
+//
+// Fields that only exist in the kops state, e.g. defaults filled in by kops,
+// aren't reported.
+func diffKopsResources(rendered, current []byte) ([]*KopsSpecChange, error) {
+	keys, planned, err := parseKopsResources(rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	_, existing, err := parseKopsResources(current)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []*KopsSpecChange{}
+	for _, key := range keys {
+		kindName := strings.SplitN(key, "/", 2)
+		resource := existing[key]
+		if resource == nil {
+			changes = append(changes, &KopsSpecChange{Kind: kindName[0], Name: kindName[1]})
+			continue
+		}
+
+		diffValues("spec", planned[key]["spec"], resource["spec"], func(field string, planned, current interface{}) {
+			changes = append(changes, &KopsSpecChange{
+				Kind:    kindName[0],
+				Name:    kindName[1],
+				Field:   field,
+				Current: current,
+				Planned: planned,
+			})
+		})
+	}
+
+	return changes, nil
+}
+
+// diffValues - call cb for every field set in planned with a different value in current
+func diffValues(field string, planned, current interface{}, cb func(string, interface{}, interface{})) {
+	plannedMap, ok := planned.(map[string]interface{})
+	if !ok {
+		if !reflect.DeepEqual(planned, current) {
+			cb(field, planned, current)
+		}
+		return
+	}
+
+	currentMap, _ := current.(map[string]interface{})
+
+	var keys []string
+	for key := range plannedMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		diffValues(field+"."+key, plannedMap[key], currentMap[key], cb)
+	}
+}
+
+// formatTerraformActions - the symbol terraform uses for a change
+func formatTerraformActions(actions []string) string {
+	switch strings.Join(actions, ",") {
+	case "create":
+		return "+"
+	case "delete":
+		return "-"
+	case "update":
+		return "~"
+	case "delete,create":
+		return "-/+"
+	case "create,delete":
+		return "+/-"
+	default:
+		return strings.Join(actions, ",")
+	}
+}
+
+func formatPlanValue(v interface{}) string {
+	if v == nil {
+		return "(unset)"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func indentLines(s, prefix string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// printPlanReport - write the report for people to read
+func printPlanReport(w io.Writer, report *PlanReport) {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "Plan for cluster %s", report.Cluster)
+	if report.NewCluster {
+		fmt.Fprint(&b, " (new cluster)")
+	}
+	fmt.Fprintln(&b)
+	if report.PlanID != "" {
+		fmt.Fprintf(&b, "Saved as plan %s\n", report.PlanID)
+	}
+
+	for _, tf := range report.Terraform {
+		counts := map[string]int{}
+		for _, change := range tf.Changes {
+			counts[formatTerraformActions(change.Actions)]++
+		}
+
+		fmt.Fprintf(&b, "\nterraform %s: ", tf.Module)
+		if len(tf.Changes) == 0 {
+			fmt.Fprintln(&b, "no changes")
+			continue
+		}
+		fmt.Fprintf(
+			&b,
+			"%d to add, %d to change, %d to destroy, %d to replace\n",
+			counts["+"],
+			counts["~"],
+			counts["-"],
+			counts["-/+"]+counts["+/-"],
+		)
+		for _, change := range tf.Changes {
+			fmt.Fprintf(&b, "  %-3s %s\n", formatTerraformActions(change.Actions), change.Address)
+		}
+	}
+
+	fmt.Fprint(&b, "\nkops: ")
+	switch {
+	case report.Kops.Skipped != "":
+		fmt.Fprintf(&b, "not compared. %s\n", report.Kops.Skipped)
+	case len(report.Kops.Changes) == 0:
+		fmt.Fprintln(&b, "no changes to the cluster spec")
+	default:
+		fmt.Fprintf(&b, "%d changes to the cluster spec\n", len(report.Kops.Changes))
+		for _, change := range report.Kops.Changes {
+			if change.Field == "" {
+				fmt.Fprintf(&b, "  +   %s/%s\n", change.Kind, change.Name)
+				continue
+			}
+			fmt.Fprintf(
+				&b,
+				"  ~   %s/%s %s: %s -> %s\n",
+				change.Kind,
+				change.Name,
+				change.Field,
+				formatPlanValue(change.Current),
+				formatPlanValue(change.Planned),
+			)
+		}
+	}
+	if report.Kops.Update != "" {
+		fmt.Fprintln(&b, "\nkops update cluster:")
+		fmt.Fprintln(&b, indentLines(report.Kops.Update, "  "))
+	}
+
+	fmt.Fprint(&b, "\nkubernetes: ")
+	switch {
+	case report.Kubernetes.Skipped != "":
+		fmt.Fprintf(&b, "not compared. %s\n", report.Kubernetes.Skipped)
+	case !report.Kubernetes.Changed:
+		fmt.Fprintln(&b, "no changes")
+	default:
+		fmt.Fprintln(&b, "changes")
+		fmt.Fprintln(&b, indentLines(report.Kubernetes.Diff, "  "))
+	}
+
+	if !report.HasChanges() {
+		fmt.Fprintln(&b, "\nNo changes. The cluster matches the configuration")
+	}
+
+	w.Write(b.Bytes())
+}
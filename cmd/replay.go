@@ -0,0 +1,575 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// replayFixtureVersion - version of the record and replay fixture format
+const replayFixtureVersion = 1
+
+// Placeholders for the machine specific paths in a fixture
+const (
+	replayLocalStateDirPlaceholder = "${KLARISTA_LOCAL_STATE_DIR}"
+	replayPwdPlaceholder           = "${PWD}"
+	replayTmpDirPlaceholder        = "${TMPDIR}"
+)
+
+var (
+	// recordFile - fixture to record external commands to
+	recordFile string
+	// replayFile - fixture to replay external commands from
+	replayFile string
+)
+
+// ReplayFixture - the external commands run by one klarista command
+type ReplayFixture struct {
+	Version         int           `json:"version"`
+	KlaristaVersion string        `json:"klarista_version"`
+	Command         string        `json:"command"`
+	RecordedAt      time.Time     `json:"recorded_at"`
+	Steps           []*ReplayStep `json:"steps"`
+}
+
+// ReplayStep - one external command, or one wait between polls
+type ReplayStep struct {
+	Name    string            `json:"name,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Dir     string            `json:"dir,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Capture bool              `json:"capture,omitempty"`
+	Stdin   string            `json:"stdin,omitempty"`
+	// Stdout is the output of the command, whether or not it was captured
+	Stdout   string `json:"stdout,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	// Error is set when the command couldn't be run at all
+	Error string `json:"error,omitempty"`
+	// Files are the changes the command made to the local state directory
+	Files []*ReplayFile `json:"files,omitempty"`
+	// Sleep is set for waits between polls
+	Sleep string `json:"sleep,omitempty"`
+}
+
+// ReplayFile - a file written or removed by a command, relative to the local state directory
+type ReplayFile struct {
+	Path     string      `json:"path"`
+	Mode     os.FileMode `json:"mode,omitempty"`
+	Content  string      `json:"content,omitempty"`
+	Encoding string      `json:"encoding,omitempty"`
+	Deleted  bool        `json:"deleted,omitempty"`
+}
+
+func (s *ReplayStep) String() string {
+	if s.Sleep != "" {
+		return fmt.Sprintf("wait %s", s.Sleep)
+	}
+	return strings.Join(append([]string{s.Name}, s.Args...), " ")
+}
+
+// ReplayExitError - a recorded command that exited with a non-zero status
+type ReplayExitError struct {
+	Status int
+}
+
+func (e *ReplayExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+func (e *ReplayExitError) ExitCode() int {
+	return e.Status
+}
+
+// ReplayMismatchError - klarista didn't run the next recorded command
+type ReplayMismatchError struct {
+	Step     int
+	Expected string
+	Actual   string
+}
+
+func (e *ReplayMismatchError) Error() string {
+	return fmt.Sprintf("Replay mismatch at step %d:\n  expected: %s\n  actual:   %s", e.Step, e.Expected, e.Actual)
+}
+
+// replayPaths - replaces the machine specific paths of a command with placeholders
+type replayPaths struct {
+	localStateDir string
+	pwd           string
+	placeholders  [][2]string
+}
+
+func newReplayPaths(localStateDir string) (*replayPaths, error) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	placeholders := [][2]string{
+		{localStateDir, replayLocalStateDirPlaceholder},
+		{pwd, replayPwdPlaceholder},
+		{strings.TrimSuffix(os.TempDir(), "/"), replayTmpDirPlaceholder},
+	}
+	// Replace the most specific path first, e.g. when pwd is in $TMPDIR
+	sort.SliceStable(placeholders, func(i, j int) bool {
+		return len(placeholders[i][0]) > len(placeholders[j][0])
+	})
+
+	return &replayPaths{
+		localStateDir: localStateDir,
+		pwd:           pwd,
+		placeholders:  placeholders,
+	}, nil
+}
+
+func (p *replayPaths) normalize(s string) string {
+	for _, ph := range p.placeholders {
+		if ph[0] != "" {
+			s = strings.ReplaceAll(s, ph[0], ph[1])
+		}
+	}
+	return s
+}
+
+// step - describe c as a fixture step, without its results
+func (p *replayPaths) step(c *Command) *ReplayStep {
+	step := &ReplayStep{
+		Name:    c.Name,
+		Dir:     p.normalize(c.Dir),
+		Env:     map[string]string{},
+		Capture: c.Capture,
+		Stdin:   string(c.Stdin),
+	}
+	for _, arg := range c.Args {
+		step.Args = append(step.Args, p.normalize(arg))
+	}
+	for key, value := range c.Env {
+		step.Env[key] = p.normalize(value)
+	}
+	return step
+}
+
+// snapshotStateDir - sha256 of every file in the local state directory, except for terraform caches
+func snapshotStateDir(dir string) (map[string]string, error) {
+	snapshot := map[string]string{}
+
+	if !fileExists(dir) {
+		return snapshot, nil
+	}
+
+	err := filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir() && info.Name() == ".terraform":
+			return filepath.SkipDir
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+
+		snapshot[filepath.ToSlash(rel)] = fmt.Sprintf("%x:%o", sha256.Sum256(data), info.Mode().Perm())
+		return nil
+	})
+
+	return snapshot, err
+}
+
+// diffStateDir - the files that changed in dir since the snapshot was taken
+func diffStateDir(dir string, before map[string]string) ([]*ReplayFile, error) {
+	after, err := snapshotStateDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*ReplayFile
+
+	for rel, digest := range after {
+		if before[rel] == digest {
+			continue
+		}
+
+		fp := path.Join(dir, rel)
+		info, err := os.Stat(fp)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return nil, err
+		}
+
+		file := &ReplayFile{Path: rel, Mode: info.Mode().Perm()}
+		if utf8.Valid(data) {
+			file.Content = string(data)
+		} else {
+			file.Content = base64.StdEncoding.EncodeToString(data)
+			file.Encoding = "base64"
+		}
+		files = append(files, file)
+	}
+
+	for rel := range before {
+		if _, ok := after[rel]; !ok {
+			files = append(files, &ReplayFile{Path: rel, Deleted: true})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files, nil
+}
+
+// applyReplayFiles - make the recorded changes to the local state directory
+func applyReplayFiles(dir string, files []*ReplayFile) error {
+	for _, file := range files {
+		if path.IsAbs(file.Path) || strings.HasPrefix(path.Clean(file.Path), "..") {
+			return fmt.Errorf("Refusing to replay file %s outside of the local state directory", file.Path)
+		}
+
+		fp := path.Join(dir, file.Path)
+
+		if file.Deleted {
+			if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		data := []byte(file.Content)
+		if file.Encoding == "base64" {
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(file.Content); err != nil {
+				return fmt.Errorf("Failed to decode %s, %v", file.Path, err)
+			}
+		}
+
+		mode := file.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+
+		if err := os.MkdirAll(path.Dir(fp), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fp, data, mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(fp, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readReplayFixture - read a fixture written by a RecordingRunner
+func readReplayFixture(fp string) (*ReplayFixture, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture ReplayFixture
+	if err = json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, %v", fp, err)
+	}
+
+	if fixture.Version > replayFixtureVersion {
+		return nil, fmt.Errorf("%s uses fixture format %d, but this klarista only supports up to %d", fp, fixture.Version, replayFixtureVersion)
+	}
+
+	return &fixture, nil
+}
+
+func writeReplayFixture(fp string, fixture *ReplayFixture) error {
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(path.Dir(fp), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fp, append(data, '\n'), 0644)
+}
+
+// RecordingRunner - runs commands and records them, with their results, to a fixture
+type RecordingRunner struct {
+	file    string
+	paths   *replayPaths
+	fixture *ReplayFixture
+}
+
+func NewRecordingRunner(file, localStateDir string) (*RecordingRunner, error) {
+	// Commands change the working directory, so resolve the fixture path now
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := newReplayPaths(localStateDir)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingRunner{
+		file:  file,
+		paths: paths,
+		fixture: &ReplayFixture{
+			Version:         replayFixtureVersion,
+			KlaristaVersion: Version,
+			Command:         paths.normalize(currentCommand),
+			RecordedAt:      time.Now().UTC(),
+		},
+	}, nil
+}
+
+func (r *RecordingRunner) Run(c *Command) ([]byte, error) {
+	before, err := snapshotStateDir(r.paths.localStateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	output, runErr := (&ExecRunner{Output: &stdout}).Run(c)
+
+	step := r.paths.step(c)
+	if c.Capture {
+		step.Stdout = string(output)
+	} else {
+		step.Stdout = stdout.String()
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case runErr == nil:
+	case errors.As(runErr, &exitErr):
+		step.ExitCode = exitErr.ExitCode()
+	default:
+		step.Error = runErr.Error()
+	}
+
+	if step.Files, err = diffStateDir(r.paths.localStateDir, before); err != nil {
+		return nil, err
+	}
+
+	if err := r.record(step); err != nil {
+		return nil, err
+	}
+
+	return output, runErr
+}
+
+func (r *RecordingRunner) Sleep(d time.Duration) error {
+	if err := r.record(&ReplayStep{Sleep: d.String()}); err != nil {
+		return err
+	}
+	return sleep(d)
+}
+
+// record - add a step, and rewrite the fixture so that failed runs are recorded too
+func (r *RecordingRunner) record(step *ReplayStep) error {
+	r.fixture.Steps = append(r.fixture.Steps, step)
+	return writeReplayFixture(r.file, r.fixture)
+}
+
+func (r *RecordingRunner) Finish() error {
+	Logger.Infof("Recorded %d steps to %s", len(r.fixture.Steps), r.file)
+	return nil
+}
+
+// ReplayRunner - serves the results of recorded commands instead of running them
+//
+// Commands must be run in the recorded order, with the same arguments,
+// working directory and environment. Waits between polls return immediately.
+type ReplayRunner struct {
+	paths   *replayPaths
+	fixture *ReplayFixture
+	next    int
+	err     error
+}
+
+func NewReplayRunner(file, localStateDir string) (*ReplayRunner, error) {
+	fixture, err := readReplayFixture(file)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := newReplayPaths(localStateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReplayRunner{
+		paths:   paths,
+		fixture: fixture,
+	}, nil
+}
+
+// match - return the next recorded step if it matches actual
+func (r *ReplayRunner) match(actual *ReplayStep) (*ReplayStep, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if r.next >= len(r.fixture.Steps) {
+		r.err = &ReplayMismatchError{Step: r.next + 1, Expected: "no more steps", Actual: actual.String()}
+		return nil, r.err
+	}
+
+	expected := r.fixture.Steps[r.next]
+	r.next++
+
+	mismatch := func(expected, actual string) error {
+		r.err = &ReplayMismatchError{Step: r.next, Expected: expected, Actual: actual}
+		return r.err
+	}
+
+	switch {
+	case expected.Sleep != actual.Sleep,
+		expected.Name != actual.Name,
+		strings.Join(expected.Args, "\x00") != strings.Join(actual.Args, "\x00"),
+		expected.Capture != actual.Capture:
+		return nil, mismatch(expected.String(), actual.String())
+	case expected.Stdin != actual.Stdin:
+		return nil, mismatch(fmt.Sprintf("%s with stdin %q", expected, expected.Stdin), fmt.Sprintf("%s with stdin %q", actual, actual.Stdin))
+	case expected.Dir != actual.Dir:
+		return nil, mismatch("dir "+expected.Dir, "dir "+actual.Dir)
+	case expected.Sleep == "" && !equalEnv(expected.Env, actual.Env):
+		return nil, mismatch(fmt.Sprintf("env %v", expected.Env), fmt.Sprintf("env %v", actual.Env))
+	}
+
+	return expected, nil
+}
+
+func equalEnv(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if v, ok := b[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ReplayRunner) Run(c *Command) ([]byte, error) {
+	Logger.Debugf("Replay: %s", c)
+
+	step, err := r.match(r.paths.step(c))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = applyReplayFiles(r.paths.localStateDir, step.Files); err != nil {
+		return nil, err
+	}
+
+	var output []byte
+	if c.Capture {
+		output = []byte(step.Stdout)
+	} else {
+		fmt.Fprint(os.Stderr, step.Stdout)
+	}
+
+	switch {
+	case step.Error != "":
+		return output, errors.New(step.Error)
+	case step.ExitCode != 0:
+		return output, &ReplayExitError{Status: step.ExitCode}
+	}
+
+	return output, nil
+}
+
+func (r *ReplayRunner) Sleep(d time.Duration) error {
+	_, err := r.match(&ReplayStep{Sleep: d.String()})
+	return err
+}
+
+// Finish - fail unless every recorded step was replayed
+func (r *ReplayRunner) Finish() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.next < len(r.fixture.Steps) {
+		return &ReplayMismatchError{
+			Step:     r.next + 1,
+			Expected: r.fixture.Steps[r.next].String(),
+			Actual:   "no more steps",
+		}
+	}
+	Logger.Infof("Replayed %d steps", r.next)
+	return nil
+}
+
+// useRecordReplay - record or replay the external commands of a cluster command
+func useRecordReplay(clusterName string) error {
+	if recordFile != "" && replayFile != "" {
+		return NewInputError("Only one of --record and --replay may be set")
+	}
+
+	localStateDir, err := getLocalStateDir(clusterName)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case recordFile != "":
+		r, err := NewRecordingRunner(recordFile, localStateDir)
+		if err != nil {
+			return err
+		}
+		runner = r
+	case replayFile != "":
+		r, err := NewReplayRunner(replayFile, localStateDir)
+		if err != nil {
+			return &InputError{Err: err}
+		}
+		runner = r
+	}
+	return nil
+}
+
+// finishRecordReplay - report the result of recording or replaying
+//
+// Deferred by the commands that support --record and --replay, with their
+// error. A command that failed stops partway, so the rest of the recording is
+// not checked.
+func finishRecordReplay(err *error) {
+	if r := recover(); r != nil {
+		panic(r)
+	}
+	if *err != nil {
+		return
+	}
+	if r, ok := runner.(interface{ Finish() error }); ok {
+		*err = r.Finish()
+	}
+}
@@ -0,0 +1,556 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// Resolved input formats
+const (
+	resolveFormatText = "text"
+	resolveFormatJSON = "json"
+)
+
+// resolvedInputID - the name of the input file that layered inputs are resolved into
+const resolvedInputID = "000.tfvars.json"
+
+// inputMergeKeys - the attributes that identify the objects of a list when layers are merged, in order of preference
+var inputMergeKeys = []cty.Path{
+	cty.GetAttrPath("metadata").GetAttr("name"),
+	cty.GetAttrPath("availability_zone"),
+}
+
+// ResolvedInput - a value of the layered inputs, and where it was set
+//
+// Objects and lists of objects are kept as trees, so that a later layer can
+// merge into them. Anything else, including empty objects and lists, is a
+// leaf that a later layer replaces.
+type ResolvedInput struct {
+	// Attrs are the attributes of an object, nil for lists and leaves
+	Attrs map[string]*ResolvedInput
+	// Elems are the objects of a list, nil for objects and leaves
+	Elems []*ResolvedInput
+	// Leaf is the value of a leaf
+	Leaf cty.Value
+	// Expr is the expression that set the value, nil for values not set by a file
+	Expr hcl.Expression
+	// Source describes where a value not set by a file comes from, e.g. TF_VAR_aws_region
+	Source string
+}
+
+// ResolvedInputsReport - the resolved inputs, as printed by inputs resolve --format json
+type ResolvedInputsReport struct {
+	Inputs json.RawMessage `json:"inputs"`
+	// Sources map the path of each value to where it was set, e.g. input.tfvars:12
+	Sources map[string]string `json:"sources"`
+}
+
+// inputsResolveCmd represents the inputs resolve command
+var inputsResolveCmd = &cobra.Command{
+	Use:   "resolve <name>",
+	Short: "Print the effective inputs of a cluster",
+	Long:  "Merge the input files like create does, and print the value terraform gets for each variable, with the file and line that set it.",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
+		name := args[0]
+
+		format, _ := cmd.Flags().GetString("format")
+
+		if format != resolveFormatText && format != resolveFormatJSON {
+			return NewInputError(`Unknown format "%s". Expected one of [%s, %s]`, format, resolveFormatText, resolveFormatJSON)
+		}
+
+		if !rootCmd.PersistentFlags().Changed("input") {
+			localStateDir, err := getLocalStateDir(name)
+			if err != nil {
+				return err
+			}
+			if inputs, err = getInitialInputs(localStateDir); err != nil {
+				return err
+			}
+		}
+		if len(inputs) == 0 {
+			return NewInputError(`No input files were found. You must explicitly pass "--input <file>"`)
+		}
+
+		resolved, violations, err := resolveClusterInputs(name, inputs)
+		if err != nil {
+			return err
+		}
+		if err := checkInputViolations(violations, fmt.Sprintf(`the inputs of cluster "%s"`, name)); err != nil {
+			return err
+		}
+
+		if format == resolveFormatJSON {
+			report := &ResolvedInputsReport{
+				Inputs:  getJSONValue(resolved.Value()),
+				Sources: map[string]string{},
+			}
+			resolved.walk(nil, func(path cty.Path, input *ResolvedInput) {
+				report.Sources[formatInputPath(path)] = input.SourceString()
+			})
+
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+
+		printResolvedInputs(os.Stdout, resolved)
+		return nil
+	},
+}
+
+func init() {
+	inputsCmd.AddCommand(inputsResolveCmd)
+	inputsResolveCmd.Flags().String("format", resolveFormatText, "Output format. One of text, json")
+}
+
+// newResolvedInput - the tree of a value set by expr
+func newResolvedInput(value cty.Value, expr hcl.Expression) *ResolvedInput {
+	if value.IsNull() || !value.IsWhollyKnown() {
+		return &ResolvedInput{Leaf: value, Expr: expr}
+	}
+
+	ty := value.Type()
+
+	switch {
+	case (ty.IsObjectType() || ty.IsMapType()) && value.LengthInt() > 0:
+		input := &ResolvedInput{Attrs: map[string]*ResolvedInput{}, Expr: expr}
+		for key, attr := range value.AsValueMap() {
+			input.Attrs[key] = newResolvedInput(attr, getNestedExpr(expr, cty.GetAttrStep{Name: key}))
+		}
+		return input
+
+	case (ty.IsTupleType() || ty.IsListType()) && value.LengthInt() > 0:
+		input := &ResolvedInput{Expr: expr}
+		for i, elem := range value.AsValueSlice() {
+			if elem.IsNull() || !(elem.Type().IsObjectType() || elem.Type().IsMapType()) {
+				return &ResolvedInput{Leaf: value, Expr: expr}
+			}
+			input.Elems = append(input.Elems, newResolvedInput(elem, getNestedExpr(expr, cty.IndexStep{Key: cty.NumberIntVal(int64(i))})))
+		}
+		return input
+	}
+
+	return &ResolvedInput{Leaf: value, Expr: expr}
+}
+
+// getNestedExpr - the expression of the value at step within expr, or expr itself if it can't be found
+func getNestedExpr(expr hcl.Expression, step cty.PathStep) hcl.Expression {
+	if expr == nil {
+		return nil
+	}
+	if nested := getExprStep(expr, step); nested != nil {
+		return nested
+	}
+	return expr
+}
+
+func (r *ResolvedInput) isObject() bool {
+	return r.Attrs != nil
+}
+
+func (r *ResolvedInput) isList() bool {
+	return r.Elems != nil
+}
+
+// Value - the resolved value
+func (r *ResolvedInput) Value() cty.Value {
+	switch {
+	case r.isObject():
+		if len(r.Attrs) == 0 {
+			return cty.EmptyObjectVal
+		}
+		attrs := map[string]cty.Value{}
+		for key, attr := range r.Attrs {
+			attrs[key] = attr.Value()
+		}
+		return cty.ObjectVal(attrs)
+	case r.isList():
+		var elems []cty.Value
+		for _, elem := range r.Elems {
+			elems = append(elems, elem.Value())
+		}
+		return cty.TupleVal(elems)
+	}
+	return r.Leaf
+}
+
+// SourceString - where the value was set, e.g. input.tfvars:12, or only the file for YAML inputs
+func (r *ResolvedInput) SourceString() string {
+	if r.Expr == nil {
+		return r.Source
+	}
+
+	rng := r.Expr.Range()
+	if getInputFormat(rng.Filename) == inputFormatYAML {
+		return getDisplayPath(rng.Filename)
+	}
+	return fmt.Sprintf("%s:%d", getDisplayPath(rng.Filename), rng.Start.Line)
+}
+
+// RangeAt - the range of the value at path, or of the closest enclosing value set by a file
+func (r *ResolvedInput) RangeAt(path cty.Path) hcl.Range {
+	input := r
+	for i, step := range path {
+		next := input.step(step)
+		if next == nil {
+			if input.Expr == nil {
+				return hcl.Range{}
+			}
+			return getExprRangeAt(input.Expr, path[i:])
+		}
+		input = next
+	}
+
+	if input.Expr == nil {
+		return hcl.Range{}
+	}
+	return input.Expr.Range()
+}
+
+func (r *ResolvedInput) step(step cty.PathStep) *ResolvedInput {
+	switch s := step.(type) {
+	case cty.GetAttrStep:
+		return r.Attrs[s.Name]
+	case cty.IndexStep:
+		switch s.Key.Type() {
+		case cty.String:
+			return r.Attrs[s.Key.AsString()]
+		case cty.Number:
+			i, accuracy := s.Key.AsBigFloat().Int64()
+			if accuracy == 0 && i >= 0 && int(i) < len(r.Elems) {
+				return r.Elems[i]
+			}
+		}
+	}
+	return nil
+}
+
+// key - the string at path, which identifies an object in a list
+func (r *ResolvedInput) key(path cty.Path) (string, bool) {
+	input := r
+	for _, step := range path {
+		if input = input.step(step); input == nil {
+			return "", false
+		}
+	}
+
+	if input.isObject() || input.isList() {
+		return "", false
+	}
+
+	value := input.Leaf
+	if value.Type() != cty.String || value.IsNull() || !value.IsKnown() {
+		return "", false
+	}
+	return value.AsString(), true
+}
+
+// sortedAttrNames - the attribute names of an object, sorted
+func (r *ResolvedInput) sortedAttrNames() []string {
+	var names []string
+	for name := range r.Attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// walk - call fn with every leaf and its path
+func (r *ResolvedInput) walk(path cty.Path, fn func(cty.Path, *ResolvedInput)) {
+	switch {
+	case r.isObject():
+		for _, name := range r.sortedAttrNames() {
+			r.Attrs[name].walk(path.Copy().GetAttr(name), fn)
+		}
+	case r.isList():
+		for i, elem := range r.Elems {
+			elem.walk(path.Copy().Index(cty.NumberIntVal(int64(i))), fn)
+		}
+	default:
+		fn(path, r)
+	}
+}
+
+// mergeResolvedInputs - overlay one layer of inputs on another
+//
+// Objects are merged attribute by attribute. Lists of objects are merged by
+// the first of inputMergeKeys that identifies every object of both lists,
+// objects of the overlay with a new key being appended. Anything else,
+// including null and empty objects or lists, replaces the base value.
+func mergeResolvedInputs(base, overlay *ResolvedInput) *ResolvedInput {
+	switch {
+	case base.isObject() && overlay.isObject():
+		merged := &ResolvedInput{Attrs: map[string]*ResolvedInput{}, Expr: overlay.Expr, Source: overlay.Source}
+		for key, attr := range base.Attrs {
+			merged.Attrs[key] = attr
+		}
+		for key, attr := range overlay.Attrs {
+			if baseAttr, ok := merged.Attrs[key]; ok {
+				merged.Attrs[key] = mergeResolvedInputs(baseAttr, attr)
+			} else {
+				merged.Attrs[key] = attr
+			}
+		}
+		return merged
+
+	case base.isList() && overlay.isList():
+		key := getInputMergeKey(base.Elems, overlay.Elems)
+		if key == nil {
+			return overlay
+		}
+
+		merged := &ResolvedInput{Expr: overlay.Expr, Source: overlay.Source}
+		index := map[string]int{}
+		for i, elem := range base.Elems {
+			k, _ := elem.key(key)
+			index[k] = i
+			merged.Elems = append(merged.Elems, elem)
+		}
+		for _, elem := range overlay.Elems {
+			k, _ := elem.key(key)
+			if i, ok := index[k]; ok {
+				merged.Elems[i] = mergeResolvedInputs(merged.Elems[i], elem)
+			} else {
+				merged.Elems = append(merged.Elems, elem)
+			}
+		}
+		return merged
+	}
+
+	return overlay
+}
+
+// getInputMergeKey - the first of inputMergeKeys that is unique within each of the lists, or nil
+func getInputMergeKey(lists ...[]*ResolvedInput) cty.Path {
+	for _, key := range inputMergeKeys {
+		found := true
+
+		for _, elems := range lists {
+			seen := map[string]bool{}
+			for _, elem := range elems {
+				k, ok := elem.key(key)
+				if !ok || seen[k] {
+					found = false
+					break
+				}
+				seen[k] = true
+			}
+			if !found {
+				break
+			}
+		}
+
+		if found {
+			return key
+		}
+	}
+	return nil
+}
+
+// resolveInputFiles - merge the input files, each overlaying the ones before it
+func resolveInputFiles(files []string) (*ResolvedInput, []*InputViolation, error) {
+	resolved := &ResolvedInput{Attrs: map[string]*ResolvedInput{}}
+	var violations []*InputViolation
+
+	for _, fp := range files {
+		// Skipping it would check fewer layers than were passed
+		if !fileExists(fp) {
+			violations = append(violations, &InputViolation{
+				Path:    getDisplayPath(fp),
+				Message: "Input file does not exist",
+			})
+			continue
+		}
+
+		vars, err := parseTfvarsFiles([]string{fp})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, name := range sortedTfvarNames(vars) {
+			attr := vars[name]
+
+			value, diags := attr.Expr.Value(nil)
+			if diags.HasErrors() {
+				violations = append(violations, &InputViolation{
+					Path:    name,
+					Message: formatDiagnostics(diags),
+					Range:   attr.Expr.Range(),
+				})
+				value = cty.DynamicVal
+			}
+
+			input := newResolvedInput(value, attr.Expr)
+			if base, ok := resolved.Attrs[name]; ok {
+				input = mergeResolvedInputs(base, input)
+			}
+			resolved.Attrs[name] = input
+		}
+	}
+
+	return resolved, violations, nil
+}
+
+// resolveClusterInputs - the values terraform gets for the cluster variables
+//
+// Values are taken from, in increasing order of precedence: the variable
+// defaults, TF_VAR_<name>, the embedded default.auto.tfvars, the merged input
+// files, and the values klarista passes with -var. Only the input files are
+// merged; each of the others replaces the value before it, like in terraform.
+func resolveClusterInputs(clusterName string, files []string) (*ResolvedInput, []*InputViolation, error) {
+	resolved := &ResolvedInput{Attrs: map[string]*ResolvedInput{}}
+	var violations []*InputViolation
+
+	setValue := func(name string, expr hcl.Expression) {
+		value, diags := expr.Value(nil)
+		if diags.HasErrors() {
+			violations = append(violations, &InputViolation{
+				Path:    name,
+				Message: formatDiagnostics(diags),
+				Range:   expr.Range(),
+			})
+			value = cty.DynamicVal
+		}
+		resolved.Attrs[name] = newResolvedInput(value, expr)
+	}
+
+	variables, err := getClusterVariables()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	declared := map[string]bool{}
+	for _, variable := range variables {
+		declared[variable.Name] = true
+
+		if variable.Default != nil {
+			setValue(variable.Name, variable.Default)
+		}
+
+		env, ok := os.LookupEnv("TF_VAR_" + variable.Name)
+		if !ok {
+			continue
+		}
+
+		// Like terraform, string variables take the raw value
+		if variable.Type == cty.String {
+			resolved.Attrs[variable.Name] = &ResolvedInput{Leaf: cty.StringVal(env), Source: "TF_VAR_" + variable.Name}
+			continue
+		}
+
+		expr, diags := hclsyntax.ParseExpression([]byte(env), "TF_VAR_"+variable.Name, hcl.Pos{Line: 1, Column: 1})
+		if diags.HasErrors() {
+			violations = append(violations, &InputViolation{
+				Path:    variable.Name,
+				Message: formatDiagnostics(diags),
+			})
+			continue
+		}
+		setValue(variable.Name, expr)
+	}
+
+	defaults, err := getClusterDefaults()
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, attr := range defaults {
+		setValue(name, attr.Expr)
+	}
+
+	layers, moreViolations, err := resolveInputFiles(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	violations = append(violations, moreViolations...)
+
+	for _, name := range layers.sortedAttrNames() {
+		input := layers.Attrs[name]
+		if !declared[name] {
+			Logger.Warnf(`%s sets undeclared variable "%s"`, input.SourceString(), name)
+			continue
+		}
+		resolved.Attrs[name] = input
+	}
+
+	resolved.Attrs["cluster_name"] = &ResolvedInput{Leaf: cty.StringVal(clusterName), Source: "klarista"}
+	resolved.Attrs["state_bucket_name"] = &ResolvedInput{Leaf: cty.StringVal(getStateBucketName(clusterName)), Source: "klarista"}
+
+	return resolved, violations, nil
+}
+
+// resolveInputData - merge the input files into one .tfvars.json file
+func resolveInputData(files []string) ([]byte, error) {
+	resolved, violations, err := resolveInputFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkInputViolations(violations, "the input files"); err != nil {
+		return nil, err
+	}
+
+	data, err := ctyjson.Marshal(resolved.Value(), resolved.Value().Type())
+	if err != nil {
+		return nil, err
+	}
+
+	// Indented, so that the resolved input is readable in the state
+	var b bytes.Buffer
+	if err := json.Indent(&b, data, "", "  "); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// printResolvedInputs - print the resolved inputs as HCL, with where each value was set
+func printResolvedInputs(w io.Writer, resolved *ResolvedInput) {
+	for _, name := range resolved.sortedAttrNames() {
+		fmt.Fprintf(w, "%s = ", name)
+		printResolvedInput(w, resolved.Attrs[name], "", "")
+	}
+}
+
+func printResolvedInput(w io.Writer, input *ResolvedInput, indent, suffix string) {
+	switch {
+	case input.isObject():
+		fmt.Fprintln(w, "{")
+		for _, name := range input.sortedAttrNames() {
+			key := name
+			if !hclsyntax.ValidIdentifier(name) {
+				key = fmt.Sprintf("%q", name)
+			}
+			fmt.Fprintf(w, "%s  %s = ", indent, key)
+			printResolvedInput(w, input.Attrs[name], indent+"  ", "")
+		}
+		fmt.Fprintf(w, "%s}%s\n", indent, suffix)
+	case input.isList():
+		fmt.Fprintln(w, "[")
+		for _, elem := range input.Elems {
+			fmt.Fprintf(w, "%s  ", indent)
+			printResolvedInput(w, elem, indent+"  ", ",")
+		}
+		fmt.Fprintf(w, "%s]%s\n", indent, suffix)
+	default:
+		value := strings.TrimSpace(string(hclwrite.Format(hclwrite.TokensForValue(input.Leaf).Bytes())))
+		value = strings.ReplaceAll(value, "\n", "\n"+indent)
+		fmt.Fprintf(w, "%s%s  # %s\n", value, suffix, input.SourceString())
+	}
+}
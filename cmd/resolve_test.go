@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestMergeResolvedInputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		overlay string
+		// want is the resolved variables, as an HCL object
+		want string
+		// sources are where some of the values were set, by path
+		sources map[string]string
+	}{
+		{
+			name:    "maps are merged by key",
+			base:    `tags = { team = "platform", env = "dev" }`,
+			overlay: `tags = { env = "prod", owner = "sre" }`,
+			want:    `{ tags = { team = "platform", env = "prod", owner = "sre" } }`,
+			sources: map[string]string{
+				"tags.team":  "base.tfvars:1",
+				"tags.env":   "overlay.tfvars:1",
+				"tags.owner": "overlay.tfvars:1",
+			},
+		},
+		{
+			name:    "nested objects are merged",
+			base:    `spec = { volume = { size = 20, type = "gp3" }, minSize = 1 }`,
+			overlay: "\n" + `spec = { volume = { size = 50 } }`,
+			want:    `{ spec = { volume = { size = 50, type = "gp3" }, minSize = 1 } }`,
+			sources: map[string]string{
+				"spec.volume.size": "overlay.tfvars:2",
+				"spec.volume.type": "base.tfvars:1",
+			},
+		},
+		{
+			name: "lists are merged by metadata.name",
+			base: `groups = [
+  { metadata = { name = "a" }, spec = { minSize = 1, maxSize = 3 } },
+  { metadata = { name = "b" }, spec = { minSize = 1, maxSize = 3 } },
+]`,
+			overlay: `groups = [
+  { metadata = { name = "c" }, spec = { minSize = 0, maxSize = 1 } },
+  { metadata = { name = "a" }, spec = { maxSize = 9 } },
+]`,
+			want: `{ groups = [
+  { metadata = { name = "a" }, spec = { minSize = 1, maxSize = 9 } },
+  { metadata = { name = "b" }, spec = { minSize = 1, maxSize = 3 } },
+  { metadata = { name = "c" }, spec = { minSize = 0, maxSize = 1 } },
+] }`,
+			sources: map[string]string{
+				"groups[0].spec.minSize": "base.tfvars:2",
+				"groups[0].spec.maxSize": "overlay.tfvars:3",
+				"groups[2].spec.maxSize": "overlay.tfvars:2",
+			},
+		},
+		{
+			name: "lists are merged by availability_zone",
+			base: `subnets = [
+  { cidr_block = "172.70.0.0/27", availability_zone = "us-east-1a" },
+  { cidr_block = "172.70.0.32/27", availability_zone = "us-east-1b" },
+]`,
+			overlay: `subnets = [
+  { cidr_block = "172.70.0.96/27", availability_zone = "us-east-1b" },
+  { cidr_block = "172.70.0.64/27", availability_zone = "us-east-1c" },
+]`,
+			want: `{ subnets = [
+  { cidr_block = "172.70.0.0/27", availability_zone = "us-east-1a" },
+  { cidr_block = "172.70.0.96/27", availability_zone = "us-east-1b" },
+  { cidr_block = "172.70.0.64/27", availability_zone = "us-east-1c" },
+] }`,
+			sources: map[string]string{
+				"subnets[0].cidr_block": "base.tfvars:2",
+				"subnets[1].cidr_block": "overlay.tfvars:2",
+			},
+		},
+		{
+			name: "duplicate keys in the overlay replace the list",
+			base: `subnets = [
+  { cidr_block = "172.70.0.0/27", availability_zone = "us-east-1a" },
+]`,
+			overlay: `subnets = [
+  { cidr_block = "172.70.0.32/27", availability_zone = "us-east-1b" },
+  { cidr_block = "172.70.0.64/27", availability_zone = "us-east-1b" },
+]`,
+			want: `{ subnets = [
+  { cidr_block = "172.70.0.32/27", availability_zone = "us-east-1b" },
+  { cidr_block = "172.70.0.64/27", availability_zone = "us-east-1b" },
+] }`,
+		},
+		{
+			name: "duplicate keys in the base are replaced",
+			base: `subnets = [
+  { cidr_block = "172.70.0.0/27", availability_zone = "us-east-1a" },
+  { cidr_block = "172.70.0.32/27", availability_zone = "us-east-1a" },
+]`,
+			overlay: `subnets = [
+  { cidr_block = "172.70.0.64/27", availability_zone = "us-east-1a" },
+]`,
+			want: `{ subnets = [
+  { cidr_block = "172.70.0.64/27", availability_zone = "us-east-1a" },
+] }`,
+		},
+		{
+			name:    "objects without a key replace the list",
+			base:    `rules = [{ port = 22 }, { port = 443 }]`,
+			overlay: `rules = [{ port = 80 }]`,
+			want:    `{ rules = [{ port = 80 }] }`,
+		},
+		{
+			name:    "an empty list replaces the base",
+			base:    `groups = [{ metadata = { name = "a" } }]`,
+			overlay: `groups = []`,
+			want:    `{ groups = [] }`,
+			sources: map[string]string{
+				"groups": "overlay.tfvars:1",
+			},
+		},
+		{
+			name:    "an empty object replaces the base",
+			base:    `tags = { team = "platform" }`,
+			overlay: `tags = {}`,
+			want:    `{ tags = {} }`,
+		},
+		{
+			name:    "null replaces the base",
+			base:    `tags = { team = "platform" }`,
+			overlay: `tags = null`,
+			want:    `{ tags = null }`,
+		},
+		{
+			name:    "lists of strings replace the base",
+			base:    `sources = ["10.0.0.0/8", "172.16.0.0/12"]`,
+			overlay: `sources = ["192.168.0.0/16"]`,
+			want:    `{ sources = ["192.168.0.0/16"] }`,
+		},
+		{
+			name:    "values of another type replace the base",
+			base:    `tags = { team = "platform" }`,
+			overlay: `tags = "platform"`,
+			want:    `{ tags = "platform" }`,
+		},
+		{
+			name:    "variables set by one layer are kept",
+			base:    `aws_region = "us-east-1"`,
+			overlay: `aws_profile = "dev"`,
+			want:    `{ aws_region = "us-east-1", aws_profile = "dev" }`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var files []string
+			for _, file := range []struct{ name, content string }{{"base.tfvars", tt.base}, {"overlay.tfvars", tt.overlay}} {
+				fp := path.Join(dir, file.name)
+				if err := ioutil.WriteFile(fp, []byte(file.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, fp)
+			}
+
+			resolved, violations, err := resolveInputFiles(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range violations {
+				t.Fatalf("unexpected violation %s", v)
+			}
+
+			wantExpr, diags := hclsyntax.ParseExpression([]byte(tt.want), "want.hcl", hcl.Pos{Line: 1, Column: 1})
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+			want, diags := wantExpr.Value(nil)
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+
+			got := resolved.Value()
+			if !got.Equals(want).True() {
+				t.Errorf("resolved = %#v, want %#v", got, want)
+			}
+
+			for p, source := range tt.sources {
+				rng := resolved.RangeAt(parseTestInputPath(t, p))
+				if got := fmt.Sprintf("%s:%d", filepath.Base(rng.Filename), rng.Start.Line); got != source {
+					t.Errorf("%s was set at %s, want %s", p, got, source)
+				}
+			}
+		})
+	}
+}
+
+// parseTestInputPath - the cty.Path of a path like groups[0].spec.minSize
+func parseTestInputPath(t *testing.T, s string) cty.Path {
+	t.Helper()
+
+	traversal, diags := hclsyntax.ParseTraversalAbs([]byte(s), "path", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	var p cty.Path
+	for _, step := range traversal {
+		switch s := step.(type) {
+		case hcl.TraverseRoot:
+			p = p.GetAttr(s.Name)
+		case hcl.TraverseAttr:
+			p = p.GetAttr(s.Name)
+		case hcl.TraverseIndex:
+			p = p.Index(s.Key)
+		}
+	}
+	return p
+}
+
+func TestResolveInputFilesMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	useTestWorkDir(t, dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "base.tfvars"), []byte(`aws_region = "us-east-1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, violations, err := resolveInputFiles([]string{path.Join(dir, "base.tfvars"), path.Join(dir, "missing.tfvars")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(violations) != 1 || violations[0].Path != "missing.tfvars" || violations[0].Warning {
+		t.Fatalf("violations = %v, want one for missing.tfvars", violations)
+	}
+	if _, ok := resolved.Attrs["aws_region"]; !ok {
+		t.Errorf("the inputs of base.tfvars were not resolved")
+	}
+}
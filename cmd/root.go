@@ -1,6 +1,12 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/spf13/cobra"
 )
 
@@ -11,16 +17,75 @@ var rootCmd = &cobra.Command{
 	Use:     "klarista",
 	Long:    `klarista is a command line tool that generates terraform modules for kops clusters`,
 	Version: Version,
+	// Errors are logged by Execute
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
+		currentCommand = strings.Join(append([]string{cmd.CommandPath()}, args...), " ")
+		return applyConfig(cmd.Flags())
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	stop := interrupts.Start()
+	err := executeRootCommand()
+	stop()
+
+	if sig := interrupts.Signal(); sig != nil {
+		var interruptedErr *InterruptedError
+		if !errors.As(err, &interruptedErr) {
+			err = &InterruptedError{Signal: sig, Err: err}
+		}
+		Logger.Error(err)
+		if resumeCommand != "" {
+			Logger.Infof("Run `%s` to resume", resumeCommand)
+		} else {
+			Logger.Infof("Run `%s` again to resume", strings.Join(os.Args, " "))
+		}
+		os.Exit(getExitCode(err))
+	}
+
+	if err != nil {
 		Logger.Error(err)
+		if resumeCommand != "" {
+			Logger.Infof("Run `%s` to resume", resumeCommand)
+		}
+		os.Exit(getExitCode(err))
 	}
 }
 
+// executeRootCommand - run the command in the arguments, with unknown commands reported as an InputError
+//
+// cobra finds the command before any of klarista runs, and reports an unknown
+// one with an untyped error.
+func executeRootCommand() error {
+	err := rootCmd.Execute()
+	if err != nil && getExitCode(err) == exitCodeError && strings.HasPrefix(err.Error(), "unknown command ") {
+		return &InputError{Err: fmt.Errorf("%v\nRun '%s --help' for usage", err, rootCmd.CommandPath())}
+	}
+	return err
+}
+
 func init() {
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return &InputError{Err: fmt.Errorf("%v\nRun '%s --help' for usage", err, cmd.CommandPath())}
+	})
+
 	rootCmd.PersistentFlags().StringArrayVarP(&inputs, "input", "i", []string{}, "Path(s) to the cluster input file(s)")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Path to the klarista config file (default \"./klarista.yaml\")")
+	rootCmd.PersistentFlags().StringVar(&stateBackendName, "state-backend", stateBackendS3, "Remote state backend, one of [s3, local]")
+	rootCmd.PersistentFlags().StringVar(&stateLocalDir, "state-local-dir", getDefaultStateLocalDir(), "Root directory of the local state backend")
+	rootCmd.PersistentFlags().StringVar(&stateEndpoint, "state-endpoint", "", "Endpoint of an S3 compatible state store")
+	rootCmd.PersistentFlags().BoolVar(&statePathStyle, "state-path-style", false, "Use path-style addressing for the state bucket")
+	rootCmd.PersistentFlags().StringVar(&stateBucket, "state-bucket", "", "Existing state bucket to use instead of creating one per cluster")
+	rootCmd.PersistentFlags().StringVar(&stateKeyPrefix, "state-key-prefix", "", "Prefix of the state object keys, e.g. to share a bucket between clusters")
+	rootCmd.PersistentFlags().StringVar(&stateCompression, "state-compression", stateCompressionGzip, "Compression of the state archive [gzip, zstd, none]")
+	rootCmd.PersistentFlags().StringVar(&stateEncryption, "state-encryption", stateEncryptionNone, "Client-side encryption of the remote state [none, kms, passphrase]")
+	rootCmd.PersistentFlags().StringVar(&stateEncryptionKeyArn, "state-encryption-key-arn", "", "KMS key used to encrypt the remote state. Defaults to the encryption_key_arn input")
+	rootCmd.PersistentFlags().BoolVar(&allowDowngrade, "allow-downgrade", false, "Write state that was last written by a newer version of klarista")
+	rootCmd.PersistentFlags().DurationVar(&lockTTL, "lock-ttl", 15*time.Minute, "Time after which an abandoned remote state lock may be taken over")
 }
@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runnerEnv - environment variables that affect the external commands klarista runs
+var runnerEnv = []string{
+	"AWS_PROFILE",
+	"AWS_REGION",
+	"CLUSTER",
+	"KOPS_FEATURE_FLAGS",
+	"KOPS_STATE_STORE",
+	"KUBECONFIG",
+	"S3_ENDPOINT",
+}
+
+// Command - an external command
+type Command struct {
+	Name string
+	Args []string
+	// Dir is the working directory of the command
+	Dir string
+	// Env holds the values of runnerEnv when the command was run
+	Env map[string]string
+	// Capture returns the output of the command instead of writing it to stderr
+	Capture bool
+	// Stdin, if set, is piped to the command instead of klarista's stdin
+	Stdin []byte
+	// Quiet discards the errors written by the command
+	Quiet bool
+}
+
+// NewCommand - describe a command run in the current working directory
+func NewCommand(name string, args ...string) *Command {
+	// An empty Dir runs the command in the current working directory all the same
+	dir, _ := os.Getwd()
+
+	env := map[string]string{}
+	for _, key := range runnerEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			env[key] = value
+		}
+	}
+
+	return &Command{
+		Name: name,
+		Args: args,
+		Dir:  dir,
+		Env:  env,
+	}
+}
+
+func (c *Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Runner - runs the external commands klarista depends on
+type Runner interface {
+	// Run runs c, returning its output if c.Capture is set
+	Run(c *Command) ([]byte, error)
+	// Sleep waits for d before polling again
+	Sleep(d time.Duration) error
+}
+
+// runner - the runner used by every command
+var runner Runner = &ExecRunner{}
+
+// ExecRunner - runs commands as child processes
+type ExecRunner struct {
+	// Output, if set, also receives the output of commands that aren't captured
+	Output io.Writer
+}
+
+func (r *ExecRunner) Run(c *Command) ([]byte, error) {
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Dir = c.Dir
+
+	cmd.Stdin = os.Stdin
+	if c.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(c.Stdin)
+	}
+	if !c.Capture {
+		cmd.Stdout = os.Stderr
+		if r.Output != nil {
+			cmd.Stdout = io.MultiWriter(os.Stderr, r.Output)
+		}
+	}
+	cmd.Stderr = os.Stderr
+	if c.Quiet {
+		cmd.Stderr = nil
+	}
+
+	// Don't start anything new once klarista has been interrupted
+	if err := checkInterrupted(); err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	if c.Capture {
+		cmd.Stdout = &stdout
+	}
+
+	ownGroup := !isInteractive()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: ownGroup}
+
+	Logger.Debugf("%s", c)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	untrack := interrupts.track(cmd.Process, ownGroup)
+	err := cmd.Wait()
+	untrack()
+
+	if c.Capture {
+		return stdout.Bytes(), err
+	}
+	return nil, err
+}
+
+func (r *ExecRunner) Sleep(d time.Duration) error {
+	return sleep(d)
+}
+
+// DryRunStep - one step of a dry run plan
+type DryRunStep struct {
+	// Command is nil for steps klarista performs itself
+	Command     *Command
+	Description string
+}
+
+// DryRunRunner - records commands instead of running them
+//
+// Captured output is an empty JSON object, which every caller accepts as
+// "nothing to report".
+type DryRunRunner struct {
+	Steps []*DryRunStep
+}
+
+func NewDryRunRunner() *DryRunRunner {
+	return &DryRunRunner{}
+}
+
+func (r *DryRunRunner) Run(c *Command) ([]byte, error) {
+	Logger.Infof("Dry run: %s", c)
+	r.Steps = append(r.Steps, &DryRunStep{Command: c})
+	if c.Capture {
+		return []byte("{}"), nil
+	}
+	return nil, nil
+}
+
+func (r *DryRunRunner) Sleep(d time.Duration) error {
+	r.Steps = append(r.Steps, &DryRunStep{Description: fmt.Sprintf("wait %s", d)})
+	return nil
+}
+
+// Skip - record a step klarista would perform itself
+func (r *DryRunRunner) Skip(description string) {
+	Logger.Infof("Dry run: %s", description)
+	r.Steps = append(r.Steps, &DryRunStep{Description: description})
+}
+
+// Plan - describe every recorded step, in order
+//
+// Environment variables are only listed when they change.
+func (r *DryRunRunner) Plan() string {
+	var lines []string
+	env := map[string]string{}
+	dir := ""
+
+	for i, step := range r.Steps {
+		if step.Command == nil {
+			lines = append(lines, fmt.Sprintf("%3d. (%s)", i+1, step.Description))
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("%3d. %s", i+1, formatPlanCommand(step.Command)))
+
+		if step.Command.Stdin != nil {
+			lines = append(lines, "     stdin: output of the previous step")
+		}
+
+		if step.Command.Dir != dir {
+			dir = step.Command.Dir
+			lines = append(lines, fmt.Sprintf("     dir: %s", dir))
+		}
+
+		var changed []string
+		for key, value := range step.Command.Env {
+			if env[key] != value {
+				changed = append(changed, fmt.Sprintf("%s=%s", key, value))
+			}
+		}
+		for key := range env {
+			if _, ok := step.Command.Env[key]; !ok {
+				changed = append(changed, fmt.Sprintf("%s=", key))
+			}
+		}
+		sort.Strings(changed)
+		for _, kv := range changed {
+			lines = append(lines, fmt.Sprintf("     env: %s", kv))
+		}
+		env = step.Command.Env
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// formatPlanCommand - describe a command, with inline scripts dedented below it
+func formatPlanCommand(c *Command) string {
+	var words []string
+	var scripts []string
+
+	for _, arg := range append([]string{c.Name}, c.Args...) {
+		if !strings.Contains(strings.TrimSpace(arg), "\n") {
+			words = append(words, strings.TrimSpace(arg))
+			continue
+		}
+
+		lines := strings.Split(strings.TrimLeft(strings.TrimRight(arg, " \t\n"), "\n"), "\n")
+		indent := -1
+		for _, line := range lines {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			n := len(line) - len(strings.TrimLeft(line, " \t"))
+			if indent == -1 || n < indent {
+				indent = n
+			}
+		}
+		for i, line := range lines {
+			if len(line) >= indent {
+				line = line[indent:]
+			}
+			lines[i] = "       | " + strings.TrimRight(line, " \t")
+		}
+
+		words = append(words, "<script>")
+		scripts = append(scripts, strings.Join(lines, "\n"))
+	}
+
+	return strings.Join(append([]string{strings.Join(words, " ")}, scripts...), "\n")
+}
+
+func isDryRun() bool {
+	_, ok := runner.(*DryRunRunner)
+	return ok
+}
+
+// skipInDryRun - record a step that a dry run skips, and report whether to skip it
+func skipInDryRun(format string, args ...interface{}) bool {
+	if r, ok := runner.(*DryRunRunner); ok {
+		r.Skip(fmt.Sprintf(format, args...))
+		return true
+	}
+	return false
+}
+
+// printDryRunPlan - print the steps recorded by a dry run
+func printDryRunPlan(w io.Writer, command string) {
+	if r, ok := runner.(*DryRunRunner); ok {
+		fmt.Fprintf(w, "\n%s would run:\n\n%s\n", command, r.Plan())
+	}
+}
+
+// dryRunStateDirs - scratch state directories seeded by this dry run
+var dryRunStateDirs = map[string]bool{}
+
+// getLocalStateDir - local state directory of a cluster
+//
+// A dry run works on a scratch copy of the local state, so that it can't
+// change what a real run sees.
+func getLocalStateDir(clusterName string) (string, error) {
+	localStateDir := path.Join(os.TempDir(), clusterName)
+	if !isDryRun() {
+		return localStateDir, nil
+	}
+
+	dryRunStateDir := localStateDir + ".dry-run"
+	if dryRunStateDirs[dryRunStateDir] {
+		return dryRunStateDir, nil
+	}
+
+	if err := os.RemoveAll(dryRunStateDir); err != nil {
+		return "", err
+	}
+	if err := copyStateDir(localStateDir, dryRunStateDir); err != nil {
+		return "", err
+	}
+	dryRunStateDirs[dryRunStateDir] = true
+
+	return dryRunStateDir, nil
+}
+
+// copyStateDir - copy the files of a local state directory, except for terraform caches
+func copyStateDir(src, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	if !fileExists(src) {
+		return nil
+	}
+
+	return filepath.Walk(src, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, fp)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, rel)
+
+		switch {
+		case info.IsDir() && info.Name() == ".terraform":
+			return filepath.SkipDir
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		in, err := os.Open(fp)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
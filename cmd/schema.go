@@ -0,0 +1,463 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// Input schema formats
+const (
+	schemaFormatJSON     = "json"
+	schemaFormatMarkdown = "markdown"
+)
+
+// klaristaVariables - the variables klarista sets with -var, replacing any value from the inputs
+var klaristaVariables = map[string]string{
+	"cluster_name":      "The name of the cluster, from the command line",
+	"state_bucket_name": "The state bucket of the cluster, from --state-bucket or the cluster name",
+}
+
+// InputDoc - a cluster variable with the default terraform would use for it
+type InputDoc struct {
+	*ClusterVariable
+	// Default is the value from default.auto.tfvars or the variable default, or cty.NilVal if neither sets it
+	Default cty.Value
+	// Required is true when the inputs must set the variable
+	Required bool
+	// SetBy describes where klarista takes the value of a variable it sets itself
+	SetBy string
+}
+
+// JSONSchema - the subset of JSON Schema (draft-07) the cluster inputs need
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	UniqueItems          bool                   `json:"uniqueItems,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	MinProperties        *int                   `json:"minProperties,omitempty"`
+	MaxProperties        *int                   `json:"maxProperties,omitempty"`
+	Default              json.RawMessage        `json:"default,omitempty"`
+	ReadOnly             bool                   `json:"readOnly,omitempty"`
+	// Validations are the validation blocks of a variable, which JSON Schema can't express in general
+	Validations []*JSONSchemaValidation `json:"x-validations,omitempty"`
+}
+
+// JSONSchemaValidation - a validation block of a variable
+type JSONSchemaValidation struct {
+	Condition    string `json:"condition"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// inputsCmd represents the inputs command
+var inputsCmd = &cobra.Command{
+	Use:   "inputs <command>",
+	Short: "Describe the cluster inputs",
+	Args:  cobra.MinimumNArgs(1),
+}
+
+// inputsSchemaCmd represents the inputs schema command
+var inputsSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the schema of the cluster inputs",
+	Long:  "Print the variables of the cluster terraform, with their types, defaults and validation rules, as a JSON Schema for editors and linters, or as a Markdown reference.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
+		format, _ := cmd.Flags().GetString("format")
+
+		if format != schemaFormatJSON && format != schemaFormatMarkdown {
+			return NewInputError(`Unknown format "%s". Expected one of [%s, %s]`, format, schemaFormatJSON, schemaFormatMarkdown)
+		}
+
+		docs, err := getInputDocs()
+		if err != nil {
+			return err
+		}
+
+		if format == schemaFormatMarkdown {
+			printInputsMarkdown(os.Stdout, docs)
+			return nil
+		}
+
+		data, err := json.MarshalIndent(getInputsJSONSchema(docs), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+
+		return nil
+	},
+}
+
+func init() {
+	inputsCmd.AddCommand(inputsSchemaCmd)
+	inputsSchemaCmd.Flags().String("format", schemaFormatJSON, "Schema format. One of json, markdown")
+
+	rootCmd.AddCommand(inputsCmd)
+}
+
+// getInputDocs - the cluster variables with their effective defaults, in declaration order
+func getInputDocs() ([]*InputDoc, error) {
+	defaults, err := getClusterDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	variables, err := getClusterVariables()
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []*InputDoc
+
+	for _, variable := range variables {
+		doc := &InputDoc{ClusterVariable: variable, Default: cty.NilVal}
+
+		if setBy, ok := klaristaVariables[variable.Name]; ok {
+			doc.SetBy = setBy
+			docs = append(docs, doc)
+			continue
+		}
+
+		expr := variable.Default
+		if attr, ok := defaults[variable.Name]; ok {
+			expr = attr.Expr
+		}
+
+		if expr != nil {
+			value, diags := expr.Value(nil)
+			if diags.HasErrors() {
+				return nil, fmt.Errorf("Failed to evaluate the default of variable %s, %s", variable.Name, formatDiagnostics(diags))
+			}
+			doc.Default = value
+		}
+
+		// Like terraform, a null value for a variable without a default counts as unset. A default
+		// that fails the validation rules, e.g. an empty list of subnets, must be replaced too
+		doc.Required = variable.Default == nil && (doc.Default == cty.NilVal || doc.Default.IsNull())
+		if !doc.Required && !doc.Default.IsNull() {
+			doc.Required = !isValidDefault(variable, doc.Default)
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// isValidDefault - whether value passes the validation rules of variable, or can't be checked without terraform
+func isValidDefault(variable *ClusterVariable, value cty.Value) bool {
+	value, err := convert.Convert(value, variable.Type)
+	if err != nil {
+		return false
+	}
+
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var": cty.ObjectVal(map[string]cty.Value{variable.Name: value}),
+		},
+		Functions: inputFunctions,
+	}
+
+	for _, validation := range variable.Validations {
+		result, diags := validation.Condition.Value(ctx)
+		if diags.HasErrors() {
+			continue
+		}
+		result, err := convert.Convert(result, cty.Bool)
+		if err == nil && result.IsKnown() && !result.IsNull() && result.False() {
+			return false
+		}
+	}
+	return true
+}
+
+// getInputsJSONSchema - a JSON Schema for the values set by the input files
+func getInputsJSONSchema(docs []*InputDoc) *JSONSchema {
+	schema := &JSONSchema{
+		Schema:      "http://json-schema.org/draft-07/schema#",
+		Title:       "klarista cluster inputs",
+		Description: "The variables of the klarista cluster terraform. Generated by klarista inputs schema",
+		Type:        "object",
+		Properties:  map[string]*JSONSchema{},
+	}
+
+	for _, doc := range docs {
+		property := getTypeSchema(doc.Type, doc.TypeDefaults)
+		property.Description = doc.Description
+
+		for _, validation := range doc.Validations {
+			setLengthRule(property, doc.Name, doc.Type, validation.Condition)
+			property.Validations = append(property.Validations, &JSONSchemaValidation{
+				Condition:    validation.ConditionSource,
+				ErrorMessage: validation.ErrorMessage,
+			})
+		}
+
+		if doc.SetBy != "" {
+			property.Description = fmt.Sprintf("%s. Set by klarista, which replaces any value from the inputs", doc.SetBy)
+			property.ReadOnly = true
+		} else if doc.Required {
+			schema.Required = append(schema.Required, doc.Name)
+		} else {
+			property.Default = getJSONValue(doc.Default)
+			if doc.Default.IsNull() {
+				if t, ok := property.Type.(string); ok {
+					property.Type = []string{t, "null"}
+				}
+			}
+		}
+
+		schema.Properties[doc.Name] = property
+	}
+
+	return schema
+}
+
+// getTypeSchema - the JSON Schema of a terraform type constraint
+func getTypeSchema(ty cty.Type, defaults *typeexpr.Defaults) *JSONSchema {
+	switch {
+	case ty == cty.String:
+		return &JSONSchema{Type: "string"}
+	case ty == cty.Number:
+		return &JSONSchema{Type: "number"}
+	case ty == cty.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case ty.IsListType() || ty.IsSetType():
+		return &JSONSchema{
+			Type:        "array",
+			Items:       getTypeSchema(ty.ElementType(), getChildDefaults(defaults, "")),
+			UniqueItems: ty.IsSetType(),
+		}
+	case ty.IsTupleType():
+		n := ty.Length()
+		return &JSONSchema{Type: "array", MinItems: &n, MaxItems: &n}
+	case ty.IsMapType():
+		return &JSONSchema{
+			Type:                 "object",
+			AdditionalProperties: getTypeSchema(ty.ElementType(), getChildDefaults(defaults, "")),
+		}
+	case ty.IsObjectType():
+		schema := &JSONSchema{Type: "object", Properties: map[string]*JSONSchema{}}
+		for name, attrType := range ty.AttributeTypes() {
+			childDefaults := getChildDefaults(defaults, name)
+			property := getTypeSchema(attrType, childDefaults)
+			if defaults != nil {
+				if value, ok := defaults.DefaultValues[name]; ok {
+					// Like terraform, the defaults within the default apply too
+					if childDefaults != nil {
+						value = childDefaults.Apply(value)
+					}
+					property.Default = getJSONValue(value)
+				}
+			}
+			schema.Properties[name] = property
+
+			if !ty.AttributeOptional(name) {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+		sort.Strings(schema.Required)
+		return schema
+	}
+
+	// any
+	return &JSONSchema{}
+}
+
+// getChildDefaults - the defaults of an attribute, or of the elements of a collection for key ""
+func getChildDefaults(defaults *typeexpr.Defaults, key string) *typeexpr.Defaults {
+	if defaults == nil {
+		return nil
+	}
+	return defaults.Children[key]
+}
+
+// getJSONValue - value as JSON, like terraform writes it to a .tfvars.json file
+//
+// Only known values are described, so failing to marshal one is a bug.
+func getJSONValue(value cty.Value) json.RawMessage {
+	if value == cty.NilVal {
+		return nil
+	}
+
+	data, err := ctyjson.Marshal(value, value.Type())
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// setLengthRule - translate a validation rule like length(var.name) <= 44 to JSON Schema keywords
+//
+// Other rules are only listed in x-validations.
+func setLengthRule(schema *JSONSchema, name string, ty cty.Type, condition hcl.Expression) {
+	expr, ok := condition.(*hclsyntax.BinaryOpExpr)
+	if !ok {
+		return
+	}
+
+	call, ok := expr.LHS.(*hclsyntax.FunctionCallExpr)
+	if !ok || call.Name != "length" || len(call.Args) != 1 {
+		return
+	}
+
+	arg, ok := call.Args[0].(*hclsyntax.ScopeTraversalExpr)
+	if !ok || len(arg.Traversal) != 2 || arg.Traversal.RootName() != "var" {
+		return
+	}
+	if attr, ok := arg.Traversal[1].(hcl.TraverseAttr); !ok || attr.Name != name {
+		return
+	}
+
+	literal, ok := expr.RHS.(*hclsyntax.LiteralValueExpr)
+	if !ok || literal.Val.Type() != cty.Number || literal.Val.IsNull() {
+		return
+	}
+	n, accuracy := literal.Val.AsBigFloat().Int64()
+	if accuracy != 0 {
+		return
+	}
+	bound := int(n)
+
+	var min, max *int
+	switch expr.Op {
+	case hclsyntax.OpGreaterThanOrEqual:
+		min = &bound
+	case hclsyntax.OpGreaterThan:
+		bound++
+		min = &bound
+	case hclsyntax.OpLessThanOrEqual:
+		max = &bound
+	case hclsyntax.OpLessThan:
+		bound--
+		max = &bound
+	case hclsyntax.OpEqual:
+		min, max = &bound, &bound
+	default:
+		return
+	}
+
+	switch {
+	case ty == cty.String:
+		schema.MinLength, schema.MaxLength = pickBound(schema.MinLength, min), pickBound(schema.MaxLength, max)
+	case ty.IsListType() || ty.IsSetType() || ty.IsTupleType():
+		schema.MinItems, schema.MaxItems = pickBound(schema.MinItems, min), pickBound(schema.MaxItems, max)
+	case ty.IsMapType() || ty.IsObjectType():
+		schema.MinProperties, schema.MaxProperties = pickBound(schema.MinProperties, min), pickBound(schema.MaxProperties, max)
+	}
+}
+
+// pickBound - the new bound if there is one, otherwise the current bound
+func pickBound(current, bound *int) *int {
+	if bound != nil {
+		return bound
+	}
+	return current
+}
+
+// printInputsMarkdown - print a Markdown reference of the cluster inputs
+func printInputsMarkdown(w io.Writer, docs []*InputDoc) {
+	fmt.Fprintln(w, "# Cluster inputs")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "The variables of the klarista cluster terraform, set in the input files. Generated by `klarista inputs schema --format markdown`.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Variable | Type | Required |")
+	fmt.Fprintln(w, "| --- | --- | --- |")
+
+	for _, doc := range docs {
+		required := "no"
+		switch {
+		case doc.SetBy != "":
+			required = "set by klarista"
+		case doc.Required:
+			required = "yes"
+		}
+		typeName := doc.Type.FriendlyName()
+		if doc.Type == cty.DynamicPseudoType {
+			typeName = "any"
+		}
+		fmt.Fprintf(w, "| [`%s`](#%s) | %s | %s |\n", doc.Name, doc.Name, typeName, required)
+	}
+
+	for _, doc := range docs {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "## `%s`\n", doc.Name)
+		fmt.Fprintln(w)
+
+		if doc.Description != "" {
+			fmt.Fprintln(w, doc.Description)
+			fmt.Fprintln(w)
+		}
+
+		if doc.SetBy != "" {
+			fmt.Fprintf(w, "%s. Set by klarista, which replaces any value from the inputs.\n", doc.SetBy)
+			printValidations(w, doc)
+			continue
+		}
+
+		typeSource := doc.TypeSource
+		if typeSource == "" {
+			typeSource = "any"
+		}
+		fmt.Fprintln(w, "Type:")
+		fmt.Fprintln(w)
+		printHCLBlock(w, typeSource)
+
+		if doc.Required {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "Required.")
+		} else if doc.Default != cty.NilVal {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "Default:")
+			fmt.Fprintln(w)
+			printHCLBlock(w, string(hclwrite.Format(hclwrite.TokensForValue(doc.Default).Bytes())))
+		}
+
+		printValidations(w, doc)
+	}
+}
+
+// printValidations - print the validation rules of a variable as a list
+func printValidations(w io.Writer, doc *InputDoc) {
+	if len(doc.Validations) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Validation:")
+	fmt.Fprintln(w)
+	for _, validation := range doc.Validations {
+		fmt.Fprintf(w, "- `%s`: %s\n", strings.Join(strings.Fields(validation.ConditionSource), " "), validation.ErrorMessage)
+	}
+}
+
+// printHCLBlock - print src as a fenced HCL code block
+func printHCLBlock(w io.Writer, src string) {
+	fmt.Fprintln(w, "```hcl")
+	fmt.Fprintln(w, strings.TrimSpace(src))
+	fmt.Fprintln(w, "```")
+}
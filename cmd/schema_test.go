@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+func TestGetInputsJSONSchema(t *testing.T) {
+	docs, err := getInputDocs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := getInputsJSONSchema(docs)
+
+	// Variables without a default, or whose default is null or fails their validation rules
+	wantRequired := []string{"aws_profile", "aws_region", "cluster_vpc_cidr", "public_subnets", "private_subnets"}
+	if !reflect.DeepEqual(schema.Required, wantRequired) {
+		t.Errorf("required = %v, want %v", schema.Required, wantRequired)
+	}
+
+	intPtr := func(n int) *int { return &n }
+
+	tests := []struct {
+		name string
+		// typ is the JSON Schema type
+		typ interface{}
+		// def is the default as JSON, or empty if there is none
+		def       string
+		readOnly  bool
+		minItems  *int
+		maxLength *int
+	}{
+		{name: "aws_profile", typ: "string"},
+		{name: "cluster_masters_per_subnet", typ: "number", def: `1`},
+		{name: "k8s_version", typ: "string", def: `"1.23.13"`},
+		{name: "aws_authorized_accounts", typ: "array", def: `[]`},
+		{name: "encryption_key_arn", typ: []string{"string", "null"}, def: `null`},
+		{name: "aws_provider_default_tags", def: `null`},
+		{
+			name: "cluster_node_instance_groups",
+			typ:  "array",
+			def:  `[{"metadata":{"name":"nodes"},"spec":{"machineType":"t3.xlarge","maxSize":9,"minSize":3}}]`,
+		},
+		{name: "cluster_name", typ: "string", readOnly: true, maxLength: intPtr(44)},
+		{name: "state_bucket_name", typ: "string", readOnly: true},
+		{name: "private_subnets", typ: "array", minItems: intPtr(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			property := schema.Properties[tt.name]
+			if property == nil {
+				t.Fatalf("no property %s", tt.name)
+			}
+
+			if !reflect.DeepEqual(property.Type, tt.typ) {
+				t.Errorf("type = %v, want %v", property.Type, tt.typ)
+			}
+			if tt.def == "" {
+				if property.Default != nil {
+					t.Errorf("default = %s, want none", property.Default)
+				}
+			} else if !equalJSON(t, property.Default, []byte(tt.def)) {
+				t.Errorf("default = %s, want %s", property.Default, tt.def)
+			}
+			if property.ReadOnly != tt.readOnly {
+				t.Errorf("readOnly = %t, want %t", property.ReadOnly, tt.readOnly)
+			}
+			if !reflect.DeepEqual(property.MinItems, tt.minItems) {
+				t.Errorf("minItems = %v, want %v", property.MinItems, tt.minItems)
+			}
+			if !reflect.DeepEqual(property.MaxLength, tt.maxLength) {
+				t.Errorf("maxLength = %v, want %v", property.MaxLength, tt.maxLength)
+			}
+		})
+	}
+}
+
+func TestGetTypeSchema(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{
+			name: "primitive",
+			expr: `number`,
+			want: `{"type":"number"}`,
+		},
+		{
+			name: "set",
+			expr: `set(string)`,
+			want: `{"type":"array","items":{"type":"string"},"uniqueItems":true}`,
+		},
+		{
+			name: "map",
+			expr: `map(bool)`,
+			want: `{"type":"object","additionalProperties":{"type":"boolean"}}`,
+		},
+		{
+			name: "tuple",
+			expr: `tuple([string, number])`,
+			want: `{"type":"array","minItems":2,"maxItems":2}`,
+		},
+		{
+			name: "any",
+			expr: `any`,
+			want: `{}`,
+		},
+		{
+			name: "optional attributes and their defaults",
+			expr: `object({name = string, size = optional(number, 8), tags = optional(map(string))})`,
+			want: `{
+				"type": "object",
+				"properties": {
+					"name": {"type": "string"},
+					"size": {"type": "number", "default": 8},
+					"tags": {"type": "object", "additionalProperties": {"type": "string"}}
+				},
+				"required": ["name"]
+			}`,
+		},
+		{
+			name: "defaults of nested objects",
+			expr: `list(object({spec = optional(object({enabled = optional(bool, true)}), {})}))`,
+			want: `{
+				"type": "array",
+				"items": {
+					"type": "object",
+					"properties": {
+						"spec": {
+							"type": "object",
+							"properties": {"enabled": {"type": "boolean", "default": true}},
+							"default": {"enabled": true}
+						}
+					}
+				}
+			}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, diags := hclsyntax.ParseExpression([]byte(tt.expr), "test.tf", hcl.Pos{Line: 1, Column: 1})
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+			ty, defaults, diags := typeexpr.TypeConstraintWithDefaults(expr)
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+
+			got, err := json.Marshal(getTypeSchema(ty, defaults))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalJSON(t, got, []byte(tt.want)) {
+				t.Errorf("getTypeSchema(%s) = %s, want %s", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+// equalJSON - whether a and b are the same JSON value
+func equalJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+
+	var av, bv interface{}
+	if err := json.Unmarshal(a, &av); err != nil {
+		t.Fatalf("%s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &bv); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	return reflect.DeepEqual(av, bv)
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// ctx - cancelled when klarista is interrupted
+var ctx = context.Background()
+
+// interrupts - the interrupt handler installed by Execute
+var interrupts = &InterruptHandler{}
+
+// InterruptHandler - cancels ctx on SIGINT or SIGTERM, and forwards the signal to the running command
+//
+// The first signal lets the running command exit cleanly, after which
+// klarista stops before the next command and still writes the local state
+// to the remote state. A second signal kills the running command, and a
+// third exits immediately.
+type InterruptHandler struct {
+	mu       sync.Mutex
+	cancel   func()
+	signals  []os.Signal
+	process  *os.Process
+	ownGroup bool
+}
+
+// Start - handle interrupts until stop is called
+func (h *InterruptHandler) Start() (stop func()) {
+	var cancel func()
+	ctx, cancel = context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				h.handle(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
+
+func (h *InterruptHandler) handle(sig os.Signal) {
+	h.mu.Lock()
+	h.signals = append(h.signals, sig)
+	count := len(h.signals)
+	process, ownGroup := h.process, h.ownGroup
+	h.mu.Unlock()
+
+	switch count {
+	case 1:
+		Logger.Warnf("Received %s, stopping after the running command exits. Interrupt again to kill it", signalName(sig))
+		h.cancel()
+		// A terminal sends SIGINT to the whole process group, so the command
+		// already received it unless it runs in a group of its own
+		if process != nil && (ownGroup || sig != syscall.SIGINT) {
+			signalProcess(process, ownGroup, sig)
+		}
+	case 2:
+		Logger.Warnf("Received %s again, killing the running command. Interrupt again to exit immediately", signalName(sig))
+		if process != nil {
+			signalProcess(process, ownGroup, syscall.SIGKILL)
+		}
+	default:
+		Logger.Errorf("Received %s, exiting without writing the state", signalName(sig))
+		os.Exit(getExitCode(&InterruptedError{Signal: sig}))
+	}
+}
+
+func signalName(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGINT:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	}
+	return sig.String()
+}
+
+func signalProcess(process *os.Process, ownGroup bool, sig os.Signal) {
+	var err error
+	if ownGroup {
+		// Signal the whole group, so that commands started by the command are stopped too
+		err = syscall.Kill(-process.Pid, sig.(syscall.Signal))
+	} else {
+		err = process.Signal(sig)
+	}
+	if err != nil {
+		Logger.Debugf("Failed to signal process %d, %v", process.Pid, err)
+	}
+}
+
+// Signal - the first signal received, or nil
+func (h *InterruptHandler) Signal() os.Signal {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.signals) == 0 {
+		return nil
+	}
+	return h.signals[0]
+}
+
+// track - forward signals to process until untrack is called
+func (h *InterruptHandler) track(process *os.Process, ownGroup bool) (untrack func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.process = process
+	h.ownGroup = ownGroup
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.process = nil
+	}
+}
+
+// checkInterrupted - an InterruptedError if klarista was interrupted
+func checkInterrupted() error {
+	if sig := interrupts.Signal(); sig != nil {
+		return &InterruptedError{Signal: sig}
+	}
+	return nil
+}
+
+// sleep - wait for d, unless klarista is interrupted
+func sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return checkInterrupted()
+	}
+}
+
+// isInteractive - whether klarista's stdin is a terminal
+//
+// Commands run interactively share klarista's process group, so that they
+// can prompt for input. Otherwise they get a group of their own, and only
+// receive the signals klarista forwards.
+func isInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
@@ -1,9 +1,10 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"path"
-	"strings"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 )
@@ -15,41 +16,344 @@ var stateCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 }
 
+// setStateAwsEnv - read the cluster inputs and configure the AWS environment for a state command
+func setStateAwsEnv(localStateDir string) error {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if !rootCmd.PersistentFlags().Changed("input") {
+		if inputs, err = getInitialInputs(localStateDir); err != nil {
+			return err
+		}
+	}
+
+	// State commands may run on a machine that has never seen the cluster
+	if len(inputs) == 0 {
+		Logger.Warn("No input files were found; using the AWS profile and region from the environment")
+		return nil
+	}
+
+	assetWriter := NewAssetWriter(pwd, localStateDir, assets)
+	inputProcessor := NewInputProcessor(assetWriter)
+
+	if err := assetWriter.Digest("tf_vars/*"); err != nil {
+		return err
+	}
+
+	inputIds, err := inputProcessor.Digest(inputs)
+	if err != nil {
+		return err
+	}
+
+	return setAwsEnv(localStateDir, inputIds)
+}
+
 // statePushCmd represents the state push command
 var statePushCmd = &cobra.Command{
 	Use:   "push <name>",
 	Short: "Push local klarista state to remote",
-	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
 		name := args[0]
 		localStateDir := path.Join(os.TempDir(), name)
-		stateBucketName := strings.ReplaceAll(name, ".", "-") + "-state"
 
-		pwd, err := os.Getwd()
+		force, _ := cmd.Flags().GetBool("force")
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		return useRemoteState(name, RemoteStateOptions{Write: true, Force: force}, func() error {
+			// noop
+			return nil
+		})
+	},
+}
+
+// stateUnlockCmd represents the state unlock command
+var stateUnlockCmd = &cobra.Command{
+	Use:   "unlock <name>",
+	Short: "Release the remote klarista state lock",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		force, _ := cmd.Flags().GetBool("force")
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		backend, err := getStateBackend(name)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		if !rootCmd.PersistentFlags().Changed("input") {
-			inputs = getInitialInputs(localStateDir)
+		lock, err := backend.LockInfo()
+		if err != nil {
+			return err
 		}
 
-		assetWriter := NewAssetWriter(pwd, localStateDir, assets)
-		inputProcessor := NewInputProcessor(assetWriter)
+		if lock == nil {
+			Logger.Infof(`State for cluster "%s" is not locked`, name)
+			return nil
+		}
 
-		assetWriter.Digest("tf_vars/*")
+		if !force && !lock.Expired() && !lock.IsOwnedByCurrentUser() {
+			return NewStateError("State is locked by %s. Use --force to release it anyway", lock)
+		}
 
-		inputIds := inputProcessor.Digest(inputs)
+		if err = backend.Unlock(lock, true); err != nil {
+			return err
+		}
 
-		setAwsEnv(localStateDir, inputIds)
+		Logger.Infof("Released state lock held by %s", lock)
+		return nil
+	},
+}
 
-		useRemoteState(name, stateBucketName, false, true, func() {
-			// noop
+// statePullCmd represents the state pull command
+var statePullCmd = &cobra.Command{
+	Use:   "pull <name>",
+	Short: "Pull remote klarista state to local",
+	Long:  "Pull remote klarista state into the local state directory, or save the state tarball to a file with --output.",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		output, _ := cmd.Flags().GetString("output")
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		if output == "" {
+			err = useRemoteState(name, RemoteStateOptions{Read: true}, func() error {
+				// noop
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			Logger.Infof(`State written to "%s"`, localStateDir)
+			return nil
+		}
+
+		output, err = filepath.Abs(output)
+		if err != nil {
+			return err
+		}
+
+		backend, err := getStateBackend(name)
+		if err != nil {
+			return err
+		}
+
+		current, err := statRemoteState(backend)
+		if err != nil {
+			return err
+		}
+		if !current.Exists {
+			return NewStateError("No state found at %s", backend.Location(remoteStateKey))
+		}
+
+		err = downloadRemoteStateVersion(backend, current, output)
+		if err != nil {
+			return fmt.Errorf("Failed to download file, %v", err)
+		}
+
+		if _, err = checkStateArchive(output); err != nil {
+			return err
+		}
+
+		Logger.Infof(`State %s written to "%s"`, current, output)
+		return nil
+	},
+}
+
+// stateImportCmd represents the state import command
+var stateImportCmd = &cobra.Command{
+	Use:   "import <name> <file.tar>",
+	Short: "Seed remote klarista state from a state tarball",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(2)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		force, _ := cmd.Flags().GetBool("force")
+
+		archivePath, err := filepath.Abs(args[1])
+		if err != nil {
+			return err
+		}
+
+		// Make sure the archive is readable and intact before touching the remote state
+		if _, err = checkStateArchive(archivePath); err != nil {
+			return NewInputError(`"%s" is not a valid state tarball, %v`, archivePath, err)
+		}
+		digests, err := digestTarFile(archivePath)
+		if err != nil {
+			return NewInputError(`"%s" is not a valid state tarball, %v`, archivePath, err)
+		}
+		if len(digests) == 0 {
+			return NewInputError(`"%s" is empty`, archivePath)
+		}
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		backend, err := getStateBackend(name)
+		if err != nil {
+			return err
+		}
+
+		lock := NewStateLock(lockTTL)
+		if err = acquireStateLock(backend, name, lock); err != nil {
+			return err
+		}
+		defer func() {
+			if err := releaseStateLock(backend, lock); err != nil {
+				Logger.Errorf("Failed to release state lock, %v", err)
+			}
+		}()
+
+		if err = checkStateDowngrade(backend); err != nil {
+			return err
+		}
+
+		current, err := statRemoteState(backend)
+		if err != nil {
+			return err
+		}
+		if current.Exists && !force {
+			return NewStateError(
+				`State already exists at %s (%s). Use --force to replace it`,
+				backend.Location(remoteStateKey),
+				current,
+			)
+		}
+
+		// Record the layout of the imported state, so that older klaristas refuse to overwrite it
+		stateVersion, err := readArchiveStateVersion(archivePath)
+		if err != nil {
+			return NewInputError(`"%s" is not a valid state tarball, %v`, archivePath, err)
+		}
+		metadata := getRemoteStateMetadata(stateVersion)
+
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if _, err = backend.Write(remoteStateKey, file, metadata); err != nil {
+			return fmt.Errorf("Failed to upload file, %v", err)
+		}
+
+		Logger.Infof(`Imported %d files from "%s" to %s`, len(digests), archivePath, backend.Location(remoteStateKey))
+		return nil
+	},
+}
+
+// stateRekeyCmd represents the state rekey command
+var stateRekeyCmd = &cobra.Command{
+	Use:   "rekey <name>",
+	Short: "Re-encrypt remote klarista state with a new data key",
+	Long: `Re-encrypt the current remote klarista state with a new data key wrapped by the configured --state-encryption.
+
+Use it to encrypt plain text state, or to rotate the KMS key or passphrase. When rotating a passphrase, set ` + stateOldPassphraseEnv + ` to the old one and ` + statePassphraseEnv + ` to the new one. Earlier versions of the state keep their original encryption.`,
+	Args: clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		if stateEncryption == stateEncryptionNone {
+			return NewInputError("State encryption is not configured. Use --state-encryption %s or %s", stateEncryptionKms, stateEncryptionPassphrase)
+		}
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		backend, err := getStateBackend(name)
+		if err != nil {
+			return err
+		}
+
+		lock := NewStateLock(lockTTL)
+		if err := acquireStateLock(backend, name, lock); err != nil {
+			return err
+		}
+		defer func() {
+			if err := releaseStateLock(backend, lock); err != nil {
+				Logger.Errorf("Failed to release state lock, %v", err)
+			}
+		}()
+
+		if err := checkStateDowngrade(backend); err != nil {
+			return err
+		}
+
+		current, err := statRemoteState(backend)
+		if err != nil {
+			return err
+		}
+		if !current.Exists {
+			return NewStateError("No state found at %s", backend.Location(remoteStateKey))
+		}
+
+		return useTempDir(func(tmpdir string) error {
+			fp := path.Join(tmpdir, remoteStateKey)
+			if err := downloadRemoteStateVersion(backend, current, fp); err != nil {
+				return fmt.Errorf("Failed to download file, %v", err)
+			}
+
+			stateVersion, err := readArchiveStateVersion(fp)
+			if err != nil {
+				return err
+			}
+
+			file, err := os.Open(fp)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			written, err := backend.Write(remoteStateKey, file, getRemoteStateMetadata(stateVersion))
+			if err != nil {
+				return fmt.Errorf("Failed to upload file, %v", err)
+			}
+
+			Logger.Infof(`Re-encrypted state %s of cluster "%s" as %s using %s`, current, name, written.Version(), stateEncryption)
+			return nil
 		})
 	},
 }
 
 func init() {
+	stateCmd.AddCommand(statePullCmd)
+	statePullCmd.Flags().StringP("output", "o", "", "Save the state tarball to this file instead of unpacking it")
+	stateCmd.AddCommand(stateImportCmd)
+	stateImportCmd.Flags().Bool("force", false, "Replace existing remote state")
 	stateCmd.AddCommand(statePushCmd)
+	stateCmd.AddCommand(stateUnlockCmd)
+	stateCmd.AddCommand(stateRekeyCmd)
+	statePushCmd.Flags().Bool("force", false, "Overwrite the remote state even if it changed since it was last read")
+	stateUnlockCmd.Flags().Bool("force", false, "Release the lock even if it is held by another user and has not expired")
 	rootCmd.AddCommand(stateCmd)
 }
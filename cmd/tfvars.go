@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	hcljson "github.com/hashicorp/hcl/v2/json"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// errTfvarNotStatic - returned when a variable can't be evaluated without terraform
+var errTfvarNotStatic = errors.New("not a static value")
+
+// Input file formats, detected by extension
+const (
+	inputFormatHCL  = "hcl"
+	inputFormatJSON = "json"
+	inputFormatYAML = "yaml"
+)
+
+// AwsSettings - the AWS settings of a cluster, set by the tf_vars module
+type AwsSettings struct {
+	Profile          string
+	Region           string
+	EncryptionKeyArn string
+}
+
+// Tfvars - the variables set by tfvars files
+type Tfvars map[string]*hcl.Attribute
+
+// parseTfvarsFiles - read tfvars files like terraform -var-file does, values in later files replacing earlier ones
+func parseTfvarsFiles(files []string) (Tfvars, error) {
+	vars := Tfvars{}
+
+	for _, fp := range files {
+		src, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return nil, err
+		}
+
+		fileVars, err := parseTfvars(src, fp)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, attr := range fileVars {
+			vars[name] = attr
+		}
+	}
+
+	return vars, nil
+}
+
+// parseTfvars - read the variables set by one tfvars, JSON or YAML file
+func parseTfvars(src []byte, filename string) (Tfvars, error) {
+	var file *hcl.File
+	var diags hcl.Diagnostics
+
+	if getInputFormat(filename) == inputFormatHCL {
+		file, diags = hclsyntax.ParseConfig(src, filename, hcl.Pos{Line: 1, Column: 1})
+	} else {
+		data, err := convertInput(src, filename)
+		if err != nil {
+			return nil, err
+		}
+		file, diags = hcljson.Parse(data, filename)
+	}
+	if diags.HasErrors() {
+		return nil, NewInputError("Failed to parse %s, %s", filename, diags.Error())
+	}
+
+	attrs, diags := file.Body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, NewInputError("Failed to parse %s, %s", filename, diags.Error())
+	}
+
+	return Tfvars(attrs), nil
+}
+
+// getInputFormat - the format of an input file, from its extension
+func getInputFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return inputFormatJSON
+	case ".yaml", ".yml":
+		return inputFormatYAML
+	}
+	return inputFormatHCL
+}
+
+// getInputID - the name of the i-th input file in the inputs dirs
+//
+// terraform reads -var-file files ending in .json as JSON, so JSON and
+// converted YAML inputs are named NNN.tfvars.json.
+func getInputID(i int, filename string) string {
+	if getInputFormat(filename) == inputFormatHCL {
+		return fmt.Sprintf("%03d.tfvars", i)
+	}
+	return fmt.Sprintf("%03d.tfvars.json", i)
+}
+
+// convertInput - the contents of an input file as terraform reads them, converting YAML to JSON
+func convertInput(src []byte, filename string) ([]byte, error) {
+	if getInputFormat(filename) != inputFormatYAML {
+		return src, nil
+	}
+
+	data, err := yaml.YAMLToJSON(src)
+	if err != nil {
+		return nil, NewInputError("Failed to parse %s, %v", filename, err)
+	}
+	return data, nil
+}
+
+// String - the value of a string variable, or TF_VAR_<name> if no file sets it
+//
+// Like terraform, numbers and bools are converted to strings.
+func (v Tfvars) String(name string) (value string, ok bool, err error) {
+	attr, found := v[name]
+	if !found {
+		value, ok = os.LookupEnv("TF_VAR_" + name)
+		return value, ok, nil
+	}
+
+	val, diags := attr.Expr.Value(nil)
+	if diags.HasErrors() || !val.IsWhollyKnown() {
+		return "", false, fmt.Errorf("Variable %s at %s is %w", name, attr.NameRange, errTfvarNotStatic)
+	}
+
+	val, err = convert.Convert(val, cty.String)
+	if err != nil {
+		return "", false, NewInputError("Variable %s at %s must be a string, %v", name, attr.NameRange, err)
+	}
+
+	if val.IsNull() {
+		return "", true, nil
+	}
+	return val.AsString(), true, nil
+}
+
+// readAwsSettings - read the AWS settings from the input tfvars in the tf_vars dir
+func readAwsSettings(tfVarsDir string, inputIds []string) (*AwsSettings, error) {
+	var files []string
+	for _, id := range inputIds {
+		files = append(files, path.Join(tfVarsDir, "inputs", id))
+	}
+
+	vars, err := parseTfvarsFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &AwsSettings{}
+
+	for _, v := range []struct {
+		name     string
+		value    *string
+		required bool
+	}{
+		{"aws_profile", &settings.Profile, true},
+		{"aws_region", &settings.Region, true},
+		{"encryption_key_arn", &settings.EncryptionKeyArn, false},
+	} {
+		value, ok, err := vars.String(v.name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok && v.required {
+			return nil, NewInputError(`No value for required variable "%s". Set it in an input file`, v.name)
+		}
+		*v.value = value
+	}
+
+	return settings, nil
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestReadAwsSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		// files are the contents of the input files in the inputs dir, in order
+		files []string
+		// ids are the names of the input files, 000.tfvars, 001.tfvars, ... by default
+		ids  []string
+		env  map[string]string
+		want *AwsSettings
+		// wantErr is errTfvarNotStatic, or an *InputError
+		wantErr error
+	}{
+		{
+			name:  "one file",
+			files: []string{`aws_profile = "dev"` + "\n" + `aws_region = "us-east-1"`},
+			want:  &AwsSettings{Profile: "dev", Region: "us-east-1"},
+		},
+		{
+			name: "last file wins",
+			files: []string{
+				`aws_profile = "dev"` + "\n" + `aws_region = "us-east-1"` + "\n" + `encryption_key_arn = "arn:dev"`,
+				`aws_region = "eu-west-1"`,
+				`aws_region = "eu-central-1"`,
+			},
+			want: &AwsSettings{Profile: "dev", Region: "eu-central-1", EncryptionKeyArn: "arn:dev"},
+		},
+		{
+			name: "JSON and converted YAML files",
+			files: []string{
+				`aws_profile = "dev"` + "\n" + `aws_region = "us-east-1"`,
+				`{"aws_region": "eu-west-1"}`,
+			},
+			ids:  []string{"000.tfvars", "001.tfvars.json"},
+			want: &AwsSettings{Profile: "dev", Region: "eu-west-1"},
+		},
+		{
+			name:  "numbers are converted to strings",
+			files: []string{`aws_profile = 123456789012` + "\n" + `aws_region = "us-east-1"`},
+			want:  &AwsSettings{Profile: "123456789012", Region: "us-east-1"},
+		},
+		{
+			name:  "TF_VAR_ fallback",
+			files: []string{`aws_profile = "dev"`},
+			env:   map[string]string{"TF_VAR_aws_region": "eu-west-1", "TF_VAR_encryption_key_arn": "arn:env"},
+			want:  &AwsSettings{Profile: "dev", Region: "eu-west-1", EncryptionKeyArn: "arn:env"},
+		},
+		{
+			name:  "files win over TF_VAR_",
+			files: []string{`aws_profile = "dev"` + "\n" + `aws_region = "us-east-1"`},
+			env:   map[string]string{"TF_VAR_aws_region": "eu-west-1"},
+			want:  &AwsSettings{Profile: "dev", Region: "us-east-1"},
+		},
+		{
+			name:    "reference",
+			files:   []string{`aws_profile = "dev"` + "\n" + `aws_region = var.region`},
+			wantErr: errTfvarNotStatic,
+		},
+		{
+			name:    "function call",
+			files:   []string{`aws_profile = lower("DEV")` + "\n" + `aws_region = "us-east-1"`},
+			wantErr: errTfvarNotStatic,
+		},
+		{
+			name:    "missing required variable",
+			files:   []string{`aws_profile = "dev"`},
+			wantErr: &InputError{},
+		},
+		{
+			name:    "not a string",
+			files:   []string{`aws_profile = "dev"` + "\n" + `aws_region = ["us-east-1"]`},
+			wantErr: &InputError{},
+		},
+		{
+			name:    "invalid syntax",
+			files:   []string{`aws_profile = `},
+			wantErr: &InputError{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"TF_VAR_aws_profile", "TF_VAR_aws_region", "TF_VAR_encryption_key_arn"} {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			tfVarsDir := t.TempDir()
+			if err := os.Mkdir(path.Join(tfVarsDir, "inputs"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			ids := tt.ids
+			if ids == nil {
+				for i := range tt.files {
+					ids = append(ids, getInputID(i, "input.tfvars"))
+				}
+			}
+			for i, content := range tt.files {
+				if err := ioutil.WriteFile(path.Join(tfVarsDir, "inputs", ids[i]), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := readAwsSettings(tfVarsDir, ids)
+
+			switch wantErr := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("readAwsSettings() = %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("readAwsSettings() = %+v, want %+v", got, tt.want)
+				}
+			case *InputError:
+				if !errors.As(err, &wantErr) {
+					t.Errorf("readAwsSettings() = %v, want an InputError", err)
+				}
+			default:
+				if !errors.Is(err, wantErr) {
+					t.Errorf("readAwsSettings() = %v, want %v", err, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestGetInputIDAndConvertInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		src      string
+		wantID   string
+		// want is the converted input, or empty if an InputError is expected
+		want string
+	}{
+		{
+			name:     "tfvars",
+			filename: "input.tfvars",
+			src:      `aws_region = "us-east-1"`,
+			wantID:   "003.tfvars",
+			want:     `aws_region = "us-east-1"`,
+		},
+		{
+			name:     "unknown extension is read as tfvars",
+			filename: "input.hcl",
+			src:      `aws_region = "us-east-1"`,
+			wantID:   "003.tfvars",
+			want:     `aws_region = "us-east-1"`,
+		},
+		{
+			name:     "JSON",
+			filename: "input.json",
+			src:      `{"aws_region": "us-east-1"}`,
+			wantID:   "003.tfvars.json",
+			want:     `{"aws_region": "us-east-1"}`,
+		},
+		{
+			name:     "YAML",
+			filename: "input.yaml",
+			src:      "aws_region: us-east-1\nprivate_subnets:\n  - cidr_block: 172.70.0.0/27\n    availability_zone: us-east-1a\n",
+			wantID:   "003.tfvars.json",
+			want:     `{"aws_region":"us-east-1","private_subnets":[{"availability_zone":"us-east-1a","cidr_block":"172.70.0.0/27"}]}`,
+		},
+		{
+			name:     "YAML with an upper case extension",
+			filename: "INPUT.YML",
+			src:      "aws_region: us-east-1\n",
+			wantID:   "003.tfvars.json",
+			want:     `{"aws_region":"us-east-1"}`,
+		},
+		{
+			name:     "invalid YAML",
+			filename: "input.yaml",
+			src:      "aws_region: [us-east-1\n",
+			wantID:   "003.tfvars.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := getInputID(3, tt.filename); id != tt.wantID {
+				t.Errorf("getInputID() = %s, want %s", id, tt.wantID)
+			}
+
+			got, err := convertInput([]byte(tt.src), tt.filename)
+			if tt.want == "" {
+				var inputErr *InputError
+				if !errors.As(err, &inputErr) {
+					t.Errorf("convertInput() = %v, want an InputError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("convertInput() = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("convertInput() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// validateInputCmd represents the validate-input command
+var validateInputCmd = &cobra.Command{
+	Use:   "validate-input <name>",
+	Short: "Check the cluster inputs",
+	Long:  "Check the cluster inputs against the variables of the cluster terraform, without running terraform or touching AWS. Reports every problem with the file and line that set the value. create runs the same checks before it starts.",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverError(&err)
+
+		name := args[0]
+
+		if !rootCmd.PersistentFlags().Changed("input") {
+			localStateDir, err := getLocalStateDir(name)
+			if err != nil {
+				return err
+			}
+			if inputs, err = getInitialInputs(localStateDir); err != nil {
+				return err
+			}
+		}
+		if len(inputs) == 0 {
+			return NewInputError(`No input files were found. You must explicitly pass "--input <file>"`)
+		}
+
+		if _, err := validateClusterInputs(name, inputs); err != nil {
+			return err
+		}
+
+		Logger.Infof(`The inputs of cluster "%s" are valid`, name)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateInputCmd)
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Embedded cluster terraform files that declare and default the cluster inputs
+const (
+	clusterVariablesAsset = "tf/variables.tf"
+	clusterDefaultsAsset  = "tf/default.auto.tfvars"
+)
+
+// ClusterVariable - a variable declared by the cluster terraform
+type ClusterVariable struct {
+	Name        string
+	Description string
+	Type        cty.Type
+	// TypeSource is the type constraint as written, e.g. list(object({...}))
+	TypeSource string
+	// TypeDefaults are the defaults of optional object attributes, if any
+	TypeDefaults *typeexpr.Defaults
+	// Default is the value of the default argument, or nil for a required variable
+	Default     hcl.Expression
+	Validations []*ClusterVariableValidation
+	Range       hcl.Range
+}
+
+// ClusterVariableValidation - a validation block of a variable
+type ClusterVariableValidation struct {
+	Condition hcl.Expression
+	// ConditionSource is the condition as written
+	ConditionSource string
+	ErrorMessage    string
+}
+
+var variableBlockSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "variable", LabelNames: []string{"name"}},
+	},
+}
+
+var variableSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "type"},
+		{Name: "default"},
+		{Name: "description"},
+		{Name: "nullable"},
+		{Name: "sensitive"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "validation"},
+	},
+}
+
+var validationSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "condition", Required: true},
+		{Name: "error_message", Required: true},
+	},
+}
+
+// getClusterVariables - the variables declared by the embedded cluster terraform, in declaration order
+func getClusterVariables() ([]*ClusterVariable, error) {
+	src, err := assets.Find(clusterVariablesAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	variables, diags := parseVariables(src, clusterVariablesAsset)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("Failed to parse %s, %s", clusterVariablesAsset, diags.Error())
+	}
+	return variables, nil
+}
+
+// parseVariables - read the variable blocks of a terraform file
+func parseVariables(src []byte, filename string) ([]*ClusterVariable, hcl.Diagnostics) {
+	file, diags := hclsyntax.ParseConfig(src, filename, hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	content, _, diags := file.Body.PartialContent(variableBlockSchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	var variables []*ClusterVariable
+
+	for _, block := range content.Blocks {
+		body, moreDiags := block.Body.Content(variableSchema)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			continue
+		}
+
+		variable := &ClusterVariable{
+			Name:  block.Labels[0],
+			Type:  cty.DynamicPseudoType,
+			Range: block.DefRange,
+		}
+
+		if attr, ok := body.Attributes["type"]; ok {
+			variable.Type, variable.TypeDefaults, moreDiags = typeexpr.TypeConstraintWithDefaults(attr.Expr)
+			variable.TypeSource = getExprSource(attr.Expr, src)
+			diags = append(diags, moreDiags...)
+		}
+
+		if attr, ok := body.Attributes["default"]; ok {
+			variable.Default = attr.Expr
+		}
+
+		if attr, ok := body.Attributes["description"]; ok {
+			description, moreDiags := attr.Expr.Value(nil)
+			diags = append(diags, moreDiags...)
+			if !moreDiags.HasErrors() && description.Type() == cty.String && !description.IsNull() {
+				variable.Description = description.AsString()
+			}
+		}
+
+		for _, validationBlock := range body.Blocks {
+			validationBody, moreDiags := validationBlock.Body.Content(validationSchema)
+			diags = append(diags, moreDiags...)
+			if moreDiags.HasErrors() {
+				continue
+			}
+
+			message, moreDiags := validationBody.Attributes["error_message"].Expr.Value(nil)
+			diags = append(diags, moreDiags...)
+			if moreDiags.HasErrors() || message.Type() != cty.String || message.IsNull() {
+				continue
+			}
+
+			variable.Validations = append(variable.Validations, &ClusterVariableValidation{
+				Condition:       validationBody.Attributes["condition"].Expr,
+				ConditionSource: getExprSource(validationBody.Attributes["condition"].Expr, src),
+				ErrorMessage:    message.AsString(),
+			})
+		}
+
+		variables = append(variables, variable)
+	}
+
+	return variables, diags
+}
+
+// getExprSource - the source of expr, reindented
+func getExprSource(expr hcl.Expression, src []byte) string {
+	return string(hclwrite.Format(expr.Range().SliceBytes(src)))
+}
+
+// getClusterDefaults - the values set by the embedded default.auto.tfvars, which terraform loads automatically
+func getClusterDefaults() (Tfvars, error) {
+	src, err := assets.Find(clusterDefaultsAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTfvars(src, clusterDefaultsAsset)
+}
+
+// sortedTfvarNames - the names of the variables set by vars, sorted
+func sortedTfvarNames(vars Tfvars) []string {
+	var names []string
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
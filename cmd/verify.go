@@ -0,0 +1,647 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+)
+
+// stateSigningKeyEnv - environment variable holding the key used to sign state manifests
+const stateSigningKeyEnv = "KLARISTA_STATE_SIGNING_KEY"
+
+// stateSignatureAlgorithm - algorithm of state manifest signatures
+const stateSignatureAlgorithm = "hmac-sha256"
+
+// StateSignature - signature of a state manifest
+type StateSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Signature string `json:"signature"`
+}
+
+// StateIntegrityError - returned when a state archive does not match its manifest or signature
+type StateIntegrityError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *StateIntegrityError) Error() string {
+	return fmt.Sprintf(
+		"State archive %s failed verification:\n\t%s\nRun \"klarista state fsck <name>\" to check the state history for a good version",
+		e.Path,
+		strings.Join(e.Problems, "\n\t"),
+	)
+}
+
+// StateVerification - result of verifying a state archive
+type StateVerification struct {
+	Manifest  *StateManifest
+	Signature *StateSignature
+	// SignatureVerified is set when the signature was checked against the configured signing key
+	SignatureVerified bool
+	Problems          []string
+	Warnings          []string
+}
+
+// getStateSigningKey - key used to sign and verify state manifests, if any
+func getStateSigningKey() []byte {
+	return []byte(os.Getenv(stateSigningKeyEnv))
+}
+
+// getStateSigningKeyID - short fingerprint identifying a signing key without revealing it
+func getStateSigningKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func computeStateSignature(key, manifest []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(manifest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signStateManifest - sign manifest bytes with the configured signing key, or nil if there is none
+func signStateManifest(manifest []byte) *StateSignature {
+	key := getStateSigningKey()
+	if len(key) == 0 {
+		return nil
+	}
+
+	return &StateSignature{
+		Algorithm: stateSignatureAlgorithm,
+		KeyID:     getStateSigningKeyID(key),
+		Signature: computeStateSignature(key, manifest),
+	}
+}
+
+// verifyStateArchive - check the content of the state archive at fp against its manifest and signature
+//
+// Integrity problems are reported in the result; the error is only set if
+// the archive can't be read at all.
+func verifyStateArchive(fp string) (*StateVerification, error) {
+	result := &StateVerification{}
+
+	var manifestBytes []byte
+	var signatureBytes []byte
+	files := map[string]*StateManifestFile{}
+	var duplicates []string
+
+	err := useStateArchive(fp, func(hdr *tar.Header, r io.Reader) error {
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+
+		switch {
+		case name == stateManifestPath:
+			data, err := ioutil.ReadAll(r)
+			manifestBytes = data
+			return err
+		case name == stateSignaturePath:
+			data, err := ioutil.ReadAll(r)
+			signatureBytes = data
+			return err
+		case hdr.Typeflag == tar.TypeDir:
+			return nil
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(hash, r)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := files[name]; ok {
+			duplicates = append(duplicates, name)
+		}
+		files[name] = &StateManifestFile{
+			Path:   name,
+			Size:   size,
+			SHA256: fmt.Sprintf("%x", hash.Sum(nil)),
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range duplicates {
+		result.Problems = append(result.Problems, fmt.Sprintf(`"%s" appears more than once`, name))
+	}
+
+	if manifestBytes == nil {
+		// A signed archive stripped of its manifest must not pass as one written by an older klarista
+		if len(getStateSigningKey()) > 0 {
+			result.Problems = append(result.Problems, fmt.Sprintf("The state has no manifest, but %s is set", stateSigningKeyEnv))
+		} else {
+			result.Warnings = append(result.Warnings, "The state was written by an older klarista version without a manifest, so it can't be verified")
+		}
+		return result, nil
+	}
+
+	result.Manifest = &StateManifest{}
+	if err = json.Unmarshal(manifestBytes, result.Manifest); err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("The manifest is invalid, %v", err))
+		result.Manifest = nil
+		return result, nil
+	}
+
+	for _, expected := range result.Manifest.Files {
+		actual, ok := files[expected.Path]
+		switch {
+		case !ok:
+			result.Problems = append(result.Problems, fmt.Sprintf(`"%s" is missing`, expected.Path))
+		case actual.Size != expected.Size:
+			result.Problems = append(result.Problems, fmt.Sprintf(`"%s" is %d bytes, expected %d`, expected.Path, actual.Size, expected.Size))
+		case actual.SHA256 != expected.SHA256:
+			result.Problems = append(result.Problems, fmt.Sprintf(`"%s" has sha256 %s, expected %s`, expected.Path, actual.SHA256, expected.SHA256))
+		}
+	}
+
+	listed := result.Manifest.Digests()
+	var unlisted []string
+	for name := range files {
+		if _, ok := listed[name]; !ok {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		result.Problems = append(result.Problems, fmt.Sprintf(`"%s" is not listed in the manifest`, name))
+	}
+
+	key := getStateSigningKey()
+
+	if signatureBytes != nil {
+		result.Signature = &StateSignature{}
+		if err = json.Unmarshal(signatureBytes, result.Signature); err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("The manifest signature is invalid, %v", err))
+			return result, nil
+		}
+	}
+
+	switch {
+	case len(key) == 0 && result.Signature == nil:
+		// Signing is not in use
+	case len(key) == 0:
+		result.Warnings = append(
+			result.Warnings,
+			fmt.Sprintf("The manifest is signed with key %s, but %s is not set, so the signature can't be verified", result.Signature.KeyID, stateSigningKeyEnv),
+		)
+	case result.Signature == nil:
+		result.Problems = append(result.Problems, fmt.Sprintf("The manifest is not signed, but %s is set", stateSigningKeyEnv))
+	case result.Signature.Algorithm != stateSignatureAlgorithm:
+		result.Problems = append(result.Problems, fmt.Sprintf(`Unknown signature algorithm "%s"`, result.Signature.Algorithm))
+	case result.Signature.KeyID != getStateSigningKeyID(key):
+		result.Problems = append(
+			result.Problems,
+			fmt.Sprintf("The manifest is signed with key %s, but %s is key %s", result.Signature.KeyID, stateSigningKeyEnv, getStateSigningKeyID(key)),
+		)
+	case !hmac.Equal([]byte(result.Signature.Signature), []byte(computeStateSignature(key, manifestBytes))):
+		result.Problems = append(result.Problems, "The manifest signature does not match")
+	default:
+		result.SignatureVerified = true
+	}
+
+	return result, nil
+}
+
+// checkStateArchive - verify the state archive at fp, returning a StateIntegrityError if it fails
+func checkStateArchive(fp string) (*StateVerification, error) {
+	result, err := verifyStateArchive(fp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read state archive %s, %v", fp, err)
+	}
+
+	for _, warning := range result.Warnings {
+		Logger.Warn(warning)
+	}
+
+	if len(result.Problems) > 0 {
+		return result, &StateIntegrityError{Path: fp, Problems: result.Problems}
+	}
+
+	return result, nil
+}
+
+// StateCheck - result of one consistency check of the state content
+type StateCheck struct {
+	Path    string
+	Problem string
+	// Repairable is set when "state fsck --repair" can fix the problem
+	Repairable bool
+}
+
+// checkStateContent - report missing or invalid pieces of the state unpacked in dir
+func checkStateContent(dir string) []*StateCheck {
+	var checks []*StateCheck
+
+	report := func(fpath, problem string, repairable bool) {
+		checks = append(checks, &StateCheck{Path: fpath, Problem: problem, Repairable: repairable})
+	}
+
+	readJSON := func(fpath string, v interface{}) bool {
+		data, err := ioutil.ReadFile(path.Join(dir, fpath))
+		if err != nil {
+			if os.IsNotExist(err) {
+				report(fpath, "missing", false)
+			} else {
+				report(fpath, err.Error(), false)
+			}
+			return false
+		}
+		if err = json.Unmarshal(data, v); err != nil {
+			report(fpath, fmt.Sprintf("invalid JSON, %v", err), false)
+			return false
+		}
+		return true
+	}
+
+	inputs, _ := ioutil.ReadDir(path.Join(dir, "tf_vars", "inputs"))
+	if len(inputs) == 0 {
+		report("tf_vars/inputs", "no inputs", false)
+	}
+
+	if isStateBucketManaged() {
+		var tfState map[string]interface{}
+		readJSON("tf_state/terraform.tfstate", &tfState)
+	}
+
+	var tfState struct {
+		Outputs map[string]struct {
+			Value interface{} `json:"value"`
+		} `json:"outputs"`
+	}
+	hasTfState := readJSON("tf/terraform.tfstate", &tfState)
+
+	outputPath := "tf/output.json"
+	outputBytes, err := ioutil.ReadFile(path.Join(dir, outputPath))
+	var output map[string]interface{}
+	switch {
+	case os.IsNotExist(err):
+		report(outputPath, "missing", hasTfState)
+	case err != nil:
+		report(outputPath, err.Error(), false)
+	default:
+		if err = json.Unmarshal(outputBytes, &output); err != nil {
+			report(outputPath, fmt.Sprintf("invalid JSON, %v", err), hasTfState)
+		} else if hasTfState {
+			for name := range tfState.Outputs {
+				if _, ok := output[name]; !ok {
+					report(outputPath, fmt.Sprintf(`output "%s" of tf/terraform.tfstate is missing`, name), true)
+					break
+				}
+			}
+		}
+	}
+
+	kubeconfigPath := "kubeconfig.yaml"
+	kubeconfigBytes, err := ioutil.ReadFile(path.Join(dir, kubeconfigPath))
+	switch {
+	case os.IsNotExist(err):
+		report(kubeconfigPath, "missing", false)
+	case err != nil:
+		report(kubeconfigPath, err.Error(), false)
+	default:
+		var kubeconfig map[string]interface{}
+		if err = yaml.Unmarshal(kubeconfigBytes, &kubeconfig); err != nil {
+			report(kubeconfigPath, fmt.Sprintf("invalid YAML, %v", err), false)
+		}
+	}
+
+	return checks
+}
+
+// repairStateContent - regenerate tf/output.json from the outputs in tf/terraform.tfstate
+func repairStateContent(dir string) error {
+	data, err := ioutil.ReadFile(path.Join(dir, "tf", "terraform.tfstate"))
+	if err != nil {
+		return err
+	}
+
+	var tfState struct {
+		Outputs map[string]struct {
+			Value interface{} `json:"value"`
+		} `json:"outputs"`
+	}
+	if err = json.Unmarshal(data, &tfState); err != nil {
+		return err
+	}
+
+	output := map[string]interface{}{}
+	for name, o := range tfState.Outputs {
+		output[name] = o.Value
+	}
+
+	outputBytes, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, "tf", "output.json"), outputBytes, 0644)
+}
+
+// formatStateVerification - describe the result of verifying a state archive
+func formatStateVerification(result *StateVerification) []string {
+	var lines []string
+
+	if result.Manifest != nil {
+		lines = append(
+			lines,
+			fmt.Sprintf("Format version:  %d", result.Manifest.FormatVersion),
+			fmt.Sprintf("State version:   %d", result.Manifest.StateVersion),
+			fmt.Sprintf("Written by:      klarista %s", result.Manifest.WriterVersion),
+			fmt.Sprintf("Written at:      %s", result.Manifest.CreatedAt.Format("2006-01-02T15:04:05Z07:00")),
+			fmt.Sprintf("Files:           %d", len(result.Manifest.Files)),
+		)
+	}
+
+	switch {
+	case result.Signature == nil:
+		lines = append(lines, "Signature:       none")
+	case result.SignatureVerified:
+		lines = append(lines, fmt.Sprintf("Signature:       verified (key %s)", result.Signature.KeyID))
+	default:
+		lines = append(lines, fmt.Sprintf("Signature:       not verified (key %s)", result.Signature.KeyID))
+	}
+
+	for _, warning := range result.Warnings {
+		lines = append(lines, "warning: "+warning)
+	}
+	for _, problem := range result.Problems {
+		lines = append(lines, "error: "+problem)
+	}
+
+	return lines
+}
+
+// stateVerifyCmd represents the state verify command
+var stateVerifyCmd = &cobra.Command{
+	Use:   "verify <name> [version]",
+	Short: "Verify remote klarista state against its manifest and signature",
+	Long:  "Verify that a version of the remote klarista state (by default, the current one) is complete and matches its manifest and signature.",
+	Args:  clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		backend, err := getStateBackend(name)
+		if err != nil {
+			return err
+		}
+
+		var version *RemoteStateVersion
+		if len(args) > 1 {
+			object, err := findRemoteStateVersion(backend, args[1])
+			if err != nil {
+				return err
+			}
+			version = object.Version()
+		} else {
+			current, err := statRemoteState(backend)
+			if err != nil {
+				return err
+			}
+			if !current.Exists {
+				return NewStateError("No state found at %s", backend.Location(remoteStateKey))
+			}
+			version = current
+		}
+
+		return useTempDir(func(tmpdir string) error {
+			fp := path.Join(tmpdir, remoteStateKey)
+			if err := downloadRemoteStateVersion(backend, version, fp); err != nil {
+				return fmt.Errorf("Failed to download file, %v", err)
+			}
+
+			result, err := verifyStateArchive(fp)
+			if err != nil {
+				return NewStateError("State %s can't be read, %v", version, err)
+			}
+
+			fmt.Printf("State %s\n", version)
+			fmt.Println(strings.Join(formatStateVerification(result), "\n"))
+
+			if len(result.Problems) > 0 {
+				return NewStateError("State %s failed verification", version)
+			}
+			return nil
+		})
+	},
+}
+
+// stateFsckCmd represents the state fsck command
+var stateFsckCmd = &cobra.Command{
+	Use:   "fsck <name>",
+	Short: "Check remote klarista state for corruption and missing pieces",
+	Long: `Check that the current remote klarista state is intact and contains the pieces klarista needs, such as tf/terraform.tfstate and tf/output.json.
+
+If the current state fails verification, the history is searched for the newest version that passes, which can be restored with "klarista state rollback". With --repair, pieces that can be rebuilt from the rest of the state are fixed and written as a new version.`,
+	Args: clusterNameArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer recoverStateError(&err)
+
+		name := args[0]
+		localStateDir := path.Join(os.TempDir(), name)
+
+		repair, _ := cmd.Flags().GetBool("repair")
+
+		if err := setStateAwsEnv(localStateDir); err != nil {
+			return err
+		}
+
+		healthy, err := fsckRemoteState(name, repair)
+		if err != nil {
+			return err
+		}
+		if !healthy {
+			return NewStateError(`State of cluster "%s" has problems`, name)
+		}
+		return nil
+	},
+}
+
+// fsckRemoteState - check the current remote state, optionally repairing it, and report whether it is healthy
+func fsckRemoteState(name string, repair bool) (bool, error) {
+	backend, err := getStateBackend(name)
+	if err != nil {
+		return false, err
+	}
+
+	if repair {
+		lock := NewStateLock(lockTTL)
+		if err := acquireStateLock(backend, name, lock); err != nil {
+			return false, err
+		}
+		defer func() {
+			if err := releaseStateLock(backend, lock); err != nil {
+				Logger.Errorf("Failed to release state lock, %v", err)
+			}
+		}()
+	}
+
+	current, err := statRemoteState(backend)
+	if err != nil {
+		return false, err
+	}
+	if !current.Exists {
+		Logger.Errorf("No state found at %s", backend.Location(remoteStateKey))
+		return false, nil
+	}
+
+	healthy := true
+
+	err = useTempDir(func(tmpdir string) error {
+		fp := path.Join(tmpdir, remoteStateKey)
+		if err := downloadRemoteStateVersion(backend, current, fp); err != nil {
+			return fmt.Errorf("Failed to download file, %v", err)
+		}
+
+		fmt.Printf("State %s\n", current)
+
+		result, err := verifyStateArchive(fp)
+		if err != nil {
+			result = &StateVerification{Problems: []string{fmt.Sprintf("The archive can't be read, %v", err)}}
+		}
+		fmt.Println(strings.Join(formatStateVerification(result), "\n"))
+
+		if len(result.Problems) > 0 {
+			healthy = false
+			good, err := findGoodStateVersion(backend, current)
+			if err != nil {
+				return err
+			}
+			if good != nil {
+				fmt.Printf(
+					"\nThe newest version that passes verification is %s from %s. To restore it, run\n\n\tklarista state rollback %s %s\n",
+					good.VersionID,
+					good.LastModified.Format("2006-01-02T15:04:05Z07:00"),
+					name,
+					good.VersionID,
+				)
+			} else {
+				fmt.Println("\nNo earlier version passes verification")
+			}
+			return nil
+		}
+
+		contentDir := path.Join(tmpdir, "content")
+		if err = unpackStateArchive(fp, contentDir); err != nil {
+			return err
+		}
+
+		checks := checkStateContent(contentDir)
+		repairable := false
+		for _, check := range checks {
+			healthy = false
+			note := ""
+			if check.Repairable {
+				repairable = true
+				note = " (repairable)"
+			}
+			fmt.Printf("error: %s: %s%s\n", check.Path, check.Problem, note)
+		}
+
+		if len(checks) == 0 {
+			fmt.Println("Content:         ok")
+			return nil
+		}
+
+		if !repairable {
+			return nil
+		}
+
+		if !repair {
+			fmt.Println("\nRun with --repair to fix repairable problems")
+			return nil
+		}
+
+		if err = repairStateContent(contentDir); err != nil {
+			return fmt.Errorf("Failed to repair state, %v", err)
+		}
+
+		if err = checkStateDowngrade(backend); err != nil {
+			return err
+		}
+
+		migrations, err := readStateMigrationRecord(contentDir)
+		if err != nil {
+			return err
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := writeStateArchive(pw, contentDir, stateCompression)
+			pw.CloseWithError(err)
+		}()
+
+		written, err := backend.Write(remoteStateKey, pr, getRemoteStateMetadata(migrations.StateVersion))
+		pr.CloseWithError(io.ErrClosedPipe)
+		if err != nil {
+			return fmt.Errorf("Failed to upload file, %v", err)
+		}
+
+		Logger.Infof("Repaired state written as %s", written.Version())
+
+		healthy = len(checkStateContent(contentDir)) == 0
+		return nil
+	})
+
+	return healthy, err
+}
+
+// findGoodStateVersion - newest version of the state older than current that passes verification
+func findGoodStateVersion(backend StateBackend, current *RemoteStateVersion) (*StateObject, error) {
+	versions, err := backend.Versions(remoteStateKey)
+	if err != nil {
+		Logger.Warnf("Failed to list state versions, %v", err)
+		return nil, nil
+	}
+
+	var found *StateObject
+
+	err = useTempDir(func(tmpdir string) error {
+		for _, v := range versions {
+			if current.Equal(v.Version()) {
+				continue
+			}
+
+			fp := path.Join(tmpdir, v.VersionID)
+			if err := downloadRemoteStateVersion(backend, v.Version(), fp); err != nil {
+				Logger.Debugf("Failed to download state version %s, %v", v.VersionID, err)
+				continue
+			}
+
+			result, err := verifyStateArchive(fp)
+			if err == nil && len(result.Problems) == 0 {
+				found = v
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return found, err
+}
+
+func init() {
+	stateCmd.AddCommand(stateVerifyCmd)
+	stateCmd.AddCommand(stateFsckCmd)
+	stateFsckCmd.Flags().Bool("repair", false, "Rebuild repairable pieces of the state and write them as a new version")
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeTestStateArchive - write a state archive of a small state dir to fp, without the archive entries in strip
+func writeTestStateArchive(t *testing.T, fp string, strip ...string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(path.Join(dir, "tf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "tf", "output.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := path.Join(t.TempDir(), "signed.tar")
+	file, err := os.Create(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = writeStateArchive(file, dir, stateCompressionNone); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	writer := tar.NewWriter(out)
+	err = useStateArchive(signed, func(hdr *tar.Header, r io.Reader) error {
+		for _, name := range strip {
+			if hdr.Name == name {
+				return nil
+			}
+		}
+		if err := writer.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(writer, r)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyStateArchive(t *testing.T) {
+	tests := []struct {
+		name       string
+		signingKey string
+		strip      []string
+		// wantProblem is a substring of the expected problem, or empty if the archive passes
+		wantProblem string
+		wantWarning string
+	}{
+		{
+			name:       "signed",
+			signingKey: "secret",
+		},
+		{
+			name:        "signed, without a manifest",
+			signingKey:  "secret",
+			strip:       []string{stateManifestPath, stateSignaturePath},
+			wantProblem: "The state has no manifest",
+		},
+		{
+			name:        "signed, without a signature",
+			signingKey:  "secret",
+			strip:       []string{stateSignaturePath},
+			wantProblem: "The manifest is not signed",
+		},
+		{
+			name:        "unsigned, without a manifest",
+			strip:       []string{stateManifestPath},
+			wantWarning: "without a manifest",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(stateSigningKeyEnv, tt.signingKey)
+
+			fp := path.Join(t.TempDir(), remoteStateKey)
+			writeTestStateArchive(t, fp, tt.strip...)
+
+			result, err := verifyStateArchive(fp)
+			if err != nil {
+				t.Fatalf("verifyStateArchive() = %v", err)
+			}
+
+			if tt.wantProblem == "" {
+				if len(result.Problems) > 0 {
+					t.Errorf("problems = %v, want none", result.Problems)
+				}
+			} else if !strings.Contains(strings.Join(result.Problems, "\n"), tt.wantProblem) {
+				t.Errorf("problems = %v, want %q", result.Problems, tt.wantProblem)
+			}
+
+			if tt.wantWarning != "" && !strings.Contains(strings.Join(result.Warnings, "\n"), tt.wantWarning) {
+				t.Errorf("warnings = %v, want %q", result.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
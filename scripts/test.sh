@@ -0,0 +1,48 @@
+#!/bin/bash
+
+# Replay the recorded create, plan and destroy runs of every cluster in test/fixtures
+#
+# No terraform, kops, kubectl or AWS credentials are needed. To re-record a
+# fixture, run the same command against a real cluster with --record instead
+# of --replay.
+
+set -euo pipefail
+
+ROOT=$(cd "$(dirname "$0")/.." && pwd)
+
+WORKDIR=$(mktemp -d)
+trap 'rm -rf "$WORKDIR"' EXIT
+
+go build -o "$WORKDIR/klarista" "$ROOT"
+
+# The fixtures record the environment of each command, so start from a clean one
+unset AWS_PROFILE AWS_REGION CLUSTER KOPS_FEATURE_FLAGS KOPS_STATE_STORE KUBECONFIG S3_ENDPOINT
+
+for FIXTURE in "$ROOT"/test/fixtures/*/; do
+    CLUSTER_NAME=$(basename "$FIXTURE")
+
+    # Each cluster gets its own local state directory and state store
+    export TMPDIR="$WORKDIR/$CLUSTER_NAME"
+    mkdir -p "$TMPDIR"
+
+    for COMMAND in create plan destroy; do
+        if [ ! -f "$FIXTURE/replay/$COMMAND.json" ]; then
+            continue
+        fi
+
+        FLAGS=(--yes)
+        if [ "$COMMAND" = plan ]; then
+            FLAGS=()
+        fi
+
+        echo "Replaying $COMMAND $CLUSTER_NAME"
+        (
+            cd "$FIXTURE"
+            "$WORKDIR/klarista" \
+                --state-backend local \
+                --state-local-dir "$TMPDIR/state" \
+                --replay "replay/$COMMAND.json" \
+                "$COMMAND" "$CLUSTER_NAME" "${FLAGS[@]}"
+        )
+    done
+done
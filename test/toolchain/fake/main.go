@@ -0,0 +1,15 @@
+// Command fake stands in for terraform, kops and kubectl in tests
+//
+// It is installed under the name of each tool by toolchain.New, and answers
+// calls with the responses scripted in scenario.json next to it.
+package main
+
+import (
+	"os"
+
+	"github.com/bfmiv/klarista/test/toolchain"
+)
+
+func main() {
+	os.Exit(toolchain.Fake(os.Args, os.Stdout, os.Stderr))
+}
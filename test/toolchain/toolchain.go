@@ -0,0 +1,410 @@
+// Package toolchain installs fake terraform, kops and kubectl binaries for tests
+//
+// The fakes answer each call with the first scripted response whose tool and
+// leading arguments match, and log every call so that tests can assert on
+// them. Calls that match no rule succeed without output, so only the calls a
+// test cares about need to be scripted.
+//
+//	tc := toolchain.New(t)
+//	tc.On("terraform", "output", "-json").Stdout(`{"aws_region":{"value":"us-east-1"}}`)
+//	tc.On("kops", "validate", "cluster").Times(2).Exit(1)
+//	tc.On("kops", "validate", "cluster").Stdout(`{}`)
+//	tc.On("kops", "update", "cluster").WritesFile("kubernetes.tf", "")
+//
+//	// ... run klarista code that shells out
+//
+//	if n := len(tc.CallsTo("kops", "validate")); n != 3 {
+//		t.Fatalf("kops validate was called %d times", n)
+//	}
+package toolchain
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Tools - the binaries installed by New
+var Tools = []string{"terraform", "kops", "kubectl"}
+
+// Env - the environment variables recorded for each call
+var Env = []string{
+	"AWS_PROFILE",
+	"AWS_REGION",
+	"CLUSTER",
+	"KOPS_FEATURE_FLAGS",
+	"KOPS_STATE_STORE",
+	"KUBECONFIG",
+	"S3_ENDPOINT",
+}
+
+const (
+	scenarioFile = "scenario.json"
+	callsFile    = "calls.jsonl"
+	fakePackage  = "github.com/bfmiv/klarista/test/toolchain/fake"
+)
+
+// Toolchain - fake tools installed in a directory on PATH
+type Toolchain struct {
+	// Dir holds the fake binaries, the scenario and the call log
+	Dir string
+
+	t     testing.TB
+	mu    sync.Mutex
+	rules []*Rule
+}
+
+// Rule - the scripted response to calls of a tool with the given leading arguments
+type Rule struct {
+	Tool string   `json:"tool"`
+	Args []string `json:"args"`
+	// Limit is the number of calls the rule answers, or 0 for every call
+	Limit    int               `json:"limit"`
+	Output   string            `json:"stdout"`
+	Errors   string            `json:"stderr"`
+	ExitCode int               `json:"exit_code"`
+	Files    map[string]string `json:"files"`
+
+	tc *Toolchain
+}
+
+// Call - one logged call of a fake tool
+type Call struct {
+	Tool string            `json:"tool"`
+	Args []string          `json:"args"`
+	Dir  string            `json:"dir"`
+	Env  map[string]string `json:"env"`
+	// Rule is the index of the rule that answered the call, or -1
+	Rule int `json:"rule"`
+}
+
+func (c *Call) String() string {
+	return strings.Join(append([]string{c.Tool}, c.Args...), " ")
+}
+
+// buildOnce - the fake is built once per test binary and copied into each toolchain
+var (
+	buildOnce sync.Once
+	buildPath string
+	buildErr  error
+)
+
+func build() (string, error) {
+	buildOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "klarista-toolchain")
+		if err != nil {
+			buildErr = err
+			return
+		}
+
+		buildPath = filepath.Join(dir, "fake")
+		cmd := exec.Command("go", "build", "-o", buildPath, fakePackage)
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			buildErr = fmt.Errorf("Failed to build %s, %v\n%s", fakePackage, err, output)
+		}
+	})
+
+	return buildPath, buildErr
+}
+
+// New - install the fake tools in a temporary directory at the front of PATH
+//
+// PATH is restored when the test finishes.
+func New(t testing.TB) *Toolchain {
+	t.Helper()
+
+	fake, err := build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &Toolchain{Dir: t.TempDir(), t: t}
+
+	for _, tool := range Tools {
+		if err = copyFile(fake, filepath.Join(tc.Dir, tool)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc.save()
+
+	t.Setenv("PATH", tc.Dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return tc
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// On - script the response to calls of tool whose arguments start with args
+//
+// Rules are tried in the order they were added, so a limited rule followed by
+// an unlimited one scripts a sequence, e.g. "fails twice, then succeeds".
+func (tc *Toolchain) On(tool string, args ...string) *Rule {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	rule := &Rule{Tool: tool, Args: args, tc: tc}
+	tc.rules = append(tc.rules, rule)
+	tc.saveLocked()
+
+	return rule
+}
+
+func (tc *Toolchain) save() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.saveLocked()
+}
+
+func (tc *Toolchain) saveLocked() {
+	tc.t.Helper()
+
+	data, err := json.MarshalIndent(tc.rules, "", "  ")
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(tc.Dir, scenarioFile), data, 0644); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// Times - answer only the next n matching calls
+func (r *Rule) Times(n int) *Rule {
+	return r.update(func() { r.Limit = n })
+}
+
+// Once - answer only the next matching call
+func (r *Rule) Once() *Rule {
+	return r.Times(1)
+}
+
+// Stdout - write s to stdout
+func (r *Rule) Stdout(s string) *Rule {
+	return r.update(func() { r.Output = s })
+}
+
+// Stderr - write s to stderr
+func (r *Rule) Stderr(s string) *Rule {
+	return r.update(func() { r.Errors = s })
+}
+
+// Exit - exit with the given status
+func (r *Rule) Exit(code int) *Rule {
+	return r.update(func() { r.ExitCode = code })
+}
+
+// WritesFile - write a file, relative to the working directory of the call
+//
+// Environment variables in the path are expanded, e.g. "$KUBECONFIG".
+func (r *Rule) WritesFile(path, content string) *Rule {
+	return r.update(func() {
+		if r.Files == nil {
+			r.Files = map[string]string{}
+		}
+		r.Files[path] = content
+	})
+}
+
+func (r *Rule) update(cb func()) *Rule {
+	r.tc.mu.Lock()
+	defer r.tc.mu.Unlock()
+	cb()
+	r.tc.saveLocked()
+	return r
+}
+
+// Calls - every call of a fake tool, in order
+func (tc *Toolchain) Calls() []*Call {
+	tc.t.Helper()
+
+	calls, err := readCalls(tc.Dir)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return calls
+}
+
+// CallsTo - the calls of tool whose arguments start with args
+func (tc *Toolchain) CallsTo(tool string, args ...string) []*Call {
+	tc.t.Helper()
+
+	var calls []*Call
+	for _, call := range tc.Calls() {
+		if call.Tool == tool && hasArgs(call.Args, args) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func readCalls(dir string) ([]*Call, error) {
+	file, err := os.Open(filepath.Join(dir, callsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var calls []*Call
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var call Call
+		if err = json.Unmarshal(scanner.Bytes(), &call); err != nil {
+			return nil, err
+		}
+		calls = append(calls, &call)
+	}
+
+	return calls, scanner.Err()
+}
+
+func hasArgs(args, prefix []string) bool {
+	if len(prefix) > len(args) {
+		return false
+	}
+	for i, arg := range prefix {
+		if args[i] != arg {
+			return false
+		}
+	}
+	return true
+}
+
+// Fake - run a fake tool. Called by the fake binary with its own arguments
+func Fake(args []string, stdout, stderr io.Writer) int {
+	tool := filepath.Base(args[0])
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 127
+	}
+	dir := filepath.Dir(exe)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, scenarioFile))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 127
+	}
+
+	var rules []*Rule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 127
+	}
+
+	calls, err := readCalls(dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 127
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 127
+	}
+
+	call := &Call{
+		Tool: tool,
+		Args: args[1:],
+		Dir:  cwd,
+		Env:  map[string]string{},
+		Rule: -1,
+	}
+	for _, key := range Env {
+		if value, ok := os.LookupEnv(key); ok {
+			call.Env[key] = value
+		}
+	}
+
+	// Find the first rule that matches and hasn't answered its limit of calls
+	for i, rule := range rules {
+		if rule.Tool != tool || !hasArgs(call.Args, rule.Args) {
+			continue
+		}
+
+		answered := 0
+		for _, c := range calls {
+			if c.Rule == i {
+				answered++
+			}
+		}
+		if rule.Limit > 0 && answered >= rule.Limit {
+			continue
+		}
+
+		call.Rule = i
+		break
+	}
+
+	if err = appendCall(dir, call); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 127
+	}
+
+	if call.Rule == -1 {
+		return 0
+	}
+
+	rule := rules[call.Rule]
+
+	for fp, content := range rule.Files {
+		fp = os.ExpandEnv(fp)
+		if err = os.MkdirAll(filepath.Dir(fp), 0755); err == nil {
+			err = ioutil.WriteFile(fp, []byte(content), 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 127
+		}
+	}
+
+	fmt.Fprint(stdout, rule.Output)
+	fmt.Fprint(stderr, rule.Errors)
+
+	return rule.ExitCode
+}
+
+func appendCall(dir string, call *Call) error {
+	data, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, callsFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}